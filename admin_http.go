@@ -0,0 +1,207 @@
+package statsdaemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/raintank/statsdaemon/out"
+	log "github.com/sirupsen/logrus"
+	"github.com/tv42/topic"
+)
+
+// adminHandler serves the http admin api. it offers the commands of the telnet api with json responses:
+//
+//	GET /sample_rate?key=<metric key>  ideal sample rate and estimated packets/s sent for the key
+//	GET /metric_stats                  for every metric in the past 10s interval, packets/s sent (estimated) and received
+//	GET /clients[?n=<n>]               for the top n (default 20, 0 for all) senders in the past 10s interval,
+//	                                   packets/s, lines/s and invalid lines/s received
+//	GET /wait_flush                    responds after the next flush
+//	GET /peek_valid, /peek_invalid     streams the valid resp. invalid lines as they come in, one per line,
+//	                                   or as server-sent events if the client accepts text/event-stream.
+//	                                   invalid lines are prefixed with the reason, and with /peek_invalid?source=1,
+//	                                   the source that sent them
+//	GET /rules_test?line=<line>[&rule=<rule>]
+//	                                   applies the filter rules, or the given rule, to the metrics of the statsd line
+//	GET /bucket_limits                 for every bucket limit, the buckets accepted and metrics rejected in the last interval
+//	GET /health                        status of the daemon, 503 when it is shutting down
+//	GET /version                       version information
+func (s *StatsDaemon) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sample_rate", s.httpSampleRate)
+	mux.HandleFunc("/metric_stats", s.httpMetricStats)
+	mux.HandleFunc("/clients", s.httpClients)
+	mux.HandleFunc("/wait_flush", s.httpWaitFlush)
+	mux.HandleFunc("/peek_valid", s.httpPeek(s.valid_lines))
+	mux.HandleFunc("/peek_invalid", s.httpPeek(s.Invalid_lines))
+	mux.HandleFunc("/rules_test", s.httpRulesTest)
+	mux.HandleFunc("/bucket_limits", s.httpBucketLimits)
+	mux.HandleFunc("/health", s.httpHealth)
+	mux.HandleFunc("/version", s.httpVersion)
+	return mux
+}
+
+func (s *StatsDaemon) adminHTTPListener(addr string) {
+	log.Infof("http admin api listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, s.adminHandler()))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, a...)})
+}
+
+// metricStats has metricStatsMonitor execute the command, and returns the result.
+// ok is false if the client went away in the meantime.
+func (s *StatsDaemon) metricStats(r *http.Request, command ...string) (interface{}, bool) {
+	reply := make(chan interface{}, 1)
+	select {
+	case s.metricStatsRequests <- metricsStatsReq{Command: command, Reply: reply}:
+	case <-r.Context().Done():
+		return nil, false
+	}
+	select {
+	case res := <-reply:
+		return res, true
+	case <-r.Context().Done():
+		return nil, false
+	}
+}
+
+func (s *StatsDaemon) httpSampleRate(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing key parameter")
+		return
+	}
+	if res, ok := s.metricStats(r, "sample_rate", key); ok {
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+func (s *StatsDaemon) httpMetricStats(w http.ResponseWriter, r *http.Request) {
+	if res, ok := s.metricStats(r, "metric_stats"); ok {
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+func (s *StatsDaemon) httpClients(w http.ResponseWriter, r *http.Request) {
+	command := []string{"clients"}
+	if n := r.URL.Query().Get("n"); n != "" {
+		if top, err := strconv.Atoi(n); err != nil || top < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid n parameter %q", n)
+			return
+		}
+		command = append(command, n)
+	}
+	if res, ok := s.metricStats(r, command...); ok {
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+func (s *StatsDaemon) httpWaitFlush(w http.ResponseWriter, r *http.Request) {
+	consumer := make(chan interface{}, 10)
+	s.events.Register(consumer)
+	defer s.events.Unregister(consumer)
+	select {
+	case ev, ok := <-consumer:
+		if !ok {
+			writeJSONError(w, http.StatusServiceUnavailable, "missed the flush event")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"event": ev.(string)})
+	case <-r.Context().Done():
+	}
+}
+
+// httpPeek streams the lines of the topic until the client disconnects or can't keep up
+func (s *StatsDaemon) httpPeek(lines *topic.Topic) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+			return
+		}
+		withSource, _ := strconv.ParseBool(r.URL.Query().Get("source"))
+		consumer := make(chan interface{}, 100)
+		lines.Register(consumer)
+		defer lines.Unregister(consumer)
+
+		sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+		if sse {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		for {
+			select {
+			case line, ok := <-consumer:
+				if !ok {
+					return
+				}
+				if invalid, ok := line.(out.InvalidLine); ok {
+					line = invalidLine(invalid, withSource)
+				}
+				if sse {
+					fmt.Fprintf(w, "data: %s\n\n", line)
+				} else {
+					fmt.Fprintf(w, "%s\n", line)
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func (s *StatsDaemon) httpRulesTest(w http.ResponseWriter, r *http.Request) {
+	line := r.URL.Query().Get("line")
+	if line == "" {
+		writeJSONError(w, http.StatusBadRequest, "missing line parameter")
+		return
+	}
+	results, err := s.dryRun(line, r.URL.Query().Get("rule"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (s *StatsDaemon) httpBucketLimits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.limiter.stats())
+}
+
+func (s *StatsDaemon) httpHealth(w http.ResponseWriter, r *http.Request) {
+	status, code := "ok", http.StatusOK
+	select {
+	case <-s.stop:
+		status, code = "stopping", http.StatusServiceUnavailable
+	default:
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"status":   status,
+		"instance": s.instance,
+		"uptime_s": int64(s.Clock.Now().Sub(s.started).Seconds()),
+	})
+}
+
+func (s *StatsDaemon) httpVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"version":    s.Version,
+		"git_hash":   s.GitHash,
+		"go_version": runtime.Version(),
+	})
+}
@@ -0,0 +1,181 @@
+package statsdaemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/bmizerany/assert"
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+)
+
+func newAdminTestDaemon() (*StatsDaemon, *httptest.Server) {
+	daemon := New("test", testConfig(), testSettings(), nil)
+	daemon.Clock = clock.NewMock()
+	daemon.started = daemon.Clock.Now()
+	go daemon.metricStatsMonitor()
+	return daemon, httptest.NewServer(daemon.adminHandler())
+}
+
+func getJSON(t *testing.T, url string, v interface{}) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("Content-Type"), "application/json")
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+func TestAdminHTTPStats(t *testing.T) {
+	daemon, srv := newAdminTestDaemon()
+	defer srv.Close()
+
+	daemon.metricAmounts <- []*common.Metric{{Bucket: "foo", Value: 1, Modifier: "ms", Sampling: 0.1}}
+	daemon.Clock.(*clock.Mock).Add(10 * time.Second)
+
+	var stats []MetricStats
+	deadline := time.Now().Add(5 * time.Second)
+	for len(stats) == 0 && time.Now().Before(deadline) {
+		assert.Equal(t, getJSON(t, srv.URL+"/metric_stats", &stats), http.StatusOK)
+	}
+	assert.Equal(t, stats, []MetricStats{{Bucket: "foo", SubmittedPerS: 1, SeenPerS: 0.1}})
+
+	var rate SampleRate
+	assert.Equal(t, getJSON(t, srv.URL+"/sample_rate?key=foo", &rate), http.StatusOK)
+	assert.Equal(t, rate, SampleRate{Bucket: "foo", IdealSampleRate: 1, SubmittedPerS: 1})
+
+	var e map[string]string
+	assert.Equal(t, getJSON(t, srv.URL+"/sample_rate", &e), http.StatusBadRequest)
+	assert.Equal(t, e["error"], "missing key parameter")
+}
+
+func TestAdminHTTPClients(t *testing.T) {
+	daemon, srv := newAdminTestDaemon()
+	defer srv.Close()
+
+	daemon.clientAmounts <- []out.ClientAmounts{{Source: "10.0.0.1", Packets: 10, Lines: 20}, {Source: "10.0.0.2", Packets: 10, Lines: 30, Invalid: 10}}
+	daemon.clientAmounts <- []out.ClientAmounts{{Source: "10.0.0.1", Packets: 10, Lines: 20}}
+	daemon.Clock.(*clock.Mock).Add(10 * time.Second)
+
+	var stats []ClientStats
+	deadline := time.Now().Add(5 * time.Second)
+	for len(stats) == 0 && time.Now().Before(deadline) {
+		assert.Equal(t, getJSON(t, srv.URL+"/clients", &stats), http.StatusOK)
+	}
+	assert.Equal(t, stats, []ClientStats{{"10.0.0.1", 2, 4, 0}, {"10.0.0.2", 1, 3, 1}})
+
+	assert.Equal(t, getJSON(t, srv.URL+"/clients?n=1", &stats), http.StatusOK)
+	assert.Equal(t, stats, []ClientStats{{"10.0.0.1", 2, 4, 0}})
+
+	var e map[string]string
+	assert.Equal(t, getJSON(t, srv.URL+"/clients?n=x", &e), http.StatusBadRequest)
+}
+
+func TestAdminHTTPWaitFlush(t *testing.T) {
+	daemon, srv := newAdminTestDaemon()
+	defer srv.Close()
+
+	done := make(chan map[string]string)
+	go func() {
+		var ev map[string]string
+		getJSON(t, srv.URL+"/wait_flush", &ev)
+		done <- ev
+	}()
+	// the request may not have registered yet, so keep flushing
+	for {
+		daemon.events.Broadcast <- "flush"
+		select {
+		case ev := <-done:
+			assert.Equal(t, ev, map[string]string{"event": "flush"})
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestAdminHTTPPeek(t *testing.T) {
+	daemon, srv := newAdminTestDaemon()
+	defer srv.Close()
+
+	cases := []struct {
+		path    string
+		accept  string
+		ctype   string
+		expLine string
+	}{
+		{"/peek_valid", "", "text/plain; charset=utf-8", "foo:1|c\n"},
+		{"/peek_invalid", "text/event-stream", "text/event-stream", "data: invalid_value foo:x|c\n"},
+		{"/peek_invalid?source=1", "", "text/plain; charset=utf-8", "10.0.0.1 invalid_value foo:x|c\n"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", srv.URL+c.path, nil)
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, resp.Header.Get("Content-Type"), c.ctype)
+		// the consumer is registered once the headers are sent
+		if c.path == "/peek_valid" {
+			daemon.valid_lines.Broadcast <- []byte("foo:1|c")
+		} else {
+			daemon.Invalid_lines.Broadcast <- out.InvalidLine{Source: "10.0.0.1", Reason: "invalid_value", Line: []byte("foo:x|c")}
+		}
+		line, err := bufio.NewReader(resp.Body).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, line, c.expLine)
+		resp.Body.Close()
+	}
+}
+
+func TestAdminHTTPRulesTest(t *testing.T) {
+	_, srv := newAdminTestDaemon()
+	defer srv.Close()
+
+	var res []DryRun
+	assert.Equal(t, getJSON(t, srv.URL+"/rules_test?line="+url.QueryEscape("foo.bar:1|c")+"&rule="+url.QueryEscape("rewrite ^foo baz"), &res), http.StatusOK)
+	assert.Equal(t, res, []DryRun{{Bucket: "foo.bar", Type: "c", Matches: []RuleMatch{{"rewrite ^foo baz name=1", "foo.bar"}}, Kept: true, Result: "baz.bar"}})
+
+	var e map[string]string
+	assert.Equal(t, getJSON(t, srv.URL+"/rules_test?line=foo", &e), http.StatusBadRequest)
+	assert.Equal(t, getJSON(t, srv.URL+"/rules_test", &e), http.StatusBadRequest)
+}
+
+func TestAdminHTTPHealth(t *testing.T) {
+	daemon, srv := newAdminTestDaemon()
+	defer srv.Close()
+	daemon.Version = "1.2"
+	daemon.Clock.(*clock.Mock).Add(time.Minute)
+
+	var health map[string]interface{}
+	assert.Equal(t, getJSON(t, srv.URL+"/health", &health), http.StatusOK)
+	assert.Equal(t, health, map[string]interface{}{"status": "ok", "instance": "test", "uptime_s": 60.0})
+
+	var version map[string]string
+	assert.Equal(t, getJSON(t, srv.URL+"/version", &version), http.StatusOK)
+	assert.Equal(t, version["version"], "1.2")
+	assert.T(t, strings.HasPrefix(version["go_version"], "go"), version)
+
+	var limits []LimitStats
+	assert.Equal(t, getJSON(t, srv.URL+"/bucket_limits", &limits), http.StatusOK)
+	assert.Equal(t, limits, []LimitStats{})
+
+	close(daemon.stop)
+	assert.Equal(t, getJSON(t, srv.URL+"/health", &health), http.StatusServiceUnavailable)
+	assert.Equal(t, health["status"], "stopping")
+}
@@ -0,0 +1,204 @@
+package statsdaemon
+
+import (
+	"fmt"
+
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+)
+
+// aggregate holds the datastructures for one flush interval
+type aggregate struct {
+	c    *out.Counters
+	g    *out.Gauges
+	t    *out.Timers
+	sets *out.Sets
+	h    *out.Histograms
+}
+
+// merge adds the data of other, which must cover different buckets, into a.
+// only the internal counters are shared, and they get summed.
+func (a *aggregate) merge(other *aggregate) {
+	a.c.Merge(other.c)
+	a.g.Merge(other.g)
+	a.t.Merge(other.t)
+	a.sets.Merge(other.sets)
+	a.h.Merge(other.h)
+}
+
+// aggregatorMsg is either a batch of metrics to add, or a request to flush,
+// in which case the aggregator sends the data of the interval that just ended to flush.
+type aggregatorMsg struct {
+	metrics []*common.Metric
+	flush   chan<- *aggregate
+}
+
+// aggregator owns the datastructures for a subset (shard) of the buckets.
+// when running with a single shard, metricsMonitor drives it directly,
+// otherwise each aggregator runs in its own goroutine, fed through its in channel.
+type aggregator struct {
+	s *StatsDaemon
+	aggregate
+	in chan aggregatorMsg
+
+	oneCounter   *common.Metric
+	oneGauge     *common.Metric
+	oneTimer     *common.Metric
+	oneHistogram *common.Metric
+	oneSet       *common.Metric
+}
+
+func newAggregator(s *StatsDaemon) *aggregator {
+	internal := func(name string) *common.Metric {
+		return &common.Metric{
+			Bucket:   fmt.Sprintf("%sdirection_is_in.statsd_type_is_%s.mtype_is_count.unit_is_Metric", s.fmt.PrefixInternal, name),
+			Value:    1,
+			Sampling: 1,
+		}
+	}
+	a := &aggregator{
+		s:            s,
+		in:           make(chan aggregatorMsg, s.max_unprocessed),
+		oneCounter:   internal("counter"),
+		oneGauge:     internal("gauge"),
+		oneTimer:     internal("timer"),
+		oneHistogram: internal("histogram"),
+		oneSet:       internal("set"),
+	}
+	a.reset()
+	return a
+}
+
+// reset sets up the datastructures for the next interval
+func (a *aggregator) reset() {
+	s := a.s
+	a.c = out.NewCounters(s.flush_rates, s.flush_counts)
+	if a.g == nil || s.delete_gauges {
+		a.g = out.NewGauges()
+	} else {
+		a.g = a.g.CarryOver(s.gaugeMaxIdle())
+	}
+	if s.timerCompression > 0 {
+		a.t = out.NewTDigestTimers(s.pct, s.timerCompression)
+	} else {
+		a.t = out.NewTimers(s.pct)
+	}
+	a.sets = out.NewSets(s.setHllThreshold)
+	a.h = out.NewHistograms(s.histogramSpecs)
+	for _, name := range []string{"timer", "gauge", "counter", "set", "histogram"} {
+		a.c.Add(&common.Metric{
+			Bucket:   fmt.Sprintf("%sdirection_is_in.statsd_type_is_%s.mtype_is_count.unit_is_Metric", s.fmt.PrefixInternal, name),
+			Sampling: 1,
+		})
+	}
+}
+
+// gaugeMaxIdle returns after how many intervals without updates the gauges that are carried over are dropped,
+// according to gauge_expiry and the current flush interval. 0 means never.
+func (s *StatsDaemon) gaugeMaxIdle() int {
+	return (s.gauge_expiry + s.flushInterval - 1) / s.flushInterval
+}
+
+// take returns the data of the current interval, and resets the aggregator for the next one
+func (a *aggregator) take() *aggregate {
+	data := a.aggregate
+	a.reset()
+	return &data
+}
+
+func (a *aggregator) add(metrics []*common.Metric) {
+	for _, m := range metrics {
+		if m.Modifier == "ms" {
+			a.t.Add(m)
+			a.h.Add(m)
+			a.c.Add(a.oneTimer)
+		} else if m.Modifier == "h" {
+			a.t.Add(m)
+			a.h.Add(m)
+			a.c.Add(a.oneHistogram)
+		} else if m.Modifier == "g" {
+			a.g.Add(m)
+			a.c.Add(a.oneGauge)
+		} else if m.Modifier == "s" {
+			a.sets.Add(m)
+			a.c.Add(a.oneSet)
+		} else {
+			a.c.Add(m)
+			a.c.Add(a.oneCounter)
+		}
+	}
+}
+
+// run processes the messages for a shard
+func (a *aggregator) run() {
+	for msg := range a.in {
+		if msg.flush != nil {
+			msg.flush <- a.take()
+			continue
+		}
+		a.add(msg.metrics)
+	}
+}
+
+// shardFilter applies the filter rules and the bucket limits to a shard of the incoming buckets, so that
+// they run in parallel too. it passes the metrics on to the aggregators that own their buckets, which may be
+// different ones if the rules rewrite them.
+type shardFilter struct {
+	s      *StatsDaemon
+	filter *filter
+	aggs   []*aggregator
+	in     chan shardFilterMsg
+}
+
+// shardFilterMsg is either a batch of metrics, or a request to sync, which the shardFilter acknowledges
+// on synced once it has passed on all metrics it received before.
+type shardFilterMsg struct {
+	metrics []*common.Metric
+	synced  chan<- struct{}
+}
+
+func newShardFilter(s *StatsDaemon, aggs []*aggregator) *shardFilter {
+	return &shardFilter{
+		s:      s,
+		filter: newFilter(s.currentRules(), s.fmt.PrefixInternal),
+		aggs:   aggs,
+		in:     make(chan shardFilterMsg, s.max_unprocessed),
+	}
+}
+
+// run processes the messages for a shard
+func (f *shardFilter) run() {
+	for msg := range f.in {
+		if msg.synced != nil {
+			msg.synced <- struct{}{}
+			continue
+		}
+		metrics := f.s.limiter.apply(f.filter.apply(msg.metrics))
+		for i, batch := range splitShards(metrics, len(f.aggs)) {
+			if batch != nil {
+				f.aggs[i].in <- aggregatorMsg{metrics: batch}
+			}
+		}
+	}
+}
+
+// splitShards splits the metrics in batches per shard
+func splitShards(metrics []*common.Metric, shards int) [][]*common.Metric {
+	batches := make([][]*common.Metric, shards)
+	for _, m := range metrics {
+		i := shardOf(m.Bucket, shards)
+		batches[i] = append(batches[i], m)
+	}
+	return batches
+}
+
+// shardOf returns the shard for the given bucket, using FNV-1a.
+// all metrics for a bucket go to the same shard, so that they are applied in order.
+func shardOf(bucket string, shards int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(bucket); i++ {
+		h ^= uint32(bucket[i])
+		h *= 16777619
+	}
+	return int(h % uint32(shards))
+}
@@ -0,0 +1,459 @@
+package statsdaemon
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+	log "github.com/sirupsen/logrus"
+)
+
+// backendQueueSize is the amount of payloads (flushes) a backend can buffer while its destination is slow or unavailable
+const backendQueueSize = 1000
+
+// backendSpoolAfter is the amount of payloads a backend with a spool keeps in memory, before writing them to the spool
+const backendSpoolAfter = 10
+
+// backendQueue implements the queueing part of out.Backend, and the internal metrics that go with it.
+// the internal metrics are fed back into the daemon, so they are sent to all backends.
+type backendQueue struct {
+	name     string
+	id       string // name and destination, if any
+	queue    chan []out.Point
+	done     chan struct{}
+	stop     chan struct{} // closed when the writer has to give up, see Stop
+	internal chan<- []*common.Metric
+	spool    *spool
+	busy     int32 // 1 while the writer is working on a payload, accessed atomically
+
+	lock      sync.Mutex
+	stopped   bool          // set once Stop starts, guarded by lock
+	successor *backendQueue // that took over on reload, guarded by lock
+
+	sendMetric  string
+	queueMetric string
+	dropMetric  string
+
+	spoolMetric     string
+	spoolDropMetric string
+}
+
+// newBackendQueue creates the queue for a backend. dest identifies the destination,
+// for backends that have multiple, and is empty otherwise.
+func newBackendQueue(name, dest, prefixInternal string, internal chan<- []*common.Metric) backendQueue {
+	id := name
+	if dest != "" {
+		id += ".destination_is_" + strings.NewReplacer(".", "_", ":", "_").Replace(dest)
+	}
+	return backendQueue{
+		name:            name,
+		id:              id,
+		queue:           make(chan []out.Point, backendQueueSize),
+		done:            make(chan struct{}),
+		stop:            make(chan struct{}),
+		internal:        internal,
+		sendMetric:      fmt.Sprintf("%smtype_is_gauge.type_is_send.backend_is_%s.unit_is_ms", prefixInternal, id),
+		queueMetric:     fmt.Sprintf("%smtype_is_gauge.type_is_queue.backend_is_%s.unit_is_Payload", prefixInternal, id),
+		dropMetric:      fmt.Sprintf("%smtype_is_count.type_is_drop.backend_is_%s.unit_is_Payload", prefixInternal, id),
+		spoolMetric:     fmt.Sprintf("%smtype_is_gauge.type_is_spool.backend_is_%s.unit_is_Payload", prefixInternal, id),
+		spoolDropMetric: fmt.Sprintf("%smtype_is_count.type_is_spool_drop.backend_is_%s.unit_is_Payload", prefixInternal, id),
+	}
+}
+
+// enableSpool makes the backend buffer payloads on disk, in a subdirectory of dir, when it falls behind.
+// it must be called before the backend is started.
+func (b *backendQueue) enableSpool(dir string, maxSize int64, maxAge time.Duration) error {
+	sp, err := openSpool(filepath.Join(dir, b.id), maxSize, maxAge)
+	if err != nil {
+		return err
+	}
+	b.spool = sp
+	return nil
+}
+
+// Submit enqueues the points. if the backend is behind, they go to the spool if there is one,
+// otherwise they are dropped once the queue is full.
+// to keep the payloads in order, they keep going to the spool until the writer has caught up with it.
+func (b *backendQueue) Submit(points []out.Point) {
+	if b.spool != nil {
+		if len(b.queue) < backendSpoolAfter && b.spool.len() == 0 {
+			b.queue <- points
+			return
+		}
+		dropped, err := b.spool.push(points)
+		if err != nil {
+			log.Errorf("%s: can't spool payload, dropping %d points: %s", b.name, len(points), err)
+			b.dropped()
+		}
+		b.spoolDropped(dropped)
+		b.report([]*common.Metric{{Bucket: b.spoolMetric, Value: float64(b.spool.len()), Modifier: "g", Sampling: 1}})
+		return
+	}
+	select {
+	case b.queue <- points:
+	default:
+		log.Errorf("%s queue is full, dropping %d points", b.name, len(points))
+		b.dropped()
+	}
+}
+
+// next returns the next payload for the writer: from the queue, or once that's empty, from the spool.
+// it returns false when the backend is stopped, or the writer has to give up.
+func (b *backendQueue) next() ([]out.Point, bool) {
+	atomic.StoreInt32(&b.busy, 0)
+	points, ok := b.nextPayload()
+	if ok {
+		atomic.StoreInt32(&b.busy, 1)
+	}
+	return points, ok
+}
+
+func (b *backendQueue) nextPayload() ([]out.Point, bool) {
+	var notify chan struct{}
+	if b.spool != nil {
+		notify = b.spool.notify
+	}
+	for {
+		select {
+		case <-b.stop:
+			return nil, false
+		default:
+		}
+		select {
+		case points, ok := <-b.queue:
+			return points, ok
+		default:
+		}
+		if b.spool != nil {
+			points, dropped, ok := b.spool.pop()
+			b.spoolDropped(dropped)
+			if ok {
+				return points, true
+			}
+		}
+		select {
+		case points, ok := <-b.queue:
+			return points, ok
+		case <-notify:
+		case <-b.stop:
+			return nil, false
+		}
+	}
+}
+
+// spoolDropped reports payloads that the spool dropped because of its size or age limits
+func (b *backendQueue) spoolDropped(n int) {
+	if n > 0 {
+		log.Errorf("%s: spool dropped %d payloads", b.name, n)
+		b.report([]*common.Metric{{Bucket: b.spoolDropMetric, Value: float64(n), Modifier: "c", Sampling: 1}})
+	}
+}
+
+// Stop closes the queue and waits until the writer has processed all of it, or the timeout passes,
+// in which case the writer is told to give up, rather than keep retrying in the background.
+// payloads in the spool are left for the next run, and so are those still in the queue when the timeout passes.
+// without a spool, they are lost, along with the payload that the writer is working on.
+func (b *backendQueue) Stop(timeout time.Duration) int {
+	return b.stopTo(timeout, nil)
+}
+
+// stopTo is like Stop, but when the backend is replaced on reload, the payloads that are still queued
+// when the timeout passes are handed to its successor, if any, instead.
+// a successor for the same destination shares the spool, so it's left open for it.
+func (b *backendQueue) stopTo(timeout time.Duration, successor *backendQueue) int {
+	b.lock.Lock()
+	b.stopped = true
+	b.successor = successor
+	b.lock.Unlock()
+	ownSpool := b.spool != nil && (successor == nil || successor.spool != b.spool)
+	close(b.queue)
+	select {
+	case <-b.done:
+		if ownSpool {
+			b.spool.close()
+		}
+		return 0
+	case <-time.After(timeout):
+	}
+	close(b.stop)
+	lost := 0
+	if successor != nil {
+		handed := 0
+		for points := range b.queue {
+			if !successor.accept(points) {
+				lost++
+				continue
+			}
+			handed++
+		}
+		if ownSpool {
+			b.spool.close()
+		}
+		log.Warnf("%s: timed out after %s, handed %d queued payloads to the new backend", b.id, timeout, handed)
+	} else if b.spool != nil {
+		spooled := 0
+		for points := range b.queue {
+			if _, err := b.spool.push(points); err != nil {
+				log.Errorf("%s: can't spool payload: %s", b.id, err)
+				lost++
+				continue
+			}
+			spooled++
+		}
+		b.spool.close()
+		log.Warnf("%s: timed out after %s, spooled %d queued payloads for the next run", b.id, timeout, spooled)
+	} else {
+		lost += len(b.queue)
+	}
+	lost += int(atomic.LoadInt32(&b.busy))
+	if lost > 0 {
+		log.Errorf("%s: timed out after %s, %d payloads were not written and are lost", b.id, timeout, lost)
+	}
+	return lost
+}
+
+// accept takes over a payload from the backend that this one replaced. if this one has been
+// replaced in the meantime too, the payload is passed on. it returns false if nothing takes it.
+func (b *backendQueue) accept(points []out.Point) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.stopped {
+		if b.successor == nil {
+			return false
+		}
+		return b.successor.accept(points)
+	}
+	b.Submit(points)
+	return true
+}
+
+// queues returns the queues of the backend, see queuedBackend
+func (b *backendQueue) queues() []*backendQueue {
+	return []*backendQueue{b}
+}
+
+// sent reports the duration of a successful send, and the remaining queue (and spool) size
+func (b *backendQueue) sent(duration time.Duration) {
+	metrics := []*common.Metric{
+		{Bucket: b.sendMetric, Value: float64(duration.Nanoseconds()) / float64(1000000), Modifier: "g", Sampling: 1},
+		{Bucket: b.queueMetric, Value: float64(len(b.queue)), Modifier: "g", Sampling: 1},
+	}
+	if b.spool != nil {
+		metrics = append(metrics, &common.Metric{Bucket: b.spoolMetric, Value: float64(b.spool.len()), Modifier: "g", Sampling: 1})
+	}
+	b.report(metrics)
+}
+
+// dropped reports a payload that was dropped
+func (b *backendQueue) dropped() {
+	b.report([]*common.Metric{{Bucket: b.dropMetric, Value: 1, Modifier: "c", Sampling: 1}})
+}
+
+// report feeds internal metrics back into the daemon, unless it can't keep up (e.g. because it is shutting down)
+func (b *backendQueue) report(metrics []*common.Metric) {
+	select {
+	case b.internal <- metrics:
+	default:
+	}
+}
+
+// newBackends creates the backends with the given names
+func (s *StatsDaemon) newBackends(names []string) ([]out.Backend, error) {
+	var backends []out.Backend
+	for _, name := range names {
+		switch name {
+		case "graphite":
+			b, err := s.newGraphiteBackends()
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, b)
+		case "tsdbgw":
+			b := newTsdbgwBackend(s.tsdbgw_addr, s.tsdbgw_api_key, s.orgid, s.flushInterval, s.fmt.PrefixInternal, s.Metrics)
+			if s.spool_dir != "" {
+				if err := s.enableSpool(&b.backendQueue); err != nil {
+					return nil, err
+				}
+			}
+			backends = append(backends, b)
+		case "opentsdb":
+			b, err := newOpentsdbBackend(s.opentsdb_addr, s.opentsdb_batch_size, map[string]string{"instance": s.instance}, s.Clock, s.fmt.PrefixInternal, s.Metrics)
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, b)
+		case "influxdb":
+			b, err := newInfluxdbBackend(s.influxdb_addr, s.influxdb_batch_size, s.influxdb_gzip, s.fmt.PrefixInternal, s.Metrics)
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, b)
+		default:
+			return nil, fmt.Errorf("unknown backend %q", name)
+		}
+	}
+	return backends, nil
+}
+
+// newGraphiteBackends creates a backend for each of the graphite destinations.
+// with several, they're combined by a router, and their internal metrics are identified by destination.
+func (s *StatsDaemon) newGraphiteBackends() (out.Backend, error) {
+	dests, err := parseGraphiteDestinations(s.graphite_addr)
+	if err != nil {
+		return nil, err
+	}
+	var backends []*tcpBackend
+	for _, d := range dests {
+		id := ""
+		if len(dests) > 1 {
+			id = d.addr
+			if d.instance != "" {
+				id += ":" + d.instance
+			}
+		}
+		if s.graphite_protocol == "pickle" {
+			backends = append(backends, newGraphitePickleBackend(d.addr, id, s.graphite_pickle_batch_size, s.Clock, s.fmt.PrefixInternal, s.Metrics))
+		} else {
+			backends = append(backends, newGraphiteBackend(d.addr, id, s.Clock, s.fmt.PrefixInternal, s.Metrics))
+		}
+		if s.spool_dir != "" {
+			if err := s.enableSpool(&backends[len(backends)-1].backendQueue); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(backends) == 1 {
+		return backends[0], nil
+	}
+	return newGraphiteRouter(s.graphite_routing, dests, backends)
+}
+
+// enableSpool gives the backend a spool in spool_dir. on reload, a backend for the same destination
+// takes over the spool of the one it replaces, which keeps running for a while to write its queued data.
+func (s *StatsDaemon) enableSpool(b *backendQueue) error {
+	for _, q := range backendQueues(s.backends) {
+		if q.id == b.id && q.spool != nil {
+			b.spool = q.spool
+			return nil
+		}
+	}
+	return b.enableSpool(s.spool_dir, s.spool_max_size, s.spool_max_age)
+}
+
+// queuedBackend is a backend that writes from one or more backendQueues
+type queuedBackend interface {
+	queues() []*backendQueue
+}
+
+// backendQueues returns the queues of the backends
+func backendQueues(backends []out.Backend) []*backendQueue {
+	var queues []*backendQueue
+	for _, b := range backends {
+		if q, ok := b.(queuedBackend); ok {
+			queues = append(queues, q.queues()...)
+		}
+	}
+	return queues
+}
+
+// stopBackends stops the backends in parallel, and returns the total amount of payloads they lost
+func stopBackends(backends []out.Backend, timeout time.Duration) int {
+	return replaceBackends(backends, nil, timeout)
+}
+
+// replaceBackends stops the backends in parallel, like stopBackends. the payloads that they didn't get to write
+// within the timeout are handed to the new backend for the same destination, if there is one.
+func replaceBackends(backends, successors []out.Backend, timeout time.Duration) int {
+	next := make(map[string]*backendQueue)
+	for _, q := range backendQueues(successors) {
+		next[q.id] = q
+	}
+	var wg sync.WaitGroup
+	var lost int64
+	for _, b := range backends {
+		q, ok := b.(queuedBackend)
+		if !ok {
+			wg.Add(1)
+			go func(b out.Backend) {
+				defer wg.Done()
+				atomic.AddInt64(&lost, int64(b.Stop(timeout)))
+			}(b)
+			continue
+		}
+		for _, bq := range q.queues() {
+			wg.Add(1)
+			go func(bq *backendQueue) {
+				defer wg.Done()
+				atomic.AddInt64(&lost, int64(bq.stopTo(timeout, next[bq.id])))
+			}(bq)
+		}
+	}
+	wg.Wait()
+	return int(lost)
+}
+
+// retryPost posts the body to url, retrying with a backoff until it succeeds,
+// or the destination rejects the data, in which case it is dropped.
+// it gives up when stop is closed. it returns whether the body was delivered.
+func retryPost(client *http.Client, name, url string, header http.Header, body []byte, stop <-chan struct{}) bool {
+	boff := &backoff.Backoff{
+		Min:    100 * time.Millisecond,
+		Max:    30 * time.Second,
+		Factor: 1.5,
+		Jitter: true,
+	}
+	for {
+		pre := time.Now()
+		retry, err := post(client, url, header, body)
+		if err == nil {
+			log.Debugf("%s: sent %d bytes in %s", name, len(body), time.Since(pre))
+			return true
+		}
+		if !retry {
+			log.Errorf("%s: dropping %d bytes of metrics: %s", name, len(body), err)
+			return false
+		}
+		d := boff.Duration()
+		log.Infof("%s: failed to submit data: %s - will try again in %s (this attempt took %s)", name, err, d, time.Since(pre))
+		select {
+		case <-time.After(d):
+		case <-stop:
+			log.Errorf("%s: stopped, dropping %d bytes of metrics", name, len(body))
+			return false
+		}
+	}
+}
+
+// post does a single request. it returns whether the request should be retried if it failed:
+// client errors like a parse error would just fail again, except for rate limiting.
+func post(client *http.Client, url string, header http.Header, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header = header
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		ioutil.ReadAll(resp.Body)
+		return false, nil
+	}
+	msg := make([]byte, 300)
+	n, _ := resp.Body.Read(msg)
+	ioutil.ReadAll(resp.Body)
+	err = fmt.Errorf("http %d - %s", resp.StatusCode, bytes.TrimSpace(msg[:n]))
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
@@ -0,0 +1,467 @@
+package statsdaemon
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/bmizerany/assert"
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+)
+
+func TestGraphiteBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	internal := make(chan []*common.Metric, 10)
+	b := newGraphiteBackend(ln.Addr().String(), "", clock.New(), "internal.", internal)
+	b.Start()
+	b.Submit([]out.Point{{Name: "foo", Value: 1, Time: 1500000000}})
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, line, "foo 1 1500000000\n")
+
+	b.Stop(time.Second)
+	metrics := <-internal
+	assert.Equal(t, metrics[0].Bucket, "internal.mtype_is_gauge.type_is_send.backend_is_graphite.unit_is_ms")
+	assert.Equal(t, metrics[1].Bucket, "internal.mtype_is_gauge.type_is_queue.backend_is_graphite.unit_is_Payload")
+}
+
+func TestTsdbgwBackend(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.Header.Get("Authorization"), "Bearer secret")
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer server.Close()
+	internal := make(chan []*common.Metric, 10)
+	b := newTsdbgwBackend(server.URL, "secret", 1, 10, "internal.", internal)
+	b.Start()
+	b.Submit([]out.Point{{Name: "foo", Value: 1, Time: 1500000000}})
+	b.Stop(time.Second)
+
+	assert.T(t, len(<-bodies) > 0)
+	metrics := <-internal
+	assert.Equal(t, metrics[0].Bucket, "internal.mtype_is_gauge.type_is_send.backend_is_tsdbgw.unit_is_ms")
+}
+
+func TestTsdbgwBackendRejected(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		http.Error(w, "invalid data", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	internal := make(chan []*common.Metric, 10)
+	b := newTsdbgwBackend(server.URL, "secret", 1, 10, "internal.", internal)
+	b.Start()
+	b.Submit([]out.Point{{Name: "foo", Value: 1, Time: 1500000000}})
+	b.Submit([]out.Point{{Name: "bar", Value: 1, Time: 1500000000}})
+	// client errors are not retried, so a rejected payload doesn't hold up the next one
+	assert.Equal(t, b.Stop(time.Second), 0)
+	assert.Equal(t, atomic.LoadInt32(&attempts), int32(2))
+	// both payloads count as dropped, and no send is reported
+	assert.Equal(t, len(internal), 2)
+	for i := 0; i < 2; i++ {
+		metrics := <-internal
+		assert.Equal(t, len(metrics), 1)
+		assert.Equal(t, metrics[0].Bucket, "internal.mtype_is_count.type_is_drop.backend_is_tsdbgw.unit_is_Payload")
+	}
+}
+
+func TestBackendQueueFull(t *testing.T) {
+	internal := make(chan []*common.Metric, 10)
+	// not started, so nothing consumes the queue
+	b := newGraphiteBackend("127.0.0.1:0", "", clock.New(), "internal.", internal)
+	for i := 0; i < backendQueueSize; i++ {
+		b.Submit([]out.Point{{Name: "foo", Value: 1, Time: 1500000000}})
+	}
+	assert.Equal(t, len(internal), 0)
+	b.Submit([]out.Point{{Name: "foo", Value: 1, Time: 1500000000}})
+	metrics := <-internal
+	assert.Equal(t, metrics[0].Bucket, "internal.mtype_is_count.type_is_drop.backend_is_graphite.unit_is_Payload")
+}
+
+func TestInfluxdbBackend(t *testing.T) {
+	var attempts int32
+	bodies := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.URL.Path, "/write")
+		assert.Equal(t, r.URL.Query().Get("db"), "statsd")
+		assert.Equal(t, r.URL.Query().Get("precision"), "s")
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			// the first attempt fails, and should be retried
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, r.Header.Get("Content-Encoding"), "gzip")
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := ioutil.ReadAll(gz)
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	internal := make(chan []*common.Metric, 10)
+	b, err := newInfluxdbBackend(server.URL+"/write?db=statsd", 2, true, "internal.", internal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Start()
+	b.Submit([]out.Point{
+		{Bucket: "a", Stat: "count", Value: 1, Time: 1500000000},
+		{Bucket: "b", Stat: "value", Value: 2, Time: 1500000000},
+		{Bucket: "c", Stat: "value", Value: 3, Time: 1500000000},
+	})
+	b.Stop(time.Second)
+
+	// batches of 2 lines
+	assert.Equal(t, <-bodies, "a count=1 1500000000\nb value=2 1500000000\n")
+	assert.Equal(t, <-bodies, "c value=3 1500000000\n")
+	assert.Equal(t, atomic.LoadInt32(&attempts), int32(3))
+	metrics := <-internal
+	assert.Equal(t, metrics[0].Bucket, "internal.mtype_is_gauge.type_is_send.backend_is_influxdb.unit_is_ms")
+}
+
+func TestInfluxdbBackendRejected(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		http.Error(w, `{"error":"unable to parse"}`, http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	internal := make(chan []*common.Metric, 10)
+	b, err := newInfluxdbBackend(server.URL+"/write?db=statsd", 10, false, "internal.", internal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Start()
+	b.Submit([]out.Point{{Bucket: "a", Stat: "count", Value: 1, Time: 1500000000}})
+	b.Stop(time.Second)
+	// client errors are not retried, and the payload counts as dropped rather than sent
+	assert.Equal(t, atomic.LoadInt32(&attempts), int32(1))
+	metrics := <-internal
+	assert.Equal(t, len(metrics), 1)
+	assert.Equal(t, metrics[0].Bucket, "internal.mtype_is_count.type_is_drop.backend_is_influxdb.unit_is_Payload")
+	assert.Equal(t, len(internal), 0)
+}
+
+func TestInfluxdbBackendUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	b, err := newInfluxdbBackend("udp://"+conn.LocalAddr().String(), 10, true, "internal.", make(chan []*common.Metric, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Start()
+	var points []out.Point
+	for i := 0; i < 100; i++ {
+		points = append(points, out.Point{Bucket: fmt.Sprintf("bucket%03d", i), Stat: "value", Value: 1, Time: 1500000000})
+	}
+	b.Submit(points)
+	b.Stop(time.Second)
+
+	// 100 lines of 28 bytes: packets of at most 10 lines
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 65536)
+	var lines int
+	for lines < 100 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.T(t, n <= influxdbMaxPacketSize)
+		packet := strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n")
+		assert.T(t, len(packet) <= 10)
+		assert.Equal(t, packet[0], fmt.Sprintf("bucket%03d value=1 1500000000", lines))
+		lines += len(packet)
+	}
+}
+
+func TestInfluxdbBackendUDPDialRetry(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	internal := make(chan []*common.Metric, 10)
+	b, err := newInfluxdbBackend("udp://"+conn.LocalAddr().String(), 10, false, "internal.", internal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dials int
+	b.dial = func(network, address string) (net.Conn, error) {
+		dials++
+		if dials == 1 {
+			return nil, errors.New("temporary failure in name resolution")
+		}
+		return net.Dial(network, address)
+	}
+	b.Start()
+	b.Submit([]out.Point{{Bucket: "a", Stat: "value", Value: 1, Time: 1500000000}})
+	b.Submit([]out.Point{{Bucket: "b", Stat: "value", Value: 2, Time: 1500000000}})
+	b.Stop(time.Second)
+
+	// the first payload is dropped, the dial is tried again for the second one
+	assert.Equal(t, dials, 2)
+	metrics := <-internal
+	assert.Equal(t, metrics[0].Bucket, "internal.mtype_is_count.type_is_drop.backend_is_influxdb.unit_is_Payload")
+	metrics = <-internal
+	assert.Equal(t, metrics[0].Bucket, "internal.mtype_is_gauge.type_is_send.backend_is_influxdb.unit_is_ms")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 65536)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(buf[:n]), "b value=2 1500000000\n")
+}
+
+func TestOpentsdbTelnetBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	internal := make(chan []*common.Metric, 10)
+	b, err := newOpentsdbBackend(ln.Addr().String(), 50, map[string]string{"instance": "test"}, clock.New(), "internal.", internal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Start()
+	b.Submit([]out.Point{{Name: "service_is_api.unit_is_Req.mtype_is_count", Value: 3, Time: 1500000000, Tags: []string{"env=prod"}}})
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, line, "put statsd 1500000000 3 env=prod instance=test mtype=count service=api unit=Req\n")
+
+	b.Stop(time.Second)
+	metrics := <-internal
+	assert.Equal(t, metrics[0].Bucket, "internal.mtype_is_gauge.type_is_send.backend_is_opentsdb.unit_is_ms")
+}
+
+func TestOpentsdbHTTPBackend(t *testing.T) {
+	batches := make(chan []out.OpentsdbDatapoint, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.URL.Path, "/api/put")
+		assert.Equal(t, r.Header.Get("Content-Type"), "application/json")
+		var dps []out.OpentsdbDatapoint
+		if err := json.NewDecoder(r.Body).Decode(&dps); err != nil {
+			t.Error(err)
+		}
+		batches <- dps
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	b, err := newOpentsdbBackend(server.URL, 2, map[string]string{"instance": "test"}, clock.New(), "internal.", make(chan []*common.Metric, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Start()
+	b.Submit([]out.Point{
+		{Name: "stats.a", Value: 1, Time: 1500000000},
+		{Name: "stats.b", Value: 2, Time: 1500000000},
+		{Name: "what_is_c.unit_is_B", Value: 3, Time: 1500000000},
+	})
+	b.Stop(time.Second)
+
+	assert.Equal(t, <-batches, []out.OpentsdbDatapoint{
+		{Metric: "stats.a", Timestamp: 1500000000, Value: 1, Tags: map[string]string{"instance": "test"}},
+		{Metric: "stats.b", Timestamp: 1500000000, Value: 2, Tags: map[string]string{"instance": "test"}},
+	})
+	assert.Equal(t, <-batches, []out.OpentsdbDatapoint{
+		{Metric: "c", Timestamp: 1500000000, Value: 3, Tags: map[string]string{"instance": "test", "unit": "B"}},
+	})
+}
+
+func TestGraphitePickleBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	b := newGraphitePickleBackend(ln.Addr().String(), "", 2, clock.New(), "internal.", make(chan []*common.Metric, 10))
+	b.Start()
+	b.Submit([]out.Point{
+		{Name: "a", Value: 1, Time: 1500000000},
+		{Name: "b", Value: 2, Time: 1500000000},
+		{Name: "c", Value: 3, Time: 1500000000},
+	})
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	exp := out.WritePickle(nil, []out.Point{
+		{Name: "a", Value: 1, Time: 1500000000},
+		{Name: "b", Value: 2, Time: 1500000000},
+		{Name: "c", Value: 3, Time: 1500000000},
+	}, 2)
+	got := make([]byte, len(exp))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, got, exp)
+	// two frames: the length header of the first one is followed by the second one
+	assert.Equal(t, int(binary.BigEndian.Uint32(got))+4 < len(got), true)
+	b.Stop(time.Second)
+}
+
+func TestBackendQueueSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	internal := make(chan []*common.Metric, 100)
+	b := newBackendQueue("graphite", "", "internal.", internal)
+	if err := b.enableSpool(dir, 1024*1024, 0); err != nil {
+		t.Fatal(err)
+	}
+	// without a writer, the backend falls behind: after a few payloads in memory, they go to the spool
+	for i := 0; i < 25; i++ {
+		b.Submit([]out.Point{{Name: "foo", Value: float64(i), Time: 1500000000}})
+	}
+	assert.Equal(t, len(b.queue), backendSpoolAfter)
+	assert.Equal(t, b.spool.len(), 25-backendSpoolAfter)
+	metrics := <-internal
+	assert.Equal(t, metrics[0].Bucket, "internal.mtype_is_gauge.type_is_spool.backend_is_graphite.unit_is_Payload")
+
+	// the writer gets them back in order
+	for i := 0; i < 20; i++ {
+		points, ok := b.next()
+		assert.T(t, ok)
+		assert.Equal(t, points[0].Value, float64(i))
+	}
+	close(b.queue)
+	_, ok := b.next()
+	assert.Equal(t, ok, false)
+	b.spool.close()
+
+	// what's left is picked up after a restart
+	b = newBackendQueue("graphite", "", "internal.", internal)
+	if err := b.enableSpool(dir, 1024*1024, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 20; i < 25; i++ {
+		points, ok := b.next()
+		assert.T(t, ok)
+		assert.Equal(t, points[0].Value, float64(i))
+	}
+}
+
+func TestBackendStopTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	internal := make(chan []*common.Metric, 10)
+
+	// the writer holds on to the first payload while it waits for a connection
+	b := newGraphiteBackend(addr, "", clock.New(), "internal.", internal)
+	b.Start()
+	for i := 0; i < 3; i++ {
+		b.Submit([]out.Point{{Name: "foo", Value: float64(i), Time: 1500000000}})
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, b.Stop(100*time.Millisecond), 3)
+
+	// with a spool, the queued payloads are kept for the next run
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b = newGraphiteBackend(addr, "", clock.New(), "internal.", internal)
+	if err := b.enableSpool(dir, 1024*1024, 0); err != nil {
+		t.Fatal(err)
+	}
+	b.Start()
+	for i := 0; i < 3; i++ {
+		b.Submit([]out.Point{{Name: "foo", Value: float64(i), Time: 1500000000}})
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, b.Stop(100*time.Millisecond), 1)
+	sp, err := openSpool(filepath.Join(dir, "graphite"), 1024*1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sp.len(), 2)
+}
+
+func TestBackendStopHandoff(t *testing.T) {
+	internal := make(chan []*common.Metric, 10)
+	old := newGraphiteBackend(closedAddr(t), "", clock.New(), "internal.", internal)
+	old.Start()
+	for i := 0; i < 3; i++ {
+		old.Submit([]out.Point{{Name: "foo", Value: float64(i), Time: 1500000000}})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// the replacement isn't started, so what it takes over stays in its queue.
+	// the payload that the old writer was working on is lost.
+	b := newGraphiteBackend(closedAddr(t), "", clock.New(), "internal.", internal)
+	assert.Equal(t, replaceBackends([]out.Backend{old}, []out.Backend{b}, 100*time.Millisecond), 1)
+	assert.Equal(t, len(b.queue), 2)
+	points := <-b.queue
+	assert.Equal(t, points[0].Value, 1.0)
+
+	// without a replacement for the same destination, they're lost
+	old = newGraphiteBackend(closedAddr(t), "", clock.New(), "internal.", internal)
+	old.Start()
+	for i := 0; i < 3; i++ {
+		old.Submit([]out.Point{{Name: "foo", Value: float64(i), Time: 1500000000}})
+	}
+	time.Sleep(50 * time.Millisecond)
+	other := newTsdbgwBackend("http://localhost:8081", "", 1, 10, "internal.", internal)
+	assert.Equal(t, replaceBackends([]out.Backend{old}, []out.Backend{other}, 100*time.Millisecond), 3)
+}
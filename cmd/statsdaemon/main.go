@@ -16,6 +16,8 @@ import (
 	"github.com/raintank/statsdaemon"
 	"github.com/raintank/statsdaemon/logger"
 	"github.com/raintank/statsdaemon/out"
+	"github.com/raintank/statsdaemon/rules"
+	"github.com/raintank/statsdaemon/udp"
 	log "github.com/sirupsen/logrus"
 
 	"net/http"
@@ -34,12 +36,24 @@ const (
 )
 
 var (
-	listen_addr   = flag.String("listen_addr", ":8125", "listener address for statsd, listens on UDP only")
+	listen_addr   = flag.String("listen_addr", ":8125", "listener address for statsd over UDP")
+	listenSockets = flag.Int("listen_sockets", 1, "number of UDP sockets to open on listen_addr using SO_REUSEPORT, each with their own reader (linux only)")
+	listenRcvbuf  = flag.Int("listen_rcvbuf", 0, "receive buffer size of the UDP sockets in bytes (SO_RCVBUF). 0 means the system default")
+	listenTCP     = flag.String("listen_tcp_addr", "", "listener address for statsd over TCP, with newline delimited lines. empty to disable")
+	listenUnix    = flag.String("listen_unix_path", "", "path of a unix socket to listen on for statsd. empty to disable")
+	listenUnixDgm = flag.Bool("listen_unix_datagram", false, "use a unix datagram socket for listen_unix_path, rather than a stream socket with newline delimited lines")
 	admin_addr    = flag.String("admin_addr", ":8126", "listener address for admin port")
+	adminHTTP     = flag.String("admin_http_addr", "", "listener address for the http admin api, with json responses. empty to disable")
 	profile_addr  = flag.String("profile_addr", "", "listener address for profiler")
-	graphite_addr = flag.String("graphite_addr", "127.0.0.1:2003", "graphite carbon-in url")
+	graphite_addr = flag.String("graphite_addr", "127.0.0.1:2003", "graphite carbon-in address, or a comma separated list of host:port[:instance] destinations")
+	graphiteRoute = flag.String("graphite_routing", "hash", "how to send to multiple graphite destinations: hash (carbon compatible consistent hashing), all or failover")
+	graphiteProto = flag.String("graphite_protocol", "plaintext", "protocol to send to graphite_addr with: plaintext or pickle (usually on port 2004)")
+	graphiteBatch = flag.Int("graphite_pickle_batch_size", 500, "max number of metrics per pickle frame")
+	prom_addr     = flag.String("prometheus_addr", "", "listener address for the prometheus /metrics endpoint, serving the last flushed metrics. empty to disable")
 	flushInterval = flag.Int("flush_interval", 10, "flush interval in seconds")
+	shutdownTime  = flag.String("shutdown_timeout", "10s", "on shutdown, how long to wait for the backends to write their queued data")
 	processes     = flag.Int("processes", 4, "number of processes to use")
+	shards        = flag.Int("aggregator_shards", 1, "number of goroutines aggregating metrics, each owning a subset of the buckets")
 
 	instance = flag.String("instance", "$HOST", "instance name, defaults to short hostname if not set")
 
@@ -48,17 +62,26 @@ var (
 	prefix_counters  = flag.String("prefix_counters", "stats_counts.", "counters prefix")
 	prefix_timers    = flag.String("prefix_timers", "stats.timers.", "timers prefix")
 	prefix_gauges    = flag.String("prefix_gauges", "stats.gauges.", "gauges prefix")
+	prefix_sets      = flag.String("prefix_sets", "stats.sets.", "sets prefix")
 
 	prefix_m20_counters = flag.String("prefix_m20_counters", "", "counters 2.0 prefix")
 	prefix_m20_gauges   = flag.String("prefix_m20_gauges", "", "gauges 2.0 prefix")
 	prefix_m20_rates    = flag.String("prefix_m20_rates", "", "rates 2.0 prefix")
 	prefix_m20_timers   = flag.String("prefix_m20_timers", "", "timers 2.0 prefix")
+	prefix_m20_sets     = flag.String("prefix_m20_sets", "", "sets 2.0 prefix")
 
 	flush_rates  = flag.Bool("flush_rates", true, "send count for counters (using prefix_counters)")
 	flush_counts = flag.Bool("flush_counts", false, "send count for counters (using prefix_counters)")
 
+	delete_gauges = flag.Bool("delete_gauges", false, "don't send gauges that weren't updated during the interval (otherwise keep sending their last value)")
+	gauge_expiry  = flag.String("gauge_expiry", "0", "when not deleting gauges, stop sending gauges that weren't updated for this long. also expires the cumulative prometheus series. 0 means never")
+
 	percentile_thresholds = flag.String("percentile_thresholds", "90,75", "percential thresholds (used by timers)")
 	max_timers_per_s      = flag.Uint64("max_timers_per_s", 1000, "max timers per second")
+	timer_mode            = flag.String("timer_mode", "exact", "how to compute timer statistics: 'exact' (keep every point) or 'tdigest' (bounded memory, estimated percentiles and median)")
+	timer_compression     = flag.Float64("timer_compression", 100, "t-digest compression for timer_mode tdigest. higher is more accurate but uses more memory")
+	histogram_bins        = flag.String("histogram_bins", "", "cumulative histogram bins for timers and histograms, like 'pattern:bin,bin;pattern:bin'")
+	set_hll_threshold     = flag.Int("set_hll_threshold", 10000, "amount of distinct values after which a set switches from exact counting to a HyperLogLog estimate. 0 means always estimate")
 
 	proftrigPath = flag.String("proftrigger_path", "/tmp/profiletrigger/", "profiler file path") // "path to store triggered profiles"
 
@@ -78,11 +101,35 @@ var (
 	memprofile  = flag.String("memprofile", "", "write memory profile to this file")
 	GitHash     = "(none)"
 
-	orgid    = flag.Int("orgid", 1, "orgid, default: 1")
-	enabletsdbgw     = flag.Bool("enabletsdbgw", false, "enable sending to tsdbgw default: false")
-	enablegraphite     = flag.Bool("enablegraphite", true, "enable sending to graphite default: true")
-	tsdbgw_addr = flag.String("tsdbgw_addr", "http://localhost:8081", "tsdbgw address default: localhost:8081")
-	tsdbgw_api_key = flag.String( "tsdbgw_api_key", "nil", "tsdbgw api key default nil")
+	orgid          = flag.Int("orgid", 1, "orgid, default: 1")
+	backends       = flag.String("backends", "", "comma separated list of backends to send metrics to: graphite, tsdbgw, influxdb, opentsdb. if empty, enablegraphite and enabletsdbgw are used")
+	enabletsdbgw   = flag.Bool("enabletsdbgw", false, "enable sending to tsdbgw default: false (deprecated, use backends)")
+	enablegraphite = flag.Bool("enablegraphite", true, "enable sending to graphite default: true (deprecated, use backends)")
+	tsdbgw_addr    = flag.String("tsdbgw_addr", "http://localhost:8081", "tsdbgw address default: localhost:8081")
+	tsdbgw_api_key = flag.String("tsdbgw_api_key", "nil", "tsdbgw api key default nil")
+
+	influxdb_addr       = flag.String("influxdb_addr", "http://localhost:8086/write?db=statsd", "influxdb write endpoint url, or udp://host:port to write over udp")
+	influxdb_batch_size = flag.Int("influxdb_batch_size", 5000, "max number of lines per influxdb request or udp packet")
+	influxdb_gzip       = flag.Bool("influxdb_gzip", true, "gzip the influxdb requests")
+
+	opentsdb_addr       = flag.String("opentsdb_addr", "localhost:4242", "opentsdb host:port to send telnet style put commands to, or the http(s) url of the /api/put endpoint")
+	opentsdb_batch_size = flag.Int("opentsdb_batch_size", 50, "max number of datapoints per opentsdb /api/put request")
+
+	max_buckets            = flag.Int("max_buckets", 0, "max number of distinct buckets per interval. 0 means no limit")
+	max_buckets_per_prefix = flag.String("max_buckets_per_prefix", "", "max number of distinct buckets per interval for buckets with a prefix, like 'prefix:limit;prefix:limit'")
+	max_buckets_per_tag    = flag.String("max_buckets_per_tag", "", "max number of distinct buckets per interval for each value of a tag, like 'tag:limit;tag:limit'")
+	bucket_limit_action    = flag.String("bucket_limit_action", "drop", "what to do with metrics for new buckets over a limit: drop, or overflow to aggregate them as __overflow__")
+
+	rules_file = flag.String("rules_file", "", "file with rules to filter and rename buckets with before aggregating them. empty to disable")
+
+	key_sanitize_legacy   = flag.String("key_sanitize_legacy", "off", "what to do with the keys of incoming legacy metrics: off, normalize (whitespace to _, / to -, strip other invalid characters) or reject them as invalid lines")
+	key_validation_legacy = flag.String("key_validation_legacy", "medium", "validation level for legacy keys that are sanitized: strict (only letters, digits, _, - and ., no empty nodes), medium (no NUL or non-ASCII bytes) or none")
+	key_sanitize_m20      = flag.String("key_sanitize_m20", "off", "like key_sanitize_legacy, for metrics 2.0 keys")
+	key_validation_m20    = flag.String("key_validation_m20", "medium", "validation level for metrics 2.0 keys that are sanitized: medium (unit and mtype tags, no mixing of = and _is_) or none")
+
+	spool_dir       = flag.String("spool_dir", "", "directory to spool graphite and tsdbgw payloads in while they are unreachable. empty to disable")
+	spool_max_size  = flag.Int64("spool_max_size_mb", 1024, "max size of the spool of each backend (and graphite destination) in MB. the oldest data is dropped beyond it")
+	spool_max_age_s = flag.String("spool_max_age", "24h", "spooled data older than this is dropped. 0 means never")
 )
 
 func expand_cfg_vars(in string) (out string) {
@@ -98,6 +145,11 @@ func expand_cfg_vars(in string) (out string) {
 }
 func main() {
 	flag.Parse()
+	// settings given on the command line take precedence over the config file, also when reloading it
+	cmdline := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		cmdline[f.Name] = true
+	})
 
 	if *showVersion {
 		fmt.Printf("statsdaemon v%s (built w/%s, git hash %s)\n", VERSION, runtime.Version(), GitHash)
@@ -153,6 +205,13 @@ func main() {
 	proftrigCpuMinDiff := int(dur.MustParseUNsec("proftrigger_cpu_min_diff", *proftrigCpuMinDiffStr))
 	proftrigCpuDur := int(dur.MustParseUNsec("proftrigger_cpu_dur", *proftrigCpuDurStr))
 
+	gaugeExpiry := int(dur.MustParseUsec("gauge_expiry", *gauge_expiry))
+	shutdownTimeout := time.Duration(dur.MustParseUsec("shutdown_timeout", *shutdownTime)) * time.Second
+	spoolMaxAge := time.Duration(dur.MustParseUsec("spool_max_age", *spool_max_age_s)) * time.Second
+	if *spool_dir != "" && *spool_max_size < 1 {
+		log.Fatal("spool_max_size_mb must be at least 1")
+	}
+
 	if proftrigHeapFreq > 0 {
 		errors := make(chan error)
 		// TODO: update to latest profile trigger
@@ -179,10 +238,35 @@ func main() {
 	}
 
 	runtime.GOMAXPROCS(*processes)
-	pct, err := out.NewPercentiles(*percentile_thresholds)
+	if *listenSockets < 1 {
+		log.Fatal("listen_sockets must be at least 1")
+	}
+	if *shards < 1 {
+		log.Fatal("aggregator_shards must be at least 1")
+	}
+	histogramSpecs, err := out.NewHistogramSpecs(*histogram_bins)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bucketLimits, err := statsdaemon.NewBucketLimits(*max_buckets, *max_buckets_per_prefix, *max_buckets_per_tag, *bucket_limit_action)
 	if err != nil {
 		log.Fatal(err)
 	}
+	keySanitizer, err := udp.NewKeySanitizer(*key_sanitize_legacy, *key_validation_legacy, *key_sanitize_m20, *key_validation_m20)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var timerCompression float64
+	switch *timer_mode {
+	case "exact":
+	case "tdigest":
+		if *timer_compression <= 0 {
+			log.Fatal("timer_compression must be positive")
+		}
+		timerCompression = *timer_compression
+	default:
+		log.Fatalf("unknown timer_mode %q", *timer_mode)
+	}
 	inst := os.Expand(*instance, expand_cfg_vars)
 	if inst == "" {
 		inst = "null"
@@ -197,6 +281,127 @@ func main() {
 		}()
 	}
 
+	cfg, err := liveConfig(inst)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	daemon := statsdaemon.New(inst, *cfg, statsdaemon.Settings{
+		TimerCompression: timerCompression,
+		SetHllThreshold:  *set_hll_threshold,
+		HistogramSpecs:   *histogramSpecs,
+		DeleteGauges:     *delete_gauges,
+		GaugeExpiry:      gaugeExpiry,
+		FlushInterval:    *flushInterval,
+		MaxUnprocessed:   MAX_UNPROCESSED_PACKETS,
+		Shards:           *shards,
+		MaxTimersPerS:    *max_timers_per_s,
+		Orgid:            *orgid,
+		SpoolDir:         *spool_dir,
+		SpoolMaxSize:     *spool_max_size * 1024 * 1024,
+		SpoolMaxAge:      spoolMaxAge,
+		ShutdownTimeout:  shutdownTimeout,
+		BucketLimits:     bucketLimits,
+		KeySanitizer:     keySanitizer,
+	}, signalchan)
+	daemon.Version = VERSION
+	daemon.GitHash = GitHash
+	daemon.ReloadFunc = func() (*statsdaemon.Config, error) {
+		return reloadConfig(cmdline, inst)
+	}
+	if *logLevel == "debug" {
+		consumer := make(chan interface{}, 100)
+		daemon.Invalid_lines.Register(consumer)
+		go func() {
+			for line := range consumer {
+				invalid := line.(out.InvalidLine)
+				log.Debugf("invalid line '%s' from %s: %s", invalid.Line, invalid.Source, invalid.Reason)
+			}
+		}()
+	}
+	daemon.Run(*listen_addr, *listenSockets, *listenRcvbuf, *listenTCP, *listenUnix, *listenUnixDgm, *admin_addr, *adminHTTP, *prom_addr)
+}
+
+// liveSettings are the settings that are applied when the config file is reloaded on SIGHUP.
+// changes to the others are reported, and need a restart.
+var liveSettings = map[string]bool{
+	"legacy_namespace":           true,
+	"prefix_rates":               true,
+	"prefix_counters":            true,
+	"prefix_timers":              true,
+	"prefix_gauges":              true,
+	"prefix_sets":                true,
+	"prefix_m20_counters":        true,
+	"prefix_m20_gauges":          true,
+	"prefix_m20_rates":           true,
+	"prefix_m20_timers":          true,
+	"prefix_m20_sets":            true,
+	"flush_rates":                true,
+	"flush_counts":               true,
+	"percentile_thresholds":      true,
+	"log_level":                  true,
+	"backends":                   true,
+	"enablegraphite":             true,
+	"enabletsdbgw":               true,
+	"graphite_addr":              true,
+	"graphite_routing":           true,
+	"graphite_protocol":          true,
+	"graphite_pickle_batch_size": true,
+	"tsdbgw_addr":                true,
+	"tsdbgw_api_key":             true,
+	"influxdb_addr":              true,
+	"influxdb_batch_size":        true,
+	"influxdb_gzip":              true,
+	"opentsdb_addr":              true,
+	"opentsdb_batch_size":        true,
+	"rules_file":                 true,
+}
+
+// liveConfig validates the live settings and returns them
+func liveConfig(inst string) (*statsdaemon.Config, error) {
+	lvl, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse log-level, %s", err.Error())
+	}
+	pct, err := out.NewPercentiles(*percentile_thresholds)
+	if err != nil {
+		return nil, err
+	}
+	switch *graphiteProto {
+	case "plaintext":
+	case "pickle":
+		if *graphiteBatch < 1 {
+			return nil, fmt.Errorf("graphite_pickle_batch_size must be at least 1")
+		}
+	default:
+		return nil, fmt.Errorf("unknown graphite_protocol %q", *graphiteProto)
+	}
+	switch *graphiteRoute {
+	case "hash", "all", "failover":
+	default:
+		return nil, fmt.Errorf("unknown graphite_routing %q", *graphiteRoute)
+	}
+	var filterRules rules.Rules
+	if *rules_file != "" {
+		filterRules, err = rules.Load(*rules_file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var backendNames []string
+	if *backends != "" {
+		for _, name := range strings.Split(*backends, ",") {
+			backendNames = append(backendNames, strings.TrimSpace(name))
+		}
+	} else {
+		if *enablegraphite {
+			backendNames = append(backendNames, "graphite")
+		}
+		if *enabletsdbgw {
+			backendNames = append(backendNames, "tsdbgw")
+		}
+	}
+
 	formatter := out.Formatter{
 		PrefixInternal: "service_is_statsdaemon.instance_is_" + inst + ".",
 
@@ -205,27 +410,102 @@ func main() {
 		Prefix_gauges:    *prefix_gauges,
 		Prefix_rates:     *prefix_rates,
 		Prefix_timers:    *prefix_timers,
+		Prefix_sets:      *prefix_sets,
 
 		Prefix_m20_counters: *prefix_m20_counters,
 		Prefix_m20_gauges:   *prefix_m20_gauges,
 		Prefix_m20_rates:    *prefix_m20_rates,
 		Prefix_m20_timers:   *prefix_m20_timers,
+		Prefix_m20_sets:     *prefix_m20_sets,
 
 		Prefix_m20ne_counters: strings.Replace(*prefix_m20_counters, "=", "_is_", -1),
 		Prefix_m20ne_gauges:   strings.Replace(*prefix_m20_gauges, "=", "_is_", -1),
 		Prefix_m20ne_rates:    strings.Replace(*prefix_m20_rates, "=", "_is_", -1),
 		Prefix_m20ne_timers:   strings.Replace(*prefix_m20_timers, "=", "_is_", -1),
+		Prefix_m20ne_sets:     strings.Replace(*prefix_m20_sets, "=", "_is_", -1),
 	}
+	return &statsdaemon.Config{
+		Formatter:   formatter,
+		FlushRates:  *flush_rates,
+		FlushCounts: *flush_counts,
+		Pct:         *pct,
+		LogLevel:    lvl,
+		Rules:       filterRules,
+		Backends: statsdaemon.BackendConfig{
+			Names:                   backendNames,
+			GraphiteAddr:            *graphite_addr,
+			GraphiteProtocol:        *graphiteProto,
+			GraphitePickleBatchSize: *graphiteBatch,
+			GraphiteRouting:         *graphiteRoute,
+			TsdbgwAddr:              *tsdbgw_addr,
+			TsdbgwApiKey:            *tsdbgw_api_key,
+			InfluxdbAddr:            *influxdb_addr,
+			InfluxdbBatchSize:       *influxdb_batch_size,
+			InfluxdbGzip:            *influxdb_gzip,
+			OpentsdbAddr:            *opentsdb_addr,
+			OpentsdbBatchSize:       *opentsdb_batch_size,
+		},
+	}, nil
+}
 
-	daemon := statsdaemon.New(inst, formatter, *flush_rates, *flush_counts, *pct, *flushInterval, MAX_UNPROCESSED_PACKETS, *max_timers_per_s, signalchan, *orgid, *enablegraphite, *enabletsdbgw, *tsdbgw_addr, *tsdbgw_api_key)
-	if *logLevel == "debug" {
-		consumer := make(chan interface{}, 100)
-		daemon.Invalid_lines.Register(consumer)
-		go func() {
-			for line := range consumer {
-				log.Debugf("invalid line '%s'", line)
-			}
-		}()
+// reloadConfig reads the config file and environment again, updates the live settings, and returns them.
+// settings given on the command line are left alone, and changes to settings that aren't live are
+// reported and ignored. if the new settings are invalid, none of them are applied.
+func reloadConfig(cmdline map[string]bool, inst string) (*statsdaemon.Config, error) {
+	path := ""
+	if _, err := os.Stat(*config_file); err == nil {
+		path = *config_file
+	}
+	conf, err := globalconf.NewWithOptions(&globalconf.Options{
+		Filename:  path,
+		EnvPrefix: "SD_",
+	})
+	if err != nil {
+		return nil, err
+	}
+	// parse into a copy of the flags, so that settings that are no longer in the file go back to their default
+	set := flag.NewFlagSet("reload", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		set.String(f.Name, f.DefValue, f.Usage)
+	})
+	conf.ParseSet("", set)
+
+	prev := make(map[*flag.Flag]string)
+	restore := func() {
+		for f, val := range prev {
+			f.Value.Set(val)
+		}
 	}
-	daemon.Run(*listen_addr, *admin_addr, *graphite_addr)
-}
\ No newline at end of file
+	set.VisitAll(func(nf *flag.Flag) {
+		f := flag.Lookup(nf.Name)
+		old, val := f.Value.String(), nf.Value.String()
+		if cmdline[f.Name] || val == old || err != nil {
+			return
+		}
+		if err = f.Value.Set(val); err != nil {
+			err = fmt.Errorf("invalid value %q for %s: %s", val, f.Name, err)
+			return
+		}
+		if f.Value.String() == old {
+			// the same value, written differently
+			return
+		}
+		if !liveSettings[f.Name] {
+			log.Warnf("reload: %s changed from %q to %q, which needs a restart. keeping %q", f.Name, old, val, old)
+			f.Value.Set(old)
+			return
+		}
+		prev[f] = old
+		log.Infof("reload: %s changed from %q to %q", f.Name, old, val)
+	})
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	c, err := liveConfig(inst)
+	if err != nil {
+		restore()
+		return nil, err
+	}
+	return c, nil
+}
@@ -1,8 +1,22 @@
 package common
 
+import "strings"
+
 type Metric struct {
 	Bucket   string
 	Value    float64
+	SetValue string // only used for sets
+	Relative bool   // only used for gauges: the value is a delta to apply to the current value
 	Modifier string
 	Sampling float32
+	Tags     []string // sorted, in graphite's tag=value format
+}
+
+// Key returns the key to aggregate the metric under:
+// the bucket, followed by the tags in graphite's ;tag=value format, if any
+func (m *Metric) Key() string {
+	if len(m.Tags) == 0 {
+		return m.Bucket
+	}
+	return m.Bucket + ";" + strings.Join(m.Tags, ";")
 }
@@ -0,0 +1,129 @@
+package statsdaemon
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/rules"
+)
+
+// filter applies the rules to the incoming metrics, and counts how often each rule matched and dropped a metric.
+// it is only used by metricsMonitor, or with multiple shards, by a shardFilter.
+type filter struct {
+	rules          rules.Rules
+	prefixInternal string
+	matchMetrics   []string
+	dropMetrics    []string
+	matches        []float64
+	drops          []float64
+}
+
+func newFilter(r rules.Rules, prefixInternal string) *filter {
+	f := &filter{
+		rules:          r,
+		prefixInternal: prefixInternal,
+		matches:        make([]float64, len(r)),
+		drops:          make([]float64, len(r)),
+	}
+	for _, rule := range r {
+		name := strings.NewReplacer(".", "_", " ", "_").Replace(rule.Name)
+		f.matchMetrics = append(f.matchMetrics, fmt.Sprintf("%smtype_is_count.type_is_rule_match.rule_is_%s.unit_is_Metric", prefixInternal, name))
+		f.dropMetrics = append(f.dropMetrics, fmt.Sprintf("%smtype_is_count.type_is_rule_drop.rule_is_%s.unit_is_Metric", prefixInternal, name))
+	}
+	return f
+}
+
+// apply returns the metrics that the rules keep, with their new buckets, followed by the internal counters
+// of the rules that matched. statsdaemon's own metrics are left alone.
+// the metrics are shared with metricStatsMonitor, so rather than modifying them, it makes copies.
+func (f *filter) apply(metrics []*common.Metric) []*common.Metric {
+	if len(f.rules) == 0 {
+		return metrics
+	}
+	last := 0
+	matched := func(i int, bucket string) {
+		f.matches[i]++
+		last = i
+	}
+	kept := make([]*common.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		if strings.HasPrefix(m.Bucket, f.prefixInternal) {
+			kept = append(kept, m)
+			continue
+		}
+		bucket, keep := f.rules.Apply(m, matched)
+		if !keep {
+			f.drops[last]++
+			continue
+		}
+		if bucket != m.Bucket {
+			rewritten := *m
+			rewritten.Bucket = bucket
+			m = &rewritten
+		}
+		kept = append(kept, m)
+	}
+	for i := range f.rules {
+		if f.matches[i] > 0 {
+			kept = append(kept, &common.Metric{Bucket: f.matchMetrics[i], Value: f.matches[i], Modifier: "c", Sampling: 1})
+			f.matches[i] = 0
+		}
+		if f.drops[i] > 0 {
+			kept = append(kept, &common.Metric{Bucket: f.dropMetrics[i], Value: f.drops[i], Modifier: "c", Sampling: 1})
+			f.drops[i] = 0
+		}
+	}
+	return kept
+}
+
+// RuleMatch is a rule that matched in a dry run, and the bucket it saw
+type RuleMatch struct {
+	Rule   string `json:"rule"`
+	Bucket string `json:"bucket"`
+}
+
+// DryRun is the outcome of applying the rules to one of the metrics of a line
+type DryRun struct {
+	Bucket  string      `json:"bucket"`
+	Type    string      `json:"type"`
+	Matches []RuleMatch `json:"matches"`
+	Kept    bool        `json:"kept"`
+	Result  string      `json:"result,omitempty"` // the bucket it is aggregated under, if kept
+}
+
+// dryRun applies the rules to the metrics of the statsd line, without affecting the rule counters.
+// the line is parsed like the incoming lines, so its key is sanitized first if that is enabled.
+// if rule is not empty, only that rule is applied rather than the configured ones.
+func (s *StatsDaemon) dryRun(line, rule string) ([]DryRun, error) {
+	r := s.currentRules()
+	if rule != "" {
+		parsed, err := rules.ParseRule(rule, 1)
+		if err != nil {
+			return nil, err
+		}
+		r = rules.Rules{parsed}
+	}
+	metrics, err := s.parse([]byte(line))
+	if err != nil {
+		return nil, fmt.Errorf("invalid line %q: %s", line, err)
+	}
+	results := make([]DryRun, 0, len(metrics))
+	for _, m := range metrics {
+		res := DryRun{Bucket: m.Bucket, Type: m.Modifier, Matches: []RuleMatch{}}
+		bucket, keep := r.Apply(m, func(i int, bucket string) {
+			res.Matches = append(res.Matches, RuleMatch{r[i].String(), bucket})
+		})
+		res.Kept = keep
+		if keep {
+			res.Result = bucket
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// currentRules returns the rules in use
+func (s *StatsDaemon) currentRules() rules.Rules {
+	return s.rules.Load().(rules.Rules)
+}
@@ -0,0 +1,82 @@
+package statsdaemon
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/rules"
+)
+
+func TestFilter(t *testing.T) {
+	r, err := rules.Parse(strings.NewReader(`
+rewrite ^user\.[0-9]+\. user.all. types=ms name=users
+deny    ^user\.[0-9]
+deny    .       name=internal.test
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFilter(r, "internal.")
+	in := []*common.Metric{
+		{Bucket: "user.1.latency", Value: 1, Modifier: "ms", Sampling: 1},
+		{Bucket: "user.2.latency", Value: 2, Modifier: "ms", Sampling: 1},
+		{Bucket: "user.2.logins", Value: 1, Modifier: "c", Sampling: 1},
+		{Bucket: "internal.foo", Value: 1, Modifier: "c", Sampling: 1},
+	}
+	got := make(map[string]float64)
+	for _, m := range f.apply(in) {
+		got[m.Bucket] += m.Value
+	}
+	assert.Equal(t, got, map[string]float64{
+		"internal.foo": 1,
+		// the rewritten metrics are denied by the last rule
+		"internal.mtype_is_count.type_is_rule_match.rule_is_users.unit_is_Metric":         2,
+		"internal.mtype_is_count.type_is_rule_match.rule_is_2.unit_is_Metric":             1,
+		"internal.mtype_is_count.type_is_rule_drop.rule_is_2.unit_is_Metric":              1,
+		"internal.mtype_is_count.type_is_rule_match.rule_is_internal_test.unit_is_Metric": 2,
+		"internal.mtype_is_count.type_is_rule_drop.rule_is_internal_test.unit_is_Metric":  2,
+	})
+	// the incoming metrics are shared with metricStatsMonitor, and must not change
+	assert.Equal(t, in[0].Bucket, "user.1.latency")
+
+	// the counts are per batch
+	out := f.apply([]*common.Metric{{Bucket: "user.3.latency", Value: 3, Modifier: "ms", Sampling: 1}})
+	assert.Equal(t, len(out), 3)
+}
+
+func TestDryRun(t *testing.T) {
+	r, err := rules.Parse(strings.NewReader("rewrite ^user\\.[0-9]+\\. user.all. types=ms\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig()
+	config.Rules = r
+	daemon := New("test", config, testSettings(), nil)
+
+	res, err := daemon.dryRun("user.1.latency:3|ms", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res, []DryRun{{
+		Bucket:  "user.1.latency",
+		Type:    "ms",
+		Matches: []RuleMatch{{`rewrite ^user\.[0-9]+\. user.all. types=ms name=1`, "user.1.latency"}},
+		Kept:    true,
+		Result:  "user.all.latency",
+	}})
+
+	// a rule that isn't configured yet
+	res, err = daemon.dryRun("user.1.latency:3|ms", "deny latency$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, res[0].Kept, false)
+	assert.Equal(t, res[0].Matches[0].Rule, "deny latency$ name=1")
+
+	_, err = daemon.dryRun("user.1.latency", "")
+	assert.NotEqual(t, err, nil)
+	_, err = daemon.dryRun("user.1.latency:3|ms", "block foo")
+	assert.NotEqual(t, err, nil)
+}
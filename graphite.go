@@ -0,0 +1,178 @@
+package statsdaemon
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+	log "github.com/sirupsen/logrus"
+)
+
+// tcpBackend connects to a destination that takes a line based protocol over tcp, like graphite,
+// and submits all pending data to it, reconnecting as needed.
+type tcpBackend struct {
+	backendQueue
+	addr   string
+	clock  clock.Clock
+	render func(buf []byte, points []out.Point) []byte
+
+	connected  int32  // 1 when connected, accessed atomically
+	connMetric string // reports the connection state, when there are several destinations
+}
+
+func newTCPBackend(name, addr, dest string, render func(buf []byte, points []out.Point) []byte, clock clock.Clock, prefixInternal string, internal chan<- []*common.Metric) *tcpBackend {
+	b := &tcpBackend{
+		backendQueue: newBackendQueue(name, dest, prefixInternal, internal),
+		addr:         addr,
+		clock:        clock,
+		render:       render,
+	}
+	if dest != "" {
+		b.connMetric = strings.Replace(b.sendMetric, ".type_is_send.", ".type_is_connected.", 1)
+		b.connMetric = strings.Replace(b.connMetric, ".unit_is_ms", ".unit_is_Conn", 1)
+	}
+	return b
+}
+
+// newGraphiteBackend creates a backend for graphite's plaintext protocol.
+// dest identifies the destination in the internal metrics, when there are several.
+func newGraphiteBackend(addr, dest string, clock clock.Clock, prefixInternal string, internal chan<- []*common.Metric) *tcpBackend {
+	return newTCPBackend("graphite", addr, dest, out.WriteGraphite, clock, prefixInternal, internal)
+}
+
+// newGraphitePickleBackend creates a backend for carbon's pickle protocol, sending frames of up to batchSize points
+func newGraphitePickleBackend(addr, dest string, batchSize int, clock clock.Clock, prefixInternal string, internal chan<- []*common.Metric) *tcpBackend {
+	render := func(buf []byte, points []out.Point) []byte {
+		return out.WritePickle(buf, points, batchSize)
+	}
+	return newTCPBackend("graphite", addr, dest, render, clock, prefixInternal, internal)
+}
+
+// isConnected returns whether the backend currently has a connection to its destination
+func (g *tcpBackend) isConnected() bool {
+	return atomic.LoadInt32(&g.connected) == 1
+}
+
+func (g *tcpBackend) Start() {
+	log.Infof("starting %s writer", g.name)
+	go g.run()
+}
+
+// run is the background worker that writes the queued data to the destination.
+// it returns when the backend is stopped, or when it has to give up while waiting for a connection.
+// TODO: conn.Write() returns no error for a while when the remote endpoint is down, the reconnect happens with a delay
+func (g *tcpBackend) run() {
+	defer close(g.done)
+	lock := &sync.Mutex{}
+	connectTicker := g.clock.Ticker(2 * time.Second)
+	defer connectTicker.Stop()
+	quit := make(chan struct{})
+	var conn net.Conn
+	var err error
+	defer func() {
+		close(quit)
+		lock.Lock()
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+		lock.Unlock()
+	}()
+	go func() {
+		for {
+			select {
+			case <-connectTicker.C:
+			case <-quit:
+				return
+			}
+			lock.Lock()
+			select {
+			case <-quit:
+				lock.Unlock()
+				return
+			default:
+			}
+			if conn == nil {
+				conn, err = net.Dial("tcp", g.addr)
+				if err == nil {
+					log.Infof("now connected to %s", g.addr)
+					atomic.StoreInt32(&g.connected, 1)
+				} else {
+					log.Warnf("dialing %s failed: %s. will retry", g.addr, err.Error())
+				}
+			}
+			if g.connMetric != "" {
+				g.report([]*common.Metric{{Bucket: g.connMetric, Value: float64(atomic.LoadInt32(&g.connected)), Modifier: "g", Sampling: 1}})
+			}
+			lock.Unlock()
+		}
+	}()
+	// wait sleeps for d, and returns false if the backend has to give up instead
+	wait := func(d time.Duration) bool {
+		select {
+		case <-g.clock.After(d):
+			return true
+		case <-g.stop:
+			log.Warnf("%s: stopped while waiting for a connection to %s", g.name, g.addr)
+			return false
+		}
+	}
+	var buf []byte
+	for {
+		points, more := g.next()
+		if !more {
+			return
+		}
+		buf = g.render(buf[:0], points)
+		lock.Lock()
+		haveConn := (conn != nil)
+		lock.Unlock()
+		for !haveConn {
+			if !wait(time.Second) {
+				return
+			}
+			lock.Lock()
+			haveConn = (conn != nil)
+			lock.Unlock()
+		}
+		if log.IsLevelEnabled(log.DebugLevel) {
+			for _, p := range points {
+				log.Debugf("writing %s %v %d", p.Key(), p.Value, p.Time)
+			}
+		}
+		ok := false
+		var duration time.Duration
+		var pre time.Time
+		for !ok {
+			pre = g.clock.Now()
+			lock.Lock()
+			_, err = conn.Write(buf)
+			if err == nil {
+				ok = true
+				duration = g.clock.Now().Sub(pre)
+				log.Debugf("wrote metrics payload to %s!", g.name)
+			} else {
+				log.Errorf("failed to write to %s: %s (took %s). will retry...", g.name, err, g.clock.Now().Sub(pre))
+				conn.Close()
+				conn = nil
+				atomic.StoreInt32(&g.connected, 0)
+				haveConn = false
+			}
+			lock.Unlock()
+			for !ok && !haveConn {
+				if !wait(2 * time.Second) {
+					return
+				}
+				lock.Lock()
+				haveConn = (conn != nil)
+				lock.Unlock()
+			}
+		}
+		g.sent(duration)
+	}
+}
@@ -0,0 +1,189 @@
+package statsdaemon
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/raintank/statsdaemon/out"
+)
+
+// graphiteDestination is one of the comma separated host:port[:instance] entries of graphite_addr
+type graphiteDestination struct {
+	addr     string // host:port
+	host     string
+	instance string
+}
+
+// parseGraphiteDestinations parses graphite_addr. the instance is optional, and only used for the hash ring,
+// like carbon-relay's DESTINATIONS setting.
+func parseGraphiteDestinations(s string) ([]graphiteDestination, error) {
+	var dests []graphiteDestination
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		d := graphiteDestination{addr: entry}
+		host, _, err := net.SplitHostPort(entry)
+		if err != nil {
+			pos := strings.LastIndexByte(entry, ':')
+			if pos < 0 {
+				return nil, fmt.Errorf("graphite_addr %q: expected host:port[:instance]", entry)
+			}
+			d.addr, d.instance = entry[:pos], entry[pos+1:]
+			host, _, err = net.SplitHostPort(d.addr)
+			if err != nil || d.instance == "" {
+				return nil, fmt.Errorf("graphite_addr %q: expected host:port[:instance]", entry)
+			}
+		}
+		d.host = host
+		// the ring only looks at the host and instance, so they must be unique
+		if seen[d.nodeKey()] {
+			return nil, fmt.Errorf("graphite_addr %q: duplicate destination, use instance names to tell destinations on the same host apart", entry)
+		}
+		seen[d.nodeKey()] = true
+		dests = append(dests, d)
+	}
+	if len(dests) == 0 {
+		return nil, fmt.Errorf("graphite_addr is empty")
+	}
+	return dests, nil
+}
+
+// nodeKey returns the key of the destination in the hash ring, which is how carbon formats its (server, instance) tuples
+func (d graphiteDestination) nodeKey() string {
+	if d.instance == "" {
+		return fmt.Sprintf("('%s', None)", d.host)
+	}
+	return fmt.Sprintf("('%s', '%s')", d.host, d.instance)
+}
+
+// hashRingReplicas is the amount of positions each destination takes on the ring, as in carbon
+const hashRingReplicas = 100
+
+type ringEntry struct {
+	pos  int
+	node int
+}
+
+// hashRing is a consistent hash ring that assigns metrics to the same destinations as carbon-relay
+// does with RELAY_METHOD = consistent-hashing (the carbon_ch hash type)
+type hashRing []ringEntry
+
+func newHashRing(dests []graphiteDestination) hashRing {
+	var ring hashRing
+	taken := make(map[int]bool)
+	for i, d := range dests {
+		key := d.nodeKey()
+		for r := 0; r < hashRingReplicas; r++ {
+			pos := ringPosition(fmt.Sprintf("%s:%d", key, r))
+			for taken[pos] {
+				pos++
+			}
+			taken[pos] = true
+			ring = append(ring, ringEntry{pos, i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].pos < ring[j].pos })
+	return ring
+}
+
+// ringPosition returns the first 2 bytes of the md5 sum of the key
+func ringPosition(key string) int {
+	sum := md5.Sum([]byte(key))
+	return int(binary.BigEndian.Uint16(sum[:2]))
+}
+
+// node returns the index of the destination for the metric key:
+// the first one at or after the key's position, wrapping around.
+func (r hashRing) node(key string) int {
+	pos := ringPosition(key)
+	i := sort.Search(len(r), func(i int) bool { return r[i].pos >= pos })
+	if i == len(r) {
+		i = 0
+	}
+	return r[i].node
+}
+
+// graphiteRouter sends to multiple graphite destinations, each with their own connection and queue,
+// so that a destination that is down doesn't hold up the others.
+// the routing mode determines which destinations get the points:
+// "hash" spreads them with the hash ring, "all" sends everything everywhere and
+// "failover" sends everything to the first destination that is connected.
+type graphiteRouter struct {
+	routing string
+	dests   []*tcpBackend
+	ring    hashRing
+}
+
+func newGraphiteRouter(routing string, dests []graphiteDestination, backends []*tcpBackend) (*graphiteRouter, error) {
+	switch routing {
+	case "hash", "all", "failover":
+	default:
+		return nil, fmt.Errorf("unknown graphite_routing %q", routing)
+	}
+	return &graphiteRouter{
+		routing: routing,
+		dests:   backends,
+		ring:    newHashRing(dests),
+	}, nil
+}
+
+func (r *graphiteRouter) Start() {
+	for _, d := range r.dests {
+		d.Start()
+	}
+}
+
+func (r *graphiteRouter) Submit(points []out.Point) {
+	switch r.routing {
+	case "all":
+		for _, d := range r.dests {
+			d.Submit(points)
+		}
+	case "failover":
+		for _, d := range r.dests {
+			if d.isConnected() {
+				d.Submit(points)
+				return
+			}
+		}
+		// nothing is connected. queue up for the primary
+		r.dests[0].Submit(points)
+	default:
+		split := make([][]out.Point, len(r.dests))
+		for _, p := range points {
+			i := r.ring.node(p.Key())
+			split[i] = append(split[i], p)
+		}
+		for i, d := range r.dests {
+			if len(split[i]) > 0 {
+				d.Submit(split[i])
+			}
+		}
+	}
+}
+
+// queues returns the queues of all destinations
+func (r *graphiteRouter) queues() []*backendQueue {
+	queues := make([]*backendQueue, len(r.dests))
+	for i, d := range r.dests {
+		queues[i] = &d.backendQueue
+	}
+	return queues
+}
+
+// Stop stops all destinations at once, so that they get the full timeout
+func (r *graphiteRouter) Stop(timeout time.Duration) int {
+	backends := make([]out.Backend, len(r.dests))
+	for i, d := range r.dests {
+		backends[i] = d
+	}
+	return stopBackends(backends, timeout)
+}
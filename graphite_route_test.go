@@ -0,0 +1,188 @@
+package statsdaemon
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/bmizerany/assert"
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+)
+
+func TestParseGraphiteDestinations(t *testing.T) {
+	dests, err := parseGraphiteDestinations("127.0.0.1:2003, carbon:2004:a,[::1]:2003:b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, dests, []graphiteDestination{
+		{"127.0.0.1:2003", "127.0.0.1", ""},
+		{"carbon:2004", "carbon", "a"},
+		{"[::1]:2003", "::1", "b"},
+	})
+	assert.Equal(t, dests[0].nodeKey(), "('127.0.0.1', None)")
+	assert.Equal(t, dests[1].nodeKey(), "('carbon', 'a')")
+
+	for _, in := range []string{"", "carbon", "carbon:2003:", "carbon:2003,carbon:2004", "carbon:2003:a,carbon:2004:a"} {
+		if _, err := parseGraphiteDestinations(in); err == nil {
+			t.Fatalf("%q: expected an error", in)
+		}
+	}
+}
+
+// TestHashRing checks the ring against the destinations carbon's ConsistentHashRing picks
+func TestHashRing(t *testing.T) {
+	dests := []graphiteDestination{
+		{"127.0.0.1:2103", "127.0.0.1", "a"},
+		{"127.0.0.1:2203", "127.0.0.1", "b"},
+		{"10.0.0.3:2003", "10.0.0.3", ""},
+	}
+	ring := newHashRing(dests)
+	assert.Equal(t, len(ring), 3*hashRingReplicas)
+	cases := map[string]int{
+		"foo.bar":                 2,
+		"stats.counters.x.count":  1,
+		"a":                       0,
+		"servers.web1.cpu;dc=ams": 1,
+	}
+	for key, exp := range cases {
+		if got := ring.node(key); got != exp {
+			t.Fatalf("%q: expected destination %d, got %d", key, exp, got)
+		}
+	}
+}
+
+// listenLines accepts a connection on a new listener and sends the lines it receives to the channel
+func listenLines(t *testing.T) (net.Listener, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string, 100)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- line
+		}
+	}()
+	return ln, lines
+}
+
+func readLines(t *testing.T, lines chan string, n int) []string {
+	var got []string
+	for len(got) < n {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d lines: %v", len(got), got)
+		}
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestGraphiteRouter(t *testing.T) {
+	ln1, lines1 := listenLines(t)
+	defer ln1.Close()
+	ln2, lines2 := listenLines(t)
+	defer ln2.Close()
+	// a destination that is down
+	ln3, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln3.Close()
+
+	dests := []graphiteDestination{
+		{ln1.Addr().String(), "127.0.0.1", "a"},
+		{ln2.Addr().String(), "127.0.0.1", "b"},
+		{ln3.Addr().String(), "127.0.0.1", "c"},
+	}
+	newRouter := func(routing string) *graphiteRouter {
+		internal := make(chan []*common.Metric, 1000)
+		var backends []*tcpBackend
+		for _, d := range dests {
+			backends = append(backends, newGraphiteBackend(d.addr, d.addr+":"+d.instance, clock.New(), "internal.", internal))
+		}
+		r, err := newGraphiteRouter(routing, dests, backends)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	// the destination that is down doesn't hold up the others
+	r := newRouter("hash")
+	var points []out.Point
+	var exp [3][]string
+	for i := 0; i < 30; i++ {
+		p := out.Point{Name: "foo" + string('a'+byte(i)), Value: 1, Time: 1500000000}
+		points = append(points, p)
+		n := r.ring.node(p.Key())
+		exp[n] = append(exp[n], p.Name+" 1 1500000000\n")
+	}
+	assert.T(t, len(exp[0]) > 0 && len(exp[1]) > 0 && len(exp[2]) > 0)
+	r.Start()
+	r.Submit(points)
+	sort.Strings(exp[0])
+	sort.Strings(exp[1])
+	assert.Equal(t, readLines(t, lines1, len(exp[0])), exp[0])
+	assert.Equal(t, readLines(t, lines2, len(exp[1])), exp[1])
+	// the writer of the down destination holds on to the first batch, the next ones queue up
+	r.Submit(points)
+	assert.Equal(t, len(r.dests[2].queue), 1)
+
+	_, err = newGraphiteRouter("random", dests, nil)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestGraphiteRouterAll(t *testing.T) {
+	ln1, lines1 := listenLines(t)
+	defer ln1.Close()
+	ln2, lines2 := listenLines(t)
+	defer ln2.Close()
+	dests := []graphiteDestination{
+		{ln1.Addr().String(), "127.0.0.1", "a"},
+		{ln2.Addr().String(), "127.0.0.1", "b"},
+	}
+	internal := make(chan []*common.Metric, 1000)
+	backends := []*tcpBackend{
+		newGraphiteBackend(dests[0].addr, dests[0].addr, clock.New(), "internal.", internal),
+		newGraphiteBackend(dests[1].addr, dests[1].addr, clock.New(), "internal.", internal),
+	}
+	r, err := newGraphiteRouter("all", dests, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	r.Submit([]out.Point{{Name: "foo", Value: 1, Time: 1500000000}, {Name: "bar", Value: 2, Time: 1500000000}})
+	exp := []string{"bar 2 1500000000\n", "foo 1 1500000000\n"}
+	assert.Equal(t, readLines(t, lines1, 2), exp)
+	assert.Equal(t, readLines(t, lines2, 2), exp)
+	r.Stop(time.Second)
+
+	// each destination reports its own metrics
+	buckets := make(map[string]bool)
+	for len(internal) > 0 {
+		for _, m := range <-internal {
+			buckets[m.Bucket] = true
+		}
+	}
+	_, port, _ := net.SplitHostPort(dests[0].addr)
+	id := "destination_is_127_0_0_1_" + port
+	assert.T(t, buckets["internal.mtype_is_gauge.type_is_send.backend_is_graphite."+id+".unit_is_ms"], buckets)
+	assert.T(t, buckets["internal.mtype_is_gauge.type_is_connected.backend_is_graphite."+id+".unit_is_Conn"], buckets)
+}
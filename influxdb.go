@@ -0,0 +1,154 @@
+package statsdaemon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+	log "github.com/sirupsen/logrus"
+)
+
+// influxdbMaxPacketSize is the max size of the payload of a udp packet, so that packets don't get fragmented
+const influxdbMaxPacketSize = 1400
+
+// influxdbBackend submits the data to InfluxDB in line protocol, over http (the /write endpoint) or udp
+type influxdbBackend struct {
+	backendQueue
+	url       *url.URL
+	batchSize int
+	gzip      bool
+	client    *http.Client
+	dial      func(network, address string) (net.Conn, error) // net.Dial, except in tests
+}
+
+// newInfluxdbBackend creates a backend for the given address, which is either a http(s) url of the
+// write endpoint, like http://localhost:8086/write?db=statsd, or udp://host:port.
+// batchSize is the max amount of lines per request or packet.
+func newInfluxdbBackend(addr string, batchSize int, gzip bool, prefixInternal string, internal chan<- []*common.Metric) (*influxdbBackend, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("influxdb_addr %q: %s", addr, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		q := u.Query()
+		q.Set("precision", "s")
+		u.RawQuery = q.Encode()
+	case "udp":
+	default:
+		return nil, fmt.Errorf("influxdb_addr %q: scheme must be http, https or udp", addr)
+	}
+	if batchSize < 1 {
+		return nil, fmt.Errorf("influxdb_batch_size must be at least 1")
+	}
+	return &influxdbBackend{
+		backendQueue: newBackendQueue("influxdb", "", prefixInternal, internal),
+		url:          u,
+		batchSize:    batchSize,
+		gzip:         gzip,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		dial:         net.Dial,
+	}, nil
+}
+
+func (b *influxdbBackend) Start() {
+	log.Infof("starting InfluxDB writer")
+	go b.run()
+}
+
+// run is the background worker that writes the queued data to InfluxDB
+func (b *influxdbBackend) run() {
+	defer close(b.done)
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		points, ok := b.next()
+		if !ok {
+			break
+		}
+		if b.url.Scheme == "udp" && conn == nil {
+			// this only fails when the address can't be resolved, which may be temporary,
+			// so it is tried again for the next payload
+			var err error
+			conn, err = b.dial("udp", b.url.Host)
+			if err != nil {
+				log.Errorf("influxdb: %s. dropping %d points", err, len(points))
+				conn = nil
+				b.dropped()
+				continue
+			}
+		}
+		lines := out.InfluxLines(points)
+		pre := time.Now()
+		delivered := true
+		for len(lines) > 0 {
+			n := b.batchSize
+			if n > len(lines) {
+				n = len(lines)
+			}
+			if b.url.Scheme == "udp" {
+				if !b.writeUDP(conn, lines[:n]) {
+					delivered = false
+				}
+			} else if !b.post(bytes.Join(lines[:n], nil)) {
+				delivered = false
+			}
+			lines = lines[n:]
+		}
+		if delivered {
+			b.sent(time.Since(pre))
+		} else {
+			b.dropped()
+		}
+	}
+}
+
+// writeUDP writes the lines in as few packets as possible, without exceeding influxdbMaxPacketSize,
+// unless a single line is larger than that. it returns whether all packets were written.
+func (b *influxdbBackend) writeUDP(conn net.Conn, lines [][]byte) bool {
+	var packet []byte
+	written := true
+	flush := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := conn.Write(packet); err != nil {
+			log.Errorf("influxdb: failed to write %d bytes: %s", len(packet), err)
+			written = false
+		}
+		packet = packet[:0]
+	}
+	for _, line := range lines {
+		if len(packet)+len(line) > influxdbMaxPacketSize {
+			flush()
+		}
+		packet = append(packet, line...)
+	}
+	flush()
+	return written
+}
+
+// post sends the lines to the write endpoint. it returns whether they were delivered.
+func (b *influxdbBackend) post(body []byte) bool {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	if b.gzip {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(body)
+		w.Close()
+		body = buf.Bytes()
+		header.Set("Content-Encoding", "gzip")
+	}
+	return retryPost(b.client, b.name, b.url.String(), header, body, b.stop)
+}
@@ -0,0 +1,350 @@
+package statsdaemon
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/raintank/statsdaemon/common"
+)
+
+// overflowBucket is what new buckets over a limit are folded into, if the limits say so
+const overflowBucket = "__overflow__"
+
+// otherTagValues is the value that the values of a tag key beyond maxTagValues share a limit as
+const otherTagValues = "__other__"
+
+// maxTagValues is how many values of a tag key get their own limit per interval, so that a tag
+// with unbounded values can't grow the limiter itself without bounds
+const maxTagValues = 1000
+
+// BucketLimits limits the amount of distinct buckets per interval, to protect statsdaemon and the backends
+// against clients that put ids or other unbounded values in their buckets.
+// there is a global limit, limits per prefix, where the longest matching prefix applies, and limits per
+// value of a tag, where the tag is a graphite tag or a metrics 2.0 node (key=value or key_is_value).
+// a new bucket must fit within all limits that apply to it. if it doesn't, its metrics are dropped,
+// or with Overflow, aggregated as __overflow__: the prefix followed by __overflow__ for a prefix limit,
+// __overflow__ with the tag for a tag limit.
+type BucketLimits struct {
+	Max      int // 0 means no global limit
+	Prefixes []PrefixLimit
+	Tags     map[string]int // by tag key
+	Overflow bool
+}
+
+type PrefixLimit struct {
+	Prefix string
+	Max    int
+}
+
+// NewBucketLimits parses the limits. prefixes is a ';' separated list of prefix:limit, tags a ';' separated
+// list of tag:limit. action is drop or overflow.
+func NewBucketLimits(max int, prefixes, tags, action string) (*BucketLimits, error) {
+	l := &BucketLimits{Max: max, Tags: make(map[string]int)}
+	if max < 0 {
+		return nil, fmt.Errorf("max_buckets can't be negative")
+	}
+	parse := func(spec string) (string, int, error) {
+		pos := strings.LastIndex(spec, ":")
+		if pos < 1 {
+			return "", 0, fmt.Errorf("bucket limit %q: expected <prefix or tag>:<limit>", spec)
+		}
+		n, err := strconv.Atoi(spec[pos+1:])
+		if err != nil || n < 1 {
+			return "", 0, fmt.Errorf("bucket limit %q: limit must be a positive number", spec)
+		}
+		return spec[:pos], n, nil
+	}
+	for _, spec := range strings.Split(prefixes, ";") {
+		if spec == "" {
+			continue
+		}
+		prefix, n, err := parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		l.Prefixes = append(l.Prefixes, PrefixLimit{prefix, n})
+	}
+	// so that the first match is the longest
+	sort.SliceStable(l.Prefixes, func(i, j int) bool { return len(l.Prefixes[i].Prefix) > len(l.Prefixes[j].Prefix) })
+	for _, spec := range strings.Split(tags, ";") {
+		if spec == "" {
+			continue
+		}
+		tag, n, err := parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		l.Tags[tag] = n
+	}
+	switch action {
+	case "drop":
+	case "overflow":
+		l.Overflow = true
+	default:
+		return nil, fmt.Errorf("unknown bucket_limit_action %q", action)
+	}
+	return l, nil
+}
+
+func (l *BucketLimits) enabled() bool {
+	return l != nil && (l.Max > 0 || len(l.Prefixes) > 0 || len(l.Tags) > 0)
+}
+
+// LimitStats describes a limit in the last interval, for the admin api
+type LimitStats struct {
+	Limit    string  `json:"limit"` // global, prefix <prefix> or tag <key>=<value>
+	Max      int     `json:"max"`
+	Buckets  int     `json:"buckets"`  // distinct buckets that were accepted
+	Rejected float64 `json:"rejected"` // metrics for new buckets that were dropped or folded
+}
+
+// limit is the state of a limit in the current interval. it is shared by the shards.
+type limit struct {
+	name     string // as in LimitStats
+	max      int
+	buckets  int64 // accessed atomically
+	rejected int64 // in the interval, accessed atomically
+	metric   string
+	overflow *common.Metric // template of the metrics to fold into
+}
+
+// limiter enforces the bucket limits. with multiple shards, it is applied by all of them at once.
+// the buckets that were seen are kept per shard of the (possibly rewritten) bucket, so that
+// the shards rarely contend for them, and the limits are counted atomically.
+// it is reset between intervals, when the shards are idle.
+type limiter struct {
+	limits         *BucketLimits
+	prefixInternal string
+	seen           []*seenBuckets // by shard
+	global         *limit
+	prefixes       []*limit
+	maxTagValues   int
+	tagsLock       sync.RWMutex
+	tags           map[string]*limit // by key=value
+	tagValues      map[string]int    // amount of values with their own limit, by key
+	last           atomic.Value      // []LimitStats
+}
+
+// seenBuckets are the keys of the buckets of a shard that fit within the limits
+type seenBuckets struct {
+	sync.Mutex
+	keys map[string]struct{}
+}
+
+func newLimiter(limits *BucketLimits, prefixInternal string, shards int) *limiter {
+	l := &limiter{
+		limits:         limits,
+		prefixInternal: prefixInternal,
+		seen:           make([]*seenBuckets, shards),
+		maxTagValues:   maxTagValues,
+	}
+	l.last.Store([]LimitStats{})
+	if limits.enabled() {
+		l.reset()
+	}
+	return l
+}
+
+func (l *limiter) newLimit(name, node string, max int, overflow *common.Metric) *limit {
+	return &limit{
+		name:     name,
+		max:      max,
+		metric:   fmt.Sprintf("%smtype_is_count.type_is_bucket_limit.%s.unit_is_Metric", l.prefixInternal, node),
+		overflow: overflow,
+	}
+}
+
+// limitNode makes a value usable as a node of a metrics 2.0 metric
+var limitNode = strings.NewReplacer(".", "_", "=", "_", " ", "_")
+
+// reset starts a new interval, and keeps the stats of the last one
+func (l *limiter) reset() {
+	if !l.limits.enabled() {
+		return
+	}
+	if l.tags != nil {
+		var stats []LimitStats
+		add := func(lim *limit) {
+			stats = append(stats, LimitStats{lim.name, lim.max, int(lim.buckets), float64(lim.rejected)})
+		}
+		if l.global != nil {
+			add(l.global)
+		}
+		for _, lim := range l.prefixes {
+			add(lim)
+		}
+		var tags []string
+		for tag, lim := range l.tags {
+			// there may be many values, so only those that matter
+			if lim.rejected > 0 {
+				tags = append(tags, tag)
+			}
+		}
+		sort.Strings(tags)
+		for _, tag := range tags {
+			add(l.tags[tag])
+		}
+		l.last.Store(stats)
+	}
+
+	for i := range l.seen {
+		l.seen[i] = &seenBuckets{keys: make(map[string]struct{})}
+	}
+	l.global = nil
+	if l.limits.Max > 0 {
+		l.global = l.newLimit("global", "limit_is_global", l.limits.Max, &common.Metric{Bucket: overflowBucket})
+	}
+	l.prefixes = make([]*limit, len(l.limits.Prefixes))
+	for i, p := range l.limits.Prefixes {
+		l.prefixes[i] = l.newLimit("prefix "+p.Prefix, "limit_is_prefix.prefix_is_"+limitNode.Replace(p.Prefix), p.Max, &common.Metric{Bucket: p.Prefix + overflowBucket})
+	}
+	l.tags = make(map[string]*limit)
+	l.tagValues = make(map[string]int)
+}
+
+// tagLimit returns the limit for a tag value, creating it if it's the first time the value is seen.
+// once a key has maxTagValues values, the values that are new share the limit of __other__.
+func (l *limiter) tagLimit(key, value string, max int) *limit {
+	tag := key + "=" + value
+	l.tagsLock.RLock()
+	lim, ok := l.tags[tag]
+	l.tagsLock.RUnlock()
+	if ok {
+		return lim
+	}
+	l.tagsLock.Lock()
+	defer l.tagsLock.Unlock()
+	if lim, ok := l.tags[tag]; ok {
+		return lim
+	}
+	if l.tagValues[key] >= l.maxTagValues {
+		value = otherTagValues
+		tag = key + "=" + value
+		if lim, ok := l.tags[tag]; ok {
+			return lim
+		}
+	} else {
+		l.tagValues[key]++
+	}
+	node := "limit_is_tag.tag_is_" + limitNode.Replace(key) + ".value_is_" + limitNode.Replace(value)
+	lim = l.newLimit("tag "+tag, node, max, &common.Metric{Bucket: overflowBucket, Tags: []string{tag}})
+	l.tags[tag] = lim
+	return lim
+}
+
+// tagLimits returns the limits for the tags of the metric. they're created as new tag values are seen.
+func (l *limiter) tagLimits(m *common.Metric, buf []*limit) []*limit {
+	add := func(key, value string) {
+		max, ok := l.limits.Tags[key]
+		if !ok {
+			return
+		}
+		buf = append(buf, l.tagLimit(key, value, max))
+	}
+	for _, tag := range m.Tags {
+		if pos := strings.Index(tag, "="); pos > 0 {
+			add(tag[:pos], tag[pos+1:])
+		}
+	}
+	for _, node := range strings.Split(m.Bucket, ".") {
+		if pos := strings.Index(node, "="); pos > 0 {
+			add(node[:pos], node[pos+1:])
+		} else if pos := strings.Index(node, "_is_"); pos > 0 {
+			add(node[:pos], node[pos+4:])
+		}
+	}
+	return buf
+}
+
+// admit counts a new bucket against the limits that apply to it. if one of them is full,
+// the bucket isn't counted, and the full limit is returned.
+func admit(applies []*limit) *limit {
+	for i, lim := range applies {
+		if atomic.AddInt64(&lim.buckets, 1) > int64(lim.max) {
+			for _, undo := range applies[:i+1] {
+				atomic.AddInt64(&undo.buckets, -1)
+			}
+			return lim
+		}
+	}
+	return nil
+}
+
+// apply returns the metrics that fit within the limits, the ones that don't folded into their overflow bucket
+// if configured, followed by the internal counters of the limits that were hit.
+// statsdaemon's own metrics are left alone. like the filter, it doesn't modify the metrics.
+func (l *limiter) apply(metrics []*common.Metric) []*common.Metric {
+	if !l.limits.enabled() {
+		return metrics
+	}
+	kept := make([]*common.Metric, 0, len(metrics))
+	var hit []*limit
+	var pending []float64 // per limit that was hit
+	var buf []*limit
+	for _, m := range metrics {
+		if strings.HasPrefix(m.Bucket, l.prefixInternal) {
+			kept = append(kept, m)
+			continue
+		}
+		key := m.Key()
+		seen := l.seen[shardOf(m.Bucket, len(l.seen))]
+		seen.Lock()
+		if _, ok := seen.keys[key]; ok {
+			seen.Unlock()
+			kept = append(kept, m)
+			continue
+		}
+		applies := buf[:0]
+		if l.global != nil {
+			applies = append(applies, l.global)
+		}
+		for i, p := range l.limits.Prefixes {
+			if strings.HasPrefix(m.Bucket, p.Prefix) {
+				applies = append(applies, l.prefixes[i])
+				break
+			}
+		}
+		if len(l.limits.Tags) > 0 {
+			applies = l.tagLimits(m, applies)
+		}
+		buf = applies
+		over := admit(applies)
+		if over == nil {
+			seen.keys[key] = struct{}{}
+		}
+		seen.Unlock()
+		if over == nil {
+			kept = append(kept, m)
+			continue
+		}
+		atomic.AddInt64(&over.rejected, 1)
+		j := 0
+		for j < len(hit) && hit[j] != over {
+			j++
+		}
+		if j == len(hit) {
+			hit = append(hit, over)
+			pending = append(pending, 0)
+		}
+		pending[j]++
+		if l.limits.Overflow {
+			folded := *m
+			folded.Bucket = over.overflow.Bucket
+			folded.Tags = over.overflow.Tags
+			kept = append(kept, &folded)
+		}
+	}
+	for i, lim := range hit {
+		kept = append(kept, &common.Metric{Bucket: lim.metric, Value: pending[i], Modifier: "c", Sampling: 1})
+	}
+	return kept
+}
+
+// stats returns the stats of the limits in the last interval
+func (l *limiter) stats() []LimitStats {
+	return l.last.Load().([]LimitStats)
+}
@@ -0,0 +1,146 @@
+package statsdaemon
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/raintank/statsdaemon/common"
+)
+
+func TestNewBucketLimits(t *testing.T) {
+	l, err := NewBucketLimits(100, "api.:10;api.users.:5", "service:20", "overflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, l, &BucketLimits{
+		Max:      100,
+		Prefixes: []PrefixLimit{{"api.users.", 5}, {"api.", 10}},
+		Tags:     map[string]int{"service": 20},
+		Overflow: true,
+	})
+	assert.Equal(t, l.enabled(), true)
+	l, _ = NewBucketLimits(0, "", "", "drop")
+	assert.Equal(t, l.enabled(), false)
+
+	for _, c := range [][]string{{"api.", ""}, {"api.:0", ""}, {":5", ""}, {"", "service:x"}, {"", "", "block"}} {
+		action := "drop"
+		if len(c) > 2 {
+			action = c[2]
+		}
+		if _, err := NewBucketLimits(0, c[0], c[1], action); err == nil {
+			t.Fatalf("%q: expected an error", c)
+		}
+	}
+}
+
+func counter(bucket string, tags ...string) *common.Metric {
+	return &common.Metric{Bucket: bucket, Value: 1, Modifier: "c", Sampling: 1, Tags: tags}
+}
+
+// applyLimits returns the values per key of the metrics the limiter keeps
+func applyLimits(l *limiter, metrics ...*common.Metric) map[string]float64 {
+	got := make(map[string]float64)
+	for _, m := range l.apply(metrics) {
+		got[m.Key()] += m.Value
+	}
+	return got
+}
+
+func TestLimiter(t *testing.T) {
+	limits, err := NewBucketLimits(4, "api.:2", "", "drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimiter(limits, "internal.", 1)
+	got := applyLimits(l, counter("api.a"), counter("api.b"), counter("api.c"), counter("api.a"), counter("internal.foo"))
+	assert.Equal(t, got, map[string]float64{
+		"api.a":        2,
+		"api.b":        1,
+		"internal.foo": 1,
+		"internal.mtype_is_count.type_is_bucket_limit.limit_is_prefix.prefix_is_api_.unit_is_Metric": 1,
+	})
+	got = applyLimits(l, counter("x"), counter("y"), counter("z"), counter("api.d"))
+	assert.Equal(t, got, map[string]float64{
+		"x": 1,
+		"y": 1,
+		"internal.mtype_is_count.type_is_bucket_limit.limit_is_global.unit_is_Metric": 2,
+	})
+
+	// the stats cover the last interval, and the limits start over
+	assert.Equal(t, l.stats(), []LimitStats{})
+	l.reset()
+	assert.Equal(t, l.stats(), []LimitStats{
+		{Limit: "global", Max: 4, Buckets: 4, Rejected: 2},
+		{Limit: "prefix api.", Max: 2, Buckets: 2, Rejected: 1},
+	})
+	got = applyLimits(l, counter("api.c"))
+	assert.Equal(t, got, map[string]float64{"api.c": 1})
+}
+
+func TestLimiterOverflowTags(t *testing.T) {
+	limits, err := NewBucketLimits(0, "", "service:2", "overflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimiter(limits, "internal.", 1)
+	var metrics []*common.Metric
+	for i := 0; i < 4; i++ {
+		// as graphite tag, and as metrics 2.0 node
+		metrics = append(metrics, counter(fmt.Sprintf("requests.id_is_%d", i), "service=api"))
+		metrics = append(metrics, counter(fmt.Sprintf("service_is_web.id_is_%d", i)))
+	}
+	metrics = append(metrics, counter("other.1"), counter("other.2"), counter("other.3"))
+	got := applyLimits(l, metrics...)
+	assert.Equal(t, got, map[string]float64{
+		"requests.id_is_0;service=api": 1,
+		"requests.id_is_1;service=api": 1,
+		"__overflow__;service=api":     2,
+		"service_is_web.id_is_0":       1,
+		"service_is_web.id_is_1":       1,
+		"__overflow__;service=web":     2,
+		"other.1":                      1,
+		"other.2":                      1,
+		"other.3":                      1,
+		"internal.mtype_is_count.type_is_bucket_limit.limit_is_tag.tag_is_service.value_is_api.unit_is_Metric": 2,
+		"internal.mtype_is_count.type_is_bucket_limit.limit_is_tag.tag_is_service.value_is_web.unit_is_Metric": 2,
+	})
+	// the metrics are shared with metricStatsMonitor, and must not change
+	assert.Equal(t, metrics[4].Bucket, "requests.id_is_2")
+
+	l.reset()
+	assert.Equal(t, l.stats(), []LimitStats{
+		{Limit: "tag service=api", Max: 2, Buckets: 2, Rejected: 2},
+		{Limit: "tag service=web", Max: 2, Buckets: 2, Rejected: 2},
+	})
+}
+
+func TestLimiterTagValues(t *testing.T) {
+	limits, err := NewBucketLimits(0, "", "host:1", "overflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimiter(limits, "internal.", 1)
+	l.maxTagValues = 2
+	var metrics []*common.Metric
+	for i := 0; i < 5; i++ {
+		metrics = append(metrics, counter(fmt.Sprintf("cpu.host_is_%d", i)))
+	}
+	got := applyLimits(l, metrics...)
+	// the values beyond the first two share a single limit
+	assert.Equal(t, got, map[string]float64{
+		"cpu.host_is_0":               1,
+		"cpu.host_is_1":               1,
+		"cpu.host_is_2":               1,
+		"__overflow__;host=__other__": 2,
+		"internal.mtype_is_count.type_is_bucket_limit.limit_is_tag.tag_is_host.value_is___other__.unit_is_Metric": 2,
+	})
+	assert.Equal(t, len(l.tags), 3)
+
+	l.reset()
+	assert.Equal(t, l.stats(), []LimitStats{
+		{Limit: "tag host=__other__", Max: 1, Buckets: 1, Rejected: 2},
+	})
+	got = applyLimits(l, counter("cpu.host_is_3"))
+	assert.Equal(t, got, map[string]float64{"cpu.host_is_3": 1})
+}
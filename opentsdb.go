@@ -0,0 +1,94 @@
+package statsdaemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+	log "github.com/sirupsen/logrus"
+)
+
+// newOpentsdbBackend creates a backend for OpenTSDB. if addr is a http(s) url, the data is posted to
+// the /api/put endpoint in batches of batchSize datapoints, otherwise addr is the host:port to send
+// telnet style put commands to.
+// defaultTags are added to the datapoints without them, as OpenTSDB needs at least one tag.
+func newOpentsdbBackend(addr string, batchSize int, defaultTags map[string]string, clock clock.Clock, prefixInternal string, internal chan<- []*common.Metric) (out.Backend, error) {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		render := func(buf []byte, points []out.Point) []byte {
+			return out.WriteOpentsdb(buf, out.OpentsdbDatapoints(points, defaultTags))
+		}
+		return newTCPBackend("opentsdb", addr, "", render, clock, prefixInternal, internal), nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("opentsdb_addr %q: %s", addr, err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/api/put"
+	}
+	if batchSize < 1 {
+		return nil, fmt.Errorf("opentsdb_batch_size must be at least 1")
+	}
+	return &opentsdbHTTPBackend{
+		backendQueue: newBackendQueue("opentsdb", "", prefixInternal, internal),
+		url:          u.String(),
+		batchSize:    batchSize,
+		defaultTags:  defaultTags,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// opentsdbHTTPBackend submits the data to OpenTSDB's /api/put endpoint
+type opentsdbHTTPBackend struct {
+	backendQueue
+	url         string
+	batchSize   int
+	defaultTags map[string]string
+	client      *http.Client
+}
+
+func (b *opentsdbHTTPBackend) Start() {
+	log.Infof("starting OpenTSDB writer")
+	go b.run()
+}
+
+// run is the background worker that writes the queued data to OpenTSDB
+func (b *opentsdbHTTPBackend) run() {
+	defer close(b.done)
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	for {
+		points, ok := b.next()
+		if !ok {
+			break
+		}
+		dps := out.OpentsdbDatapoints(points, b.defaultTags)
+		pre := time.Now()
+		delivered := true
+		for len(dps) > 0 {
+			n := b.batchSize
+			if n > len(dps) {
+				n = len(dps)
+			}
+			body, err := json.Marshal(dps[:n])
+			if err != nil {
+				log.Errorf("opentsdb: cannot encode datapoints: %s", err)
+				delivered = false
+			} else if !retryPost(b.client, b.name, b.url, header, body, b.stop) {
+				delivered = false
+			}
+			dps = dps[n:]
+		}
+		if delivered {
+			b.sent(time.Since(pre))
+		} else {
+			b.dropped()
+		}
+	}
+}
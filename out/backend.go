@@ -0,0 +1,16 @@
+package out
+
+import "time"
+
+// Backend is a destination for the flushed metrics, like graphite or tsdbgw.
+// every flush, the metrics are submitted to all enabled backends.
+type Backend interface {
+	// Start starts writing submitted data in the background
+	Start()
+	// Submit enqueues the points of a flush for writing. the points are shared between backends,
+	// so they must not be modified. it should not block, even when the destination is unavailable.
+	Submit(points []Point)
+	// Stop stops accepting data, and returns once the queued data has been written, or the timeout passed.
+	// it returns the amount of payloads that were not written, and are lost.
+	Stop(timeout time.Duration) int
+}
@@ -21,21 +21,29 @@ func NewCounters(flushRates, flushCounts bool) *Counters {
 
 // Add updates the counters map, adding the metric key if needed
 func (c *Counters) Add(metric *common.Metric) {
-	c.Values[metric.Bucket] += metric.Value * float64(1/metric.Sampling)
+	c.Values[metric.Key()] += metric.Value * float64(1/metric.Sampling)
 }
 
-// processCounters computes the outbound metrics for counters and puts them in the buffer
-func (c *Counters) Process(buf []byte, now int64, interval int, f Formatter) ([]byte, int64) {
+// Merge adds the counts of other to c
+func (c *Counters) Merge(other *Counters) {
+	for key, val := range other.Values {
+		c.Values[key] += val
+	}
+}
+
+// Process computes the outbound points for counters
+func (c *Counters) Process(points []Point, now int64, interval int, f Formatter) ([]Point, int64) {
 	for key, val := range c.Values {
+		bucket, tags := splitKey(key)
 		if c.flushCounts {
-			key := m20.Count(key, f.Prefix_counters, f.Prefix_m20_counters, f.Prefix_m20ne_counters, f.Legacy_namespace)
-			buf = WriteFloat64(buf, []byte(key), val, now)
+			name := m20.Count(bucket, f.Prefix_counters, f.Prefix_m20_counters, f.Prefix_m20ne_counters, f.Legacy_namespace)
+			points = append(points, NewPoint(bucket, "count", name, tags, val, now, "count"))
 		}
 
 		if c.flushRates {
-			key := m20.DeriveCount(key, f.Prefix_rates, f.Prefix_m20_rates, f.Prefix_m20ne_rates, f.Legacy_namespace)
-			buf = WriteFloat64(buf, []byte(key), val/float64(interval), now)
+			name := m20.DeriveCount(bucket, f.Prefix_rates, f.Prefix_m20_rates, f.Prefix_m20ne_rates, f.Legacy_namespace)
+			points = append(points, NewPoint(bucket, "rate", name, tags, val/float64(interval), now, "rate"))
 		}
 	}
-	return buf, int64(len(c.Values))
+	return points, int64(len(c.Values))
 }
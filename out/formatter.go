@@ -10,16 +10,19 @@ type Formatter struct {
 	Prefix_gauges    string
 	Prefix_rates     string
 	Prefix_timers    string
+	Prefix_sets      string
 
 	// formatting of metrics2.0
 	Prefix_m20_counters string
 	Prefix_m20_gauges   string
 	Prefix_m20_rates    string
 	Prefix_m20_timers   string
+	Prefix_m20_sets     string
 
 	// metrics2.0 using _is_ convention instead of =
 	Prefix_m20ne_counters string
 	Prefix_m20ne_gauges   string
 	Prefix_m20ne_rates    string
 	Prefix_m20ne_timers   string
+	Prefix_m20ne_sets     string
 }
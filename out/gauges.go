@@ -7,26 +7,62 @@ import (
 
 type Gauges struct {
 	Values map[string]float64
+	idle   map[string]int // for gauges carried over from previous intervals: how many intervals since their last update
 }
 
 func NewGauges() *Gauges {
 	return &Gauges{
 		make(map[string]float64),
+		make(map[string]int),
 	}
 }
 
-// Add updates the gauges with the latest value for given key
+// Add updates the gauges with the latest value for given key,
+// or applies the value as a delta to the current value if it is relative
 func (g *Gauges) Add(metric *common.Metric) {
-	g.Values[metric.Bucket] = metric.Value
+	key := metric.Key()
+	if metric.Relative {
+		g.Values[key] += metric.Value
+	} else {
+		g.Values[key] = metric.Value
+	}
+	delete(g.idle, key)
+}
+
+// CarryOver returns the gauges to use for the next interval, starting out with the values of g.
+// gauges that haven't been updated in more than maxIdle intervals are dropped.
+// if maxIdle is 0, gauges are kept indefinitely.
+func (g *Gauges) CarryOver(maxIdle int) *Gauges {
+	next := NewGauges()
+	for key, val := range g.Values {
+		idle := g.idle[key] + 1
+		if maxIdle > 0 && idle > maxIdle {
+			continue
+		}
+		next.Values[key] = val
+		next.idle[key] = idle
+	}
+	return next
+}
+
+// Merge adds the gauges of other, which must not share keys with g
+func (g *Gauges) Merge(other *Gauges) {
+	for key, val := range other.Values {
+		g.Values[key] = val
+	}
+	for key, idle := range other.idle {
+		g.idle[key] = idle
+	}
 }
 
-// Process puts gauges in the outbound buffer
-func (g *Gauges) Process(buf []byte, now int64, interval int, f Formatter) ([]byte, int64) {
+// Process computes the outbound points for gauges
+func (g *Gauges) Process(points []Point, now int64, interval int, f Formatter) ([]Point, int64) {
 	var num int64
 	for key, val := range g.Values {
-		key = m20.Gauge(key, f.Prefix_gauges, f.Prefix_m20_gauges, f.Prefix_m20ne_gauges)
-		buf = WriteFloat64(buf, []byte(key), val, now)
+		bucket, tags := splitKey(key)
+		name := m20.Gauge(bucket, f.Prefix_gauges, f.Prefix_m20_gauges, f.Prefix_m20ne_gauges)
+		points = append(points, NewPoint(bucket, "value", name, tags, val, now, "gauge"))
 		num++
 	}
-	return buf, num
+	return points, num
 }
@@ -0,0 +1,149 @@
+package out
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/raintank/statsdaemon/common"
+)
+
+// HistogramSpecs is an ordered list of bin configurations. the first one that matches a bucket wins.
+type HistogramSpecs []*HistogramSpec
+
+// HistogramSpec defines the bins for all buckets containing pattern
+type HistogramSpec struct {
+	pattern string
+	bounds  []float64
+	names   []string
+}
+
+func (a *HistogramSpecs) Set(s string) error {
+	return nil
+}
+func (h *HistogramSpec) String() string {
+	return h.pattern + ":" + strings.Join(h.names, ",")
+}
+func (a *HistogramSpecs) String() string {
+	return fmt.Sprintf("%v", *a)
+}
+
+// NewHistogramSpec parses a spec like "api.latency:100,500,inf"
+// bins are exclusive upper bounds and must be ascending. the inf bin is always added.
+func NewHistogramSpec(spec string) (*HistogramSpec, error) {
+	pos := strings.LastIndex(spec, ":")
+	if pos == -1 {
+		return nil, fmt.Errorf("histogram spec %q: missing ':' between pattern and bins", spec)
+	}
+	h := &HistogramSpec{pattern: spec[:pos]}
+	bins := strings.Split(spec[pos+1:], ",")
+	for i, bin := range bins {
+		if bin == "inf" {
+			if i != len(bins)-1 {
+				return nil, fmt.Errorf("histogram spec %q: inf must be the last bin", spec)
+			}
+			break
+		}
+		f, err := strconv.ParseFloat(bin, 64)
+		if err != nil {
+			return nil, fmt.Errorf("histogram spec %q: %s", spec, err)
+		}
+		if len(h.bounds) > 0 && f <= h.bounds[len(h.bounds)-1] {
+			return nil, fmt.Errorf("histogram spec %q: bins must be ascending", spec)
+		}
+		h.bounds = append(h.bounds, f)
+		h.names = append(h.names, "lt_"+strings.Replace(bin, ".", "_", -1))
+	}
+	if len(h.bounds) == 0 {
+		return nil, fmt.Errorf("histogram spec %q: need at least one bin", spec)
+	}
+	h.names = append(h.names, "inf")
+	return h, nil
+}
+
+// NewHistogramSpecs parses a ';' separated list of histogram specs
+func NewHistogramSpecs(specs string) (*HistogramSpecs, error) {
+	histogramSpecs := HistogramSpecs{}
+	for _, spec := range strings.Split(specs, ";") {
+		if spec == "" {
+			continue
+		}
+		h, err := NewHistogramSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		histogramSpecs = append(histogramSpecs, h)
+	}
+	return &histogramSpecs, nil
+}
+
+// match returns the spec to use for the given bucket, if any
+func (a HistogramSpecs) match(bucket string) *HistogramSpec {
+	for _, h := range a {
+		if strings.Contains(bucket, h.pattern) {
+			return h
+		}
+	}
+	return nil
+}
+
+type Histograms struct {
+	specs  HistogramSpecs
+	Values map[string]*Histogram
+}
+
+func NewHistograms(specs HistogramSpecs) *Histograms {
+	return &Histograms{
+		specs,
+		make(map[string]*Histogram),
+	}
+}
+
+// Histogram holds the (estimated, based on sample rate) amount of values per bin.
+// Counts[i] holds the values below bound i but not below bound i-1, the last one the values
+// above all bounds. Sum is the (estimated) sum of the values.
+type Histogram struct {
+	spec   *HistogramSpec
+	Counts []float64
+	Sum    float64
+}
+
+// Add updates the bin counts for the metric key, if it matches a spec
+func (hs *Histograms) Add(metric *common.Metric) {
+	key := metric.Key()
+	h, ok := hs.Values[key]
+	if !ok {
+		spec := hs.specs.match(metric.Bucket)
+		if spec == nil {
+			return
+		}
+		h = &Histogram{spec: spec, Counts: make([]float64, len(spec.names))}
+		hs.Values[key] = h
+	}
+	i := 0
+	for i < len(h.spec.bounds) && metric.Value >= h.spec.bounds[i] {
+		i++
+	}
+	h.Counts[i] += float64(1 / metric.Sampling)
+	h.Sum += metric.Value * float64(1/metric.Sampling)
+}
+
+// Merge adds the histograms of other, which must not share keys with hs
+func (hs *Histograms) Merge(other *Histograms) {
+	for key, h := range other.Values {
+		hs.Values[key] = h
+	}
+}
+
+// Process computes the outbound points with the cumulative bin counts
+func (hs *Histograms) Process(points []Point, now int64, interval int, f Formatter) ([]Point, int64) {
+	for key, h := range hs.Values {
+		bucket, tags := splitKey(key)
+		cumulative := float64(0)
+		for i, name := range h.spec.names {
+			cumulative += h.Counts[i]
+			points = append(points, NewPoint(bucket, "bin_"+name, Bin(bucket, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, name), tags, cumulative, now, "count"))
+		}
+	}
+	return points, int64(len(hs.Values))
+}
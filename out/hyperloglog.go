@@ -0,0 +1,72 @@
+package out
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// precision of the HyperLogLog sketch. 2^14 registers of one byte each
+// gives a standard error of about 0.8%
+const (
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+)
+
+// hyperLogLog estimates the cardinality of a set in bounded memory
+// see http://algo.inria.fr/flajolet/Publications/FlFuGaMe07.pdf
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{
+		make([]uint8, hllRegisters),
+	}
+}
+
+// hashString returns a well-distributed 64bit hash of the input.
+// fnv by itself doesn't mix the high bits well enough, so we apply
+// the splitmix64 finalizer on top of it.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Add registers the given value in the sketch
+func (h *hyperLogLog) Add(val string) {
+	x := hashString(val)
+	idx := x >> (64 - hllPrecision)
+	// position of the first 1 bit in the remaining bits. the sentinel bit bounds it
+	rho := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rho > h.registers[idx] {
+		h.registers[idx] = rho
+	}
+}
+
+// Count returns the estimated amount of distinct values added
+func (h *hyperLogLog) Count() int64 {
+	m := float64(hllRegisters)
+	sum := float64(0)
+	zeros := 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	// for small cardinalities, linear counting is more accurate
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
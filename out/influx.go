@@ -0,0 +1,93 @@
+package out
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// InfluxLines renders the points in InfluxDB line protocol, with one line per bucket, tag set and timestamp.
+// the measurement is formed by the plain nodes of the bucket (or the "what" node, for metrics 2.0 buckets
+// that only have key/value nodes), the metrics 2.0 nodes and the tags become influx tags,
+// and the statistics (e.g. count and rate for counters, mean and upper_90 for timers) become the fields.
+// the mtype is left out, as it differs between the statistics of a bucket.
+// NaN and infinite values are not supported by InfluxDB, so they are skipped.
+// the timestamps are in seconds.
+func InfluxLines(points []Point) [][]byte {
+	var lines [][]byte
+	var times []int64
+	lineOf := make(map[string]int) // by series and time
+	series := make(map[string]string)
+	for _, p := range points {
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+		key := p.Bucket
+		if len(p.Tags) > 0 {
+			key += ";" + strings.Join(p.Tags, ";")
+		}
+		s, ok := series[key]
+		if !ok {
+			s = influxSeries(p.Bucket, p.Tags)
+			series[key] = s
+		}
+		id := s + " " + strconv.FormatInt(p.Time, 10)
+		i, ok := lineOf[id]
+		if ok {
+			lines[i] = append(lines[i], ',')
+		} else {
+			i = len(lines)
+			lineOf[id] = i
+			lines = append(lines, append([]byte(s), ' '))
+			times = append(times, p.Time)
+		}
+		lines[i] = append(lines[i], influxKey.Replace(p.Stat)...)
+		lines[i] = append(lines[i], '=')
+		lines[i] = strconv.AppendFloat(lines[i], p.Value, 'f', -1, 64)
+	}
+	for i := range lines {
+		lines[i] = append(lines[i], ' ')
+		lines[i] = strconv.AppendInt(lines[i], times[i], 10)
+		lines[i] = append(lines[i], '\n')
+	}
+	return lines
+}
+
+// influxSeries returns the measurement and tag set for the bucket and its tags, escaped for the line protocol
+func influxSeries(bucket string, tags []string) string {
+	plain, kv := splitNodes(bucket)
+	for _, tag := range tags {
+		if pos := strings.IndexByte(tag, '='); pos > 0 {
+			kv = append(kv, [2]string{tag[:pos], tag[pos+1:]})
+		}
+	}
+	measurement := strings.Join(plain, ".")
+	var kept [][2]string
+	for _, t := range kv {
+		if t[0] == "mtype" {
+			continue
+		}
+		if measurement == "" && t[0] == "what" {
+			measurement = t[1]
+			continue
+		}
+		kept = append(kept, t)
+	}
+	if measurement == "" {
+		measurement = "statsd"
+	}
+	// influx prefers the tags sorted by key. the first one of a key wins
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i][0] < kept[j][0] })
+	s := influxMeasurement.Replace(measurement)
+	for i, t := range kept {
+		if i > 0 && t[0] == kept[i-1][0] || t[1] == "" {
+			continue
+		}
+		s += "," + influxKey.Replace(t[0]) + "=" + influxKey.Replace(t[1])
+	}
+	return s
+}
+
+var influxMeasurement = strings.NewReplacer(",", `\,`, " ", `\ `)
+var influxKey = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
@@ -0,0 +1,40 @@
+package out
+
+import (
+	"testing"
+
+	"github.com/raintank/statsdaemon/common"
+)
+
+func TestInfluxLines(t *testing.T) {
+	pct, _ := NewPercentiles("90")
+	ti := NewTimers(*pct)
+	c := NewCounters(true, true)
+	for _, m := range []*common.Metric{
+		{Bucket: "api.latency", Value: 10, Sampling: 1, Tags: []string{"env=prod"}},
+		{Bucket: "api.latency", Value: 20, Sampling: 1, Tags: []string{"env=prod"}},
+		{Bucket: "service=api.what=latency.unit=ms.mtype=gauge", Value: 5, Sampling: 1},
+	} {
+		ti.Add(m)
+	}
+	c.Add(&common.Metric{Bucket: "my requests,total", Value: 20, Sampling: 1, Tags: []string{"host=a b"}})
+	points, _ := ti.Process(nil, 1500000000, 10, Formatter{Prefix_timers: "stats.timers.", Prefix_m20_timers: "timers-2."})
+	points, _ = c.Process(points, 1500000000, 10, Formatter{})
+
+	got := make(map[string]bool)
+	for _, line := range InfluxLines(points) {
+		got[string(line)] = true
+	}
+	for _, exp := range []string{
+		"api.latency,env=prod upper_90=20,mean_90=15,sum_90=30,mean=15,median=15,std=5,sum=30,upper=20,lower=10,count=2,count_ps=0.2 1500000000\n",
+		"latency,service=api,unit=ms upper_90=5,mean_90=5,sum_90=5,mean=5,median=5,std=0,sum=5,upper=5,lower=5,count=1,count_ps=0.1 1500000000\n",
+		`my\ requests\,total,host=a\ b count=20,rate=2 1500000000` + "\n",
+	} {
+		if !got[exp] {
+			t.Fatalf("expected line %q, got %v", exp, got)
+		}
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 lines, got %v", got)
+	}
+}
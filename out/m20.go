@@ -0,0 +1,71 @@
+package out
+
+import (
+	"strings"
+
+	m20 "github.com/metrics20/go-metrics20/carbon20"
+)
+
+// naming helpers for operations not covered by the carbon20 package.
+// they follow the same conventions: legacy metrics get a prefix and suffix,
+// metrics 2.0 get their tags adjusted to reflect the operation.
+
+// CountUnique reflects counting the amount of distinct values seen for a given thing
+func CountUnique(in, p1, p2, p2ne string) (out string) {
+	switch m20.GetVersion(in) {
+	case m20.Legacy:
+		out = p1 + in + ".count"
+	case m20.M20:
+		out = p2 + setTag(in, "mtype=", "mtype=count") + ".stat=count_unique"
+	case m20.M20NoEquals:
+		out = p2ne + setTag(in, "mtype_is_", "mtype_is_count") + ".stat_is_count_unique"
+	}
+	return
+}
+
+// setTag replaces the tag starting with the given prefix, or adds it if not present
+func setTag(in, prefix, tag string) string {
+	parts := strings.Split(in, ".")
+	for i, part := range parts {
+		if strings.HasPrefix(part, prefix) {
+			parts[i] = tag
+			return strings.Join(parts, ".")
+		}
+	}
+	return in + "." + tag
+}
+
+// Bin reflects counting the values that fall into a histogram bin, like "lt_100" or "inf"
+func Bin(in, p1, p2, p2ne, bin string) (out string) {
+	switch m20.GetVersion(in) {
+	case m20.Legacy:
+		out = p1 + in + ".histogram.bin_" + bin
+	case m20.M20:
+		out = p2 + setTag(in, "mtype=", "mtype=count") + ".stat=bin_" + bin
+	case m20.M20NoEquals:
+		out = p2ne + setTag(in, "mtype_is_", "mtype_is_count") + ".stat_is_bin_" + bin
+	}
+	return
+}
+
+// splitNodes splits a bucket into its plain nodes and its metrics 2.0 key/value nodes,
+// i.e. key=value, or key_is_value for metrics 2.0 without equals. legacy buckets only have plain nodes.
+func splitNodes(bucket string) (plain []string, kv [][2]string) {
+	var sep string
+	switch m20.GetVersion(bucket) {
+	case m20.M20:
+		sep = "="
+	case m20.M20NoEquals:
+		sep = "_is_"
+	}
+	for _, node := range strings.Split(bucket, ".") {
+		if sep != "" {
+			if pos := strings.Index(node, sep); pos > 0 {
+				kv = append(kv, [2]string{node[:pos], node[pos+len(sep):]})
+				continue
+			}
+		}
+		plain = append(plain, node)
+	}
+	return plain, kv
+}
@@ -0,0 +1,101 @@
+package out
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OpentsdbDatapoint is a datapoint in the format of OpenTSDB's /api/put endpoint
+type OpentsdbDatapoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// OpentsdbDatapoints converts the points for OpenTSDB. the metrics 2.0 nodes of the name (key=value or key_is_value)
+// and the tags become OpenTSDB tags, the other nodes form the metric. if there are none, the metric is taken
+// from the "what" node. OpenTSDB needs at least one tag, so defaultTags are added to every datapoint,
+// unless the point has a tag with the same key.
+// characters that OpenTSDB doesn't allow are replaced with '_', and NaN and infinite values are skipped.
+func OpentsdbDatapoints(points []Point, defaultTags map[string]string) []OpentsdbDatapoint {
+	dps := make([]OpentsdbDatapoint, 0, len(points))
+	for _, p := range points {
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+		dp := OpentsdbDatapoint{
+			Timestamp: p.Time,
+			Value:     p.Value,
+			Tags:      make(map[string]string),
+		}
+		plain, kv := splitNodes(p.Name)
+		for _, tag := range p.Tags {
+			if pos := strings.IndexByte(tag, '='); pos > 0 {
+				kv = append(kv, [2]string{tag[:pos], tag[pos+1:]})
+			}
+		}
+		dp.Metric = strings.Join(plain, ".")
+		for _, t := range kv {
+			if dp.Metric == "" && t[0] == "what" {
+				dp.Metric = t[1]
+				continue
+			}
+			k, v := opentsdbName(t[0]), opentsdbName(t[1])
+			if _, ok := dp.Tags[k]; !ok && v != "" {
+				dp.Tags[k] = v
+			}
+		}
+		if dp.Metric == "" {
+			dp.Metric = "statsd"
+		}
+		dp.Metric = opentsdbName(dp.Metric)
+		for k, v := range defaultTags {
+			if _, ok := dp.Tags[k]; !ok {
+				dp.Tags[k] = v
+			}
+		}
+		dps = append(dps, dp)
+	}
+	return dps
+}
+
+// WriteOpentsdb renders the datapoints as telnet style put commands, appending to buf
+func WriteOpentsdb(buf []byte, dps []OpentsdbDatapoint) []byte {
+	var keys []string
+	for _, dp := range dps {
+		buf = append(buf, "put "...)
+		buf = append(buf, dp.Metric...)
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, dp.Timestamp, 10)
+		buf = append(buf, ' ')
+		buf = strconv.AppendFloat(buf, dp.Value, 'f', -1, 64)
+		keys = keys[:0]
+		for k := range dp.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf = append(buf, ' ')
+			buf = append(buf, k...)
+			buf = append(buf, '=')
+			buf = append(buf, dp.Tags[k]...)
+		}
+		buf = append(buf, '\n')
+	}
+	return buf
+}
+
+// opentsdbName replaces the characters that OpenTSDB doesn't allow in metrics and tags with '_'.
+// it allows letters, digits, '-', '_', '.' and '/'
+func opentsdbName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '/') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
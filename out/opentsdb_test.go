@@ -0,0 +1,22 @@
+package out
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOpentsdbDatapoints(t *testing.T) {
+	points := []Point{
+		{Name: "stats.timers.api latency.upper_90", Value: 12.5, Time: 1500000000, Tags: []string{"env=prod", "host=a:1"}},
+		{Name: "timers-2NE.service_is_api.unit_is_ms.mtype_is_gauge.stat_is_max_90", Value: 1, Time: 1500000000},
+		{Name: "instance_is_other.what_is_requests", Value: 2, Time: 1500000000},
+		{Name: "stats.nan", Value: math.NaN(), Time: 1500000000},
+	}
+	got := string(WriteOpentsdb(nil, OpentsdbDatapoints(points, map[string]string{"instance": "test"})))
+	exp := "put stats.timers.api_latency.upper_90 1500000000 12.5 env=prod host=a_1 instance=test\n" +
+		"put timers-2NE 1500000000 1 instance=test mtype=gauge service=api stat=max_90 unit=ms\n" +
+		"put requests 1500000000 2 instance=other\n"
+	if got != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, got)
+	}
+}
@@ -8,8 +8,45 @@ import (
 type Output struct {
 	Metrics       chan []*common.Metric
 	MetricAmounts chan []*common.Metric
+	// Clients receives what each client sent. nil means it isn't tracked
+	Clients       chan []ClientAmounts
 	Valid_lines   *topic.Topic
-	Invalid_lines *topic.Topic
+	Invalid_lines *topic.Topic // of InvalidLine
+	// Done is closed to make the listeners stop. nil means they run forever
+	Done <-chan struct{}
+}
+
+// ClientAmounts counts what a client sent. for datagram listeners, a client is a source ip,
+// for stream listeners a connection, where every read counts as a packet.
+type ClientAmounts struct {
+	Source  string
+	Packets uint64
+	Lines   uint64
+	Invalid uint64
+}
+
+// InvalidLine is a line that couldn't be parsed, why, and the client that sent it
+type InvalidLine struct {
+	Source string
+	Reason string
+	Line   []byte
+}
+
+// Stopped returns whether the listeners are asked to stop
+func (o *Output) Stopped() bool {
+	select {
+	case <-o.Done:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReportClients sends the amounts to Clients, if they are tracked
+func (o *Output) ReportClients(amounts []ClientAmounts) {
+	if o.Clients != nil && len(amounts) > 0 {
+		o.Clients <- amounts
+	}
 }
 
 func NullOutput() *Output {
@@ -0,0 +1,73 @@
+package out
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// pickle opcodes, see python's pickletools
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleBinunicode = 'X'
+	pickleBinint     = 'J'
+	pickleLong1      = 0x8a
+	pickleBinfloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleAppends    = 'e'
+	pickleStop       = '.'
+)
+
+// WritePickle renders the points for carbon's pickle protocol, appending to buf.
+// the points are chunked in frames of up to batchSize points, each consisting of a 4 byte big endian
+// length header and a pickled (protocol 2) list of (path, (timestamp, value)) tuples.
+func WritePickle(buf []byte, points []Point, batchSize int) []byte {
+	for len(points) > 0 {
+		n := batchSize
+		if n > len(points) {
+			n = len(points)
+		}
+		start := len(buf)
+		buf = append(buf, 0, 0, 0, 0) // length header, filled in below
+		buf = append(buf, pickleProto, 2, pickleEmptyList, pickleMark)
+		for _, p := range points[:n] {
+			buf = appendPickleString(buf, p.Key())
+			buf = appendPickleInt(buf, p.Time)
+			buf = append(buf, pickleBinfloat)
+			buf = appendUint64(buf, math.Float64bits(p.Value))
+			buf = append(buf, pickleTuple2, pickleTuple2)
+		}
+		buf = append(buf, pickleAppends, pickleStop)
+		binary.BigEndian.PutUint32(buf[start:], uint32(len(buf)-start-4))
+		points = points[n:]
+	}
+	return buf
+}
+
+func appendPickleString(buf []byte, s string) []byte {
+	buf = append(buf, pickleBinunicode)
+	buf = appendUint32LE(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// appendPickleInt uses a 4 byte int if it fits, and a (little endian, two's complement) long otherwise
+func appendPickleInt(buf []byte, i int64) []byte {
+	if i >= math.MinInt32 && i <= math.MaxInt32 {
+		buf = append(buf, pickleBinint)
+		return appendUint32LE(buf, uint32(int32(i)))
+	}
+	buf = append(buf, pickleLong1, 8)
+	for j := uint(0); j < 8; j++ {
+		buf = append(buf, byte(uint64(i)>>(8*j)))
+	}
+	return buf
+}
+
+func appendUint32LE(buf []byte, v uint32) []byte {
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return append(buf, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,106 @@
+package out
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+)
+
+type pickleTuple [2]interface{}
+
+// unpickle decodes the subset of pickle that WritePickle uses
+func unpickle(data []byte) (interface{}, error) {
+	var stack []interface{}
+	var marks []int
+	pop := func() interface{} {
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+	for i := 0; i < len(data); {
+		op := data[i]
+		i++
+		switch op {
+		case pickleProto:
+			i++
+		case pickleEmptyList:
+			stack = append(stack, []interface{}{})
+		case pickleMark:
+			marks = append(marks, len(stack))
+		case pickleBinunicode:
+			n := int(binary.LittleEndian.Uint32(data[i:]))
+			stack = append(stack, string(data[i+4:i+4+n]))
+			i += 4 + n
+		case pickleBinint:
+			stack = append(stack, int64(int32(binary.LittleEndian.Uint32(data[i:]))))
+			i += 4
+		case pickleLong1:
+			n := int(data[i])
+			var v uint64
+			for j := 0; j < n; j++ {
+				v |= uint64(data[i+1+j]) << (8 * uint(j))
+			}
+			stack = append(stack, int64(v))
+			i += 1 + n
+		case pickleBinfloat:
+			stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(data[i:])))
+			i += 8
+		case pickleTuple2:
+			b := pop()
+			a := pop()
+			stack = append(stack, pickleTuple{a, b})
+		case pickleAppends:
+			mark := marks[len(marks)-1]
+			marks = marks[:len(marks)-1]
+			items := stack[mark:]
+			stack = stack[:mark]
+			list := pop().([]interface{})
+			stack = append(stack, append(list, items...))
+		case pickleStop:
+			if i != len(data) || len(stack) != 1 {
+				return nil, fmt.Errorf("trailing data or items after STOP")
+			}
+			return stack[0], nil
+		default:
+			return nil, fmt.Errorf("unexpected opcode %#x at %d", op, i-1)
+		}
+	}
+	return nil, fmt.Errorf("missing STOP")
+}
+
+// decodePickleFrames splits the data in frames, and decodes them
+func decodePickleFrames(t *testing.T, data []byte) [][]interface{} {
+	var frames [][]interface{}
+	for len(data) > 0 {
+		n := int(binary.BigEndian.Uint32(data))
+		v, err := unpickle(data[4 : 4+n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, v.([]interface{}))
+		data = data[4+n:]
+	}
+	return frames
+}
+
+func TestWritePickle(t *testing.T) {
+	points := []Point{
+		{Name: "stats.a", Value: 1.5, Time: 1500000000},
+		{Name: "stats.b", Tags: []string{"env=prod"}, Value: -2, Time: 1500000000},
+		{Name: "stats.c", Value: 3, Time: 5000000000}, // doesn't fit in 4 bytes
+	}
+	frames := decodePickleFrames(t, WritePickle(nil, points, 2))
+	exp := [][]interface{}{
+		{
+			pickleTuple{"stats.a", pickleTuple{int64(1500000000), 1.5}},
+			pickleTuple{"stats.b;env=prod", pickleTuple{int64(1500000000), -2.0}},
+		},
+		{
+			pickleTuple{"stats.c", pickleTuple{int64(5000000000), 3.0}},
+		},
+	}
+	if fmt.Sprint(frames) != fmt.Sprint(exp) {
+		t.Fatalf("expected %v, got %v", exp, frames)
+	}
+}
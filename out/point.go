@@ -0,0 +1,60 @@
+package out
+
+import (
+	"strings"
+
+	m20 "github.com/metrics20/go-metrics20/carbon20"
+)
+
+// Point is a single flushed value, in a form that every backend can work with
+type Point struct {
+	Bucket string   // the bucket the point was computed from, without tags
+	Stat   string   // which statistic of the bucket it is, e.g. "count" or "rate" for counters, "upper_90" for timers
+	Name   string   // as generated by the naming functions, without tags
+	Tags   []string // sorted, in graphite's tag=value format
+	Value  float64
+	Time   int64
+	Mtype  string // metrics 2.0 mtype: count, rate or gauge
+	Unit   string // metrics 2.0 unit, or "unknown"
+}
+
+// NewPoint creates a point. for metrics 2.0 names, the mtype and unit are taken from the name,
+// otherwise the mtype defaults to the given one, and the unit is unknown.
+// tags are shared, not copied.
+func NewPoint(bucket, stat, name string, tags []string, value float64, now int64, mtype string) Point {
+	p := Point{
+		Bucket: bucket,
+		Stat:   stat,
+		Name:   name,
+		Tags:   tags,
+		Value:  value,
+		Time:   now,
+		Mtype:  mtype,
+		Unit:   "unknown",
+	}
+	var sep string
+	switch m20.GetVersion(name) {
+	case m20.M20:
+		sep = "="
+	case m20.M20NoEquals:
+		sep = "_is_"
+	default:
+		return p
+	}
+	for _, node := range strings.Split(name, ".") {
+		if strings.HasPrefix(node, "mtype"+sep) {
+			p.Mtype = node[len("mtype"+sep):]
+		} else if strings.HasPrefix(node, "unit"+sep) {
+			p.Unit = node[len("unit"+sep):]
+		}
+	}
+	return p
+}
+
+// Key returns the name of the point including its tags, in graphite's format
+func (p Point) Key() string {
+	if len(p.Tags) == 0 {
+		return p.Name
+	}
+	return p.Name + ";" + strings.Join(p.Tags, ";")
+}
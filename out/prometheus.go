@@ -0,0 +1,417 @@
+package out
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Prometheus keeps the most recently flushed aggregates, and serves them in the
+// prometheus text exposition format, for setups that scrape rather than push.
+// counters are cumulative across flushes, gauges and sets hold the last flushed value,
+// and timers are summaries with the percentiles of the last interval as quantiles,
+// and a cumulative sum and count, unless they have histogram bins, which makes them histograms.
+// the cumulative series are dropped when they haven't been updated for a while, see Update.
+type Prometheus struct {
+	pctls Percentiles
+
+	sync.Mutex
+	counters   map[string]*promSample    // by aggregation key
+	gauges     map[string]*promSample    // by aggregation key
+	sets       map[string]*promSample    // by aggregation key
+	summaries  map[string]*promSummary   // by aggregation key
+	histograms map[string]*promHistogram // by aggregation key
+}
+
+// promSample is a single series. labels is the rendered list of labels, without braces
+type promSample struct {
+	name   string
+	labels string
+	value  float64
+	idle   int // flushes since the last update, for cumulative series
+}
+
+type promSummary struct {
+	name      string
+	labels    string
+	quantiles []float64 // one per percentile, NaN if the timer had no values in the last interval
+	sum       float64
+	count     float64
+	idle      int // flushes since the last update
+}
+
+// promHistogram is a histogram with the bins of a HistogramSpec as buckets, cumulative across flushes
+type promHistogram struct {
+	name   string
+	labels string
+	bounds []float64
+	counts []float64 // per bin, the last one for the values above all bounds
+	sum    float64
+	idle   int // flushes since the last update
+}
+
+func NewPrometheus(pctls Percentiles) *Prometheus {
+	return &Prometheus{
+		pctls:      pctls,
+		counters:   make(map[string]*promSample),
+		gauges:     make(map[string]*promSample),
+		sets:       make(map[string]*promSample),
+		summaries:  make(map[string]*promSummary),
+		histograms: make(map[string]*promHistogram),
+	}
+}
+
+// SetPercentiles changes the quantiles of the summaries. they are unknown until the next Update
+func (p *Prometheus) SetPercentiles(pctls Percentiles) {
+	p.Lock()
+	defer p.Unlock()
+	p.pctls = pctls
+	for _, s := range p.summaries {
+		s.quantiles = make([]float64, len(pctls))
+		for i := range s.quantiles {
+			s.quantiles[i] = math.NaN()
+		}
+	}
+}
+
+// Update incorporates the data of a flush. it must be called after the timers have been processed.
+// the counters, summaries and histograms that haven't been updated in more than maxIdle flushes are dropped,
+// like carried over gauges. if maxIdle is 0, they are kept indefinitely.
+func (p *Prometheus) Update(c *Counters, g *Gauges, t *Timers, sets *Sets, h *Histograms, maxIdle int) {
+	p.Lock()
+	defer p.Unlock()
+	expired := func(idle *int) bool {
+		*idle++
+		return maxIdle > 0 && *idle > maxIdle
+	}
+	for key, s := range p.counters {
+		if expired(&s.idle) {
+			delete(p.counters, key)
+		}
+	}
+	for key, s := range p.summaries {
+		if expired(&s.idle) {
+			delete(p.summaries, key)
+		}
+	}
+	for key, s := range p.histograms {
+		if expired(&s.idle) {
+			delete(p.histograms, key)
+		}
+	}
+
+	for key, val := range c.Values {
+		s, ok := p.counters[key]
+		if !ok {
+			name, labels := promSeries(key)
+			if !strings.HasSuffix(name, "_total") {
+				name += "_total"
+			}
+			s = &promSample{name: name, labels: labels}
+			p.counters[key] = s
+		}
+		s.value += val
+		s.idle = 0
+	}
+	p.gauges = replaceSamples(p.gauges, g.Values)
+	setCounts := make(map[string]float64, len(sets.Values))
+	for key, s := range sets.Values {
+		setCounts[key] = float64(s.Count())
+	}
+	p.sets = replaceSamples(p.sets, setCounts)
+
+	for _, s := range p.summaries {
+		for i := range s.quantiles {
+			s.quantiles[i] = math.NaN()
+		}
+	}
+	for key, data := range t.Values {
+		if _, ok := h.Values[key]; ok {
+			// exposed as histogram
+			continue
+		}
+		s, ok := p.summaries[key]
+		if !ok {
+			name, labels := promSeries(key)
+			s = &promSummary{name: name, labels: labels, quantiles: make([]float64, len(p.pctls))}
+			p.summaries[key] = s
+		}
+		s.idle = 0
+		var seen, sum float64
+		if data.digest != nil {
+			seen, sum = float64(data.digest.count), data.digest.sum
+			for i, pct := range p.pctls {
+				s.quantiles[i] = digestPercentile(data.digest, pct)
+			}
+		} else {
+			if len(data.Points) == 0 {
+				continue
+			}
+			seen = float64(len(data.Points))
+			for _, v := range data.Points {
+				sum += v
+			}
+			if !sort.IsSorted(data.Points) {
+				sort.Sort(data.Points)
+			}
+			for i, pct := range p.pctls {
+				s.quantiles[i] = exactPercentile(data.Points, pct)
+			}
+		}
+		// like the count, the sum is an estimate based on the sample rate
+		s.count += float64(data.Amount_submitted)
+		s.sum += sum * float64(data.Amount_submitted) / seen
+	}
+
+	for key, data := range h.Values {
+		s, ok := p.histograms[key]
+		if !ok {
+			name, labels := promSeries(key)
+			s = &promHistogram{name: name, labels: labels, bounds: data.spec.bounds, counts: make([]float64, len(data.Counts))}
+			p.histograms[key] = s
+		}
+		for i, n := range data.Counts {
+			s.counts[i] += n
+		}
+		s.sum += data.Sum
+		s.idle = 0
+	}
+}
+
+// replaceSamples returns the samples for the given values, reusing the names and labels of prev
+func replaceSamples(prev map[string]*promSample, values map[string]float64) map[string]*promSample {
+	next := make(map[string]*promSample, len(values))
+	for key, val := range values {
+		s, ok := prev[key]
+		if !ok {
+			name, labels := promSeries(key)
+			s = &promSample{name: name, labels: labels}
+		}
+		s.value = val
+		next[key] = s
+	}
+	return next
+}
+
+// exactPercentile returns the value at the percentile of the sorted points, the same way as the upper_<pct>
+// and lower_<pct> metrics are computed
+func exactPercentile(points Float64Slice, pct *Percentile) float64 {
+	seen := len(points)
+	if seen == 1 {
+		return points[0]
+	}
+	abs := pct.float
+	if abs < 0 {
+		abs = 100 + abs
+	}
+	i := int(math.Floor(abs/100*float64(seen) + 0.5))
+	if pct.float >= 0 {
+		i--
+	}
+	if i < 0 {
+		i = 0
+	} else if i >= seen {
+		i = seen - 1
+	}
+	return points[i]
+}
+
+func digestPercentile(d *tDigest, pct *Percentile) float64 {
+	if d.count <= 1 {
+		return d.max
+	}
+	abs := pct.float
+	if abs < 0 {
+		abs = 100 + abs
+	}
+	return d.Quantile(abs / 100)
+}
+
+// promSeries derives the metric name and labels from an aggregation key.
+// the key=value (metrics 2.0) or key_is_value (metrics 2.0 without equals) nodes of the bucket
+// become labels, the other nodes form the name, and the tags are added as labels too.
+// if there are no other nodes, the name is taken from the "what" node.
+// the mtype is left out, as it is implied by the metric type.
+func promSeries(key string) (string, string) {
+	bucket, tags := splitKey(key)
+	nameParts, labels := splitNodes(bucket)
+	for _, tag := range tags {
+		if pos := strings.IndexByte(tag, '='); pos > 0 {
+			labels = append(labels, [2]string{tag[:pos], tag[pos+1:]})
+		}
+	}
+
+	name := strings.Join(nameParts, "_")
+	var kept [][2]string
+	for _, l := range labels {
+		if l[0] == "mtype" {
+			continue
+		}
+		if name == "" && l[0] == "what" {
+			name = l[1]
+			continue
+		}
+		l[0] = promLabelName(l[0])
+		kept = append(kept, l)
+	}
+	if name == "" {
+		name = "statsd"
+	}
+	// labels must be unique. the first one wins
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i][0] < kept[j][0] })
+	var buf bytes.Buffer
+	for i, l := range kept {
+		if i > 0 && l[0] == kept[i-1][0] {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(l[0])
+		buf.WriteString(`="`)
+		buf.WriteString(promLabelValue.Replace(l[1]))
+		buf.WriteByte('"')
+	}
+	return promName(name), buf.String()
+}
+
+// promName replaces the characters that are not allowed in a metric name with '_'
+func promName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' || c >= '0' && c <= '9' && i > 0) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// promLabelName replaces the characters that are not allowed in a label name with '_'
+func promLabelName(s string) string {
+	return strings.Replace(promName(s), ":", "_", -1)
+}
+
+var promLabelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promFamily is the data for one "# TYPE" section
+type promFamily struct {
+	typ   string
+	lines []string
+}
+
+// ServeHTTP renders the data of the last flush in the prometheus text format
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	families := make(map[string]*promFamily)
+	add := func(name, typ string, lines ...string) {
+		f, ok := families[name]
+		if !ok {
+			f = &promFamily{typ: typ}
+			families[name] = f
+		} else if f.typ != typ {
+			log.Debugf("prometheus: skipping %s %s, which is already used for a %s", typ, name, f.typ)
+			return
+		}
+		f.lines = append(f.lines, lines...)
+	}
+	p.Lock()
+	for _, s := range p.counters {
+		add(s.name, "counter", promLine(s.name, s.labels, "", s.value))
+	}
+	for _, s := range p.gauges {
+		add(s.name, "gauge", promLine(s.name, s.labels, "", s.value))
+	}
+	for _, s := range p.sets {
+		add(s.name, "gauge", promLine(s.name, s.labels, "", s.value))
+	}
+	// all lines of a summary go together, so rather than sorting the lines, sort the summaries
+	keys := make([]string, 0, len(p.summaries))
+	for key := range p.summaries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := p.summaries[key]
+		var lines []string
+		seen := make(map[string]bool)
+		for i, pct := range p.pctls {
+			abs := pct.float
+			if abs < 0 {
+				abs = 100 + abs
+			}
+			q := strconv.FormatFloat(abs/100, 'g', -1, 64)
+			if seen[q] {
+				continue
+			}
+			seen[q] = true
+			lines = append(lines, promLine(s.name, s.labels, `quantile="`+q+`"`, s.quantiles[i]))
+		}
+		lines = append(lines,
+			promLine(s.name+"_sum", s.labels, "", s.sum),
+			promLine(s.name+"_count", s.labels, "", s.count),
+		)
+		add(s.name, "summary", lines...)
+	}
+	keys = keys[:0]
+	for key := range p.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := p.histograms[key]
+		var lines []string
+		cumulative := float64(0)
+		for i, n := range s.counts {
+			cumulative += n
+			le := "+Inf"
+			if i < len(s.bounds) {
+				le = strconv.FormatFloat(s.bounds[i], 'g', -1, 64)
+			}
+			lines = append(lines, promLine(s.name+"_bucket", s.labels, `le="`+le+`"`, cumulative))
+		}
+		lines = append(lines,
+			promLine(s.name+"_sum", s.labels, "", s.sum),
+			promLine(s.name+"_count", s.labels, "", cumulative),
+		)
+		add(s.name, "histogram", lines...)
+	}
+	p.Unlock()
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := families[name]
+		buf.WriteString("# TYPE " + name + " " + f.typ + "\n")
+		if f.typ != "summary" && f.typ != "histogram" {
+			sort.Strings(f.lines)
+		}
+		for _, line := range f.lines {
+			buf.WriteString(line)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// promLine renders a sample. extra is an additional label, like the quantile of a summary
+func promLine(name, labels, extra string, value float64) string {
+	if extra != "" {
+		if labels != "" {
+			labels += ","
+		}
+		labels += extra
+	}
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	return name + " " + strconv.FormatFloat(value, 'g', -1, 64) + "\n"
+}
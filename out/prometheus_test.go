@@ -0,0 +1,230 @@
+package out
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/raintank/statsdaemon/common"
+)
+
+func scrape(t *testing.T, p *Prometheus) string {
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	body, _ := ioutil.ReadAll(w.Body)
+	return string(body)
+}
+
+func TestPrometheus(t *testing.T) {
+	pct, _ := NewPercentiles("50,-10")
+	p := NewPrometheus(*pct)
+	flush := func(metrics ...*common.Metric) {
+		c := NewCounters(true, false)
+		g := NewGauges()
+		ti := NewTimers(*pct)
+		sets := NewSets(10)
+		for _, m := range metrics {
+			switch m.Modifier {
+			case "c":
+				c.Add(m)
+			case "g":
+				g.Add(m)
+			case "ms":
+				ti.Add(m)
+			case "s":
+				sets.Add(m)
+			}
+		}
+		p.Update(c, g, ti, sets, NewHistograms(nil), 0)
+	}
+	flush(
+		&common.Metric{Bucket: "api.requests", Value: 3, Modifier: "c", Sampling: 1, Tags: []string{"env=prod"}},
+		&common.Metric{Bucket: "service=api.what=requests.unit=Req.mtype=count", Value: 2, Modifier: "c", Sampling: 1},
+		&common.Metric{Bucket: "temperature", Value: 21.5, Modifier: "g", Sampling: 1},
+		&common.Metric{Bucket: "users", SetValue: "a", Modifier: "s", Sampling: 1},
+		&common.Metric{Bucket: "users", SetValue: "b", Modifier: "s", Sampling: 1},
+		&common.Metric{Bucket: "latency", Value: 1, Modifier: "ms", Sampling: 1},
+		&common.Metric{Bucket: "latency", Value: 2, Modifier: "ms", Sampling: 1},
+		&common.Metric{Bucket: "latency", Value: 3, Modifier: "ms", Sampling: 0.5},
+	)
+	exp := `# TYPE api_requests_total counter
+api_requests_total{env="prod"} 3
+# TYPE latency summary
+latency{quantile="0.5"} 2
+latency{quantile="0.9"} 3
+latency_sum 8
+latency_count 4
+# TYPE requests_total counter
+requests_total{service="api",unit="Req"} 2
+# TYPE temperature gauge
+temperature 21.5
+# TYPE users gauge
+users 2
+`
+	got := scrape(t, p)
+	if got != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, got)
+	}
+
+	// counters accumulate, timers without values have no quantiles,
+	// and gauges and sets only contain what was flushed
+	flush(
+		&common.Metric{Bucket: "api.requests", Value: 4, Modifier: "c", Sampling: 1, Tags: []string{"env=prod"}},
+	)
+	exp = `# TYPE api_requests_total counter
+api_requests_total{env="prod"} 7
+# TYPE latency summary
+latency{quantile="0.5"} NaN
+latency{quantile="0.9"} NaN
+latency_sum 8
+latency_count 4
+# TYPE requests_total counter
+requests_total{service="api",unit="Req"} 2
+`
+	got = scrape(t, p)
+	if got != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, got)
+	}
+}
+
+func TestPrometheusSummary(t *testing.T) {
+	pct, _ := NewPercentiles("50,90")
+	cases := []struct {
+		timers *Timers
+		lines  []string
+	}{
+		{NewTimers(*pct), []string{`latency{quantile="0.5"} 5`, `latency{quantile="0.9"} 9`, `latency_sum 55`, `latency_count 10`}},
+		// the digest interpolates between the values
+		{NewTDigestTimers(*pct, 100), []string{`latency{quantile="0.5"} 5.5`, `latency{quantile="0.9"} 9.5`, `latency_sum 55`, `latency_count 10`}},
+	}
+	for _, c := range cases {
+		p := NewPrometheus(*pct)
+		for i := 1; i <= 10; i++ {
+			c.timers.Add(&common.Metric{Bucket: "latency", Value: float64(i), Modifier: "ms", Sampling: 1})
+		}
+		p.Update(NewCounters(true, false), NewGauges(), c.timers, NewSets(10), NewHistograms(nil), 0)
+		got := scrape(t, p)
+		for _, line := range c.lines {
+			if !strings.Contains(got, line+"\n") {
+				t.Fatalf("%s: output %q does not contain %q", c.timers, got, line)
+			}
+		}
+	}
+}
+
+func TestPrometheusHistogram(t *testing.T) {
+	pct, _ := NewPercentiles("50")
+	specs, err := NewHistogramSpecs("latency:10,100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPrometheus(*pct)
+	flush := func(values ...float64) {
+		ti := NewTimers(*pct)
+		h := NewHistograms(*specs)
+		for _, v := range values {
+			m := &common.Metric{Bucket: "api.latency", Value: v, Modifier: "ms", Sampling: 1, Tags: []string{"env=prod"}}
+			ti.Add(m)
+			h.Add(m)
+		}
+		p.Update(NewCounters(true, false), NewGauges(), ti, NewSets(10), h, 0)
+	}
+	flush(5, 50, 500)
+	flush(7, 1000)
+	// the timer is a histogram rather than a summary, and the buckets are cumulative across flushes
+	exp := `# TYPE api_latency histogram
+api_latency_bucket{env="prod",le="10"} 2
+api_latency_bucket{env="prod",le="100"} 3
+api_latency_bucket{env="prod",le="+Inf"} 5
+api_latency_sum{env="prod"} 1562
+api_latency_count{env="prod"} 5
+`
+	got := scrape(t, p)
+	if got != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, got)
+	}
+}
+
+func TestPrometheusExpiry(t *testing.T) {
+	pct, _ := NewPercentiles("50")
+	specs, _ := NewHistogramSpecs("size:10")
+	p := NewPrometheus(*pct)
+	flush := func(metrics ...*common.Metric) {
+		c := NewCounters(true, false)
+		ti := NewTimers(*pct)
+		h := NewHistograms(*specs)
+		for _, m := range metrics {
+			if m.Modifier == "c" {
+				c.Add(m)
+			} else {
+				ti.Add(m)
+				h.Add(m)
+			}
+		}
+		p.Update(c, NewGauges(), ti, NewSets(10), h, 2)
+	}
+	flush(
+		&common.Metric{Bucket: "requests", Value: 1, Modifier: "c", Sampling: 1},
+		&common.Metric{Bucket: "errors", Value: 1, Modifier: "c", Sampling: 1},
+		&common.Metric{Bucket: "latency", Value: 1, Modifier: "ms", Sampling: 1},
+		&common.Metric{Bucket: "size", Value: 1, Modifier: "h", Sampling: 1},
+	)
+	// only requests keeps being updated. the others are kept for 2 more flushes
+	for i := 0; i < 2; i++ {
+		flush(&common.Metric{Bucket: "requests", Value: 1, Modifier: "c", Sampling: 1})
+	}
+	got := scrape(t, p)
+	for _, line := range []string{"requests_total 3", "errors_total 1", "latency_count 1", "size_count 1"} {
+		if !strings.Contains(got, line+"\n") {
+			t.Fatalf("output %q does not contain %q", got, line)
+		}
+	}
+	flush(&common.Metric{Bucket: "requests", Value: 1, Modifier: "c", Sampling: 1})
+	exp := `# TYPE requests_total counter
+requests_total 4
+`
+	got = scrape(t, p)
+	if got != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, got)
+	}
+}
+
+func TestPrometheusSetPercentiles(t *testing.T) {
+	pct, _ := NewPercentiles("50")
+	p := NewPrometheus(*pct)
+	ti := NewTimers(*pct)
+	ti.Add(&common.Metric{Bucket: "latency", Value: 1, Modifier: "ms", Sampling: 1})
+	p.Update(NewCounters(true, false), NewGauges(), ti, NewSets(10), NewHistograms(nil), 0)
+
+	pct, _ = NewPercentiles("50,99")
+	p.SetPercentiles(*pct)
+	got := scrape(t, p)
+	for _, line := range []string{`latency{quantile="0.5"} NaN`, `latency{quantile="0.99"} NaN`, `latency_count 1`} {
+		if !strings.Contains(got, line+"\n") {
+			t.Fatalf("output %q does not contain %q", got, line)
+		}
+	}
+}
+
+func TestPromSeries(t *testing.T) {
+	cases := []struct {
+		key, name, labels string
+	}{
+		{"foo.bar-baz", "foo_bar_baz", ""},
+		{"1st.thing;b=2;a=1", "_st_thing", `a="1",b="2"`},
+		{"service_is_api.unit_is_ms.mtype_is_gauge.latency", "latency", `service="api",unit="ms"`},
+		{"what=x.unit=B;what=y", "x", `unit="B",what="y"`},
+		{"unit=B", "statsd", `unit="B"`},
+		{`foo;q=a"b`, "foo", `q="a\"b"`},
+	}
+	for _, c := range cases {
+		name, labels := promSeries(c.key)
+		if name != c.name || labels != c.labels {
+			t.Fatalf("%q: expected %q %q, got %q %q", c.key, c.name, c.labels, name, labels)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package out
+
+import (
+	"github.com/raintank/statsdaemon/common"
+)
+
+type Sets struct {
+	hllThreshold int
+	Values       map[string]*Set
+}
+
+// NewSets creates a Sets that tracks values exactly until a set has hllThreshold
+// distinct values, at which point it switches to a HyperLogLog sketch.
+// a threshold of 0 means always use the sketch.
+func NewSets(hllThreshold int) *Sets {
+	return &Sets{
+		hllThreshold,
+		make(map[string]*Set),
+	}
+}
+
+// Set tracks the distinct values seen for one bucket.
+// only one of exact and hll is in use at any time.
+type Set struct {
+	exact map[string]struct{}
+	hll   *hyperLogLog
+}
+
+// Count returns the (possibly estimated) amount of distinct values in the set
+func (s *Set) Count() int64 {
+	if s.hll != nil {
+		return s.hll.Count()
+	}
+	return int64(len(s.exact))
+}
+
+// Add updates the sets map, adding the metric key if needed
+func (sets *Sets) Add(metric *common.Metric) {
+	key := metric.Key()
+	s, ok := sets.Values[key]
+	if !ok {
+		s = &Set{}
+		if sets.hllThreshold > 0 {
+			s.exact = make(map[string]struct{})
+		} else {
+			s.hll = newHyperLogLog()
+		}
+		sets.Values[key] = s
+	}
+	if s.hll != nil {
+		s.hll.Add(metric.SetValue)
+		return
+	}
+	s.exact[metric.SetValue] = struct{}{}
+	if len(s.exact) >= sets.hllThreshold {
+		s.hll = newHyperLogLog()
+		for val := range s.exact {
+			s.hll.Add(val)
+		}
+		s.exact = nil
+	}
+}
+
+// Merge adds the sets of other, which must not share keys with sets
+func (sets *Sets) Merge(other *Sets) {
+	for key, s := range other.Values {
+		sets.Values[key] = s
+	}
+}
+
+// Process computes an outbound point with the amount of distinct values of each set
+func (sets *Sets) Process(points []Point, now int64, interval int, f Formatter) ([]Point, int64) {
+	for key, s := range sets.Values {
+		bucket, tags := splitKey(key)
+		name := CountUnique(bucket, f.Prefix_sets, f.Prefix_m20_sets, f.Prefix_m20ne_sets)
+		points = append(points, NewPoint(bucket, "count_unique", name, tags, float64(s.Count()), now, "count"))
+	}
+	return points, int64(len(sets.Values))
+}
@@ -0,0 +1,147 @@
+package out
+
+import (
+	"math"
+	"sort"
+)
+
+// tDigest is a merging t-digest (Dunning & Ertl): it summarizes a stream of values
+// into a bounded amount of centroids, with more resolution near the tails.
+// it also tracks the exact count, min, max, sum and sum of squares.
+type tDigest struct {
+	compression float64
+	centroids   []centroid // merged, sorted by mean
+	buf         []centroid // not merged yet
+	weight      float64    // total weight of centroids, excluding buf
+
+	count      int64
+	min, max   float64
+	sum, sumSq float64
+}
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+func newTDigest(compression float64) *tDigest {
+	return &tDigest{
+		compression: compression,
+		buf:         make([]centroid, 0, tDigestBufSize(compression)),
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+func tDigestBufSize(compression float64) int {
+	return int(5 * compression)
+}
+
+func (d *tDigest) Add(val float64) {
+	d.count++
+	d.sum += val
+	d.sumSq += val * val
+	if val < d.min {
+		d.min = val
+	}
+	if val > d.max {
+		d.max = val
+	}
+	d.buf = append(d.buf, centroid{val, 1})
+	if len(d.buf) == cap(d.buf) {
+		d.merge()
+	}
+}
+
+// k is the k1 scale function, which maps a quantile to a centroid index
+func (d *tDigest) k(q float64) float64 {
+	return d.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// kInv is the inverse of k
+func (d *tDigest) kInv(k float64) float64 {
+	x := k * 2 * math.Pi / d.compression
+	if x >= math.Pi/2 {
+		return 1
+	}
+	return (math.Sin(x) + 1) / 2
+}
+
+// merge folds the buffered values into the centroids, such that no centroid
+// spans more than one unit of the scale function
+func (d *tDigest) merge() {
+	if len(d.buf) == 0 {
+		return
+	}
+	total := d.weight
+	for _, c := range d.buf {
+		total += c.weight
+	}
+	all := append(d.buf, d.centroids...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := make([]centroid, 0, len(d.centroids)+1)
+	cur := all[0]
+	var before float64 // weight of the centroids before cur
+	limit := d.kInv(d.k(0) + 1)
+	for _, c := range all[1:] {
+		if (before+cur.weight+c.weight)/total <= limit {
+			cur.weight += c.weight
+			cur.mean += (c.mean - cur.mean) * c.weight / cur.weight
+			continue
+		}
+		merged = append(merged, cur)
+		before += cur.weight
+		limit = d.kInv(d.k(before/total) + 1)
+		cur = c
+	}
+	merged = append(merged, cur)
+
+	d.centroids = merged
+	d.weight = total
+	d.buf = d.buf[:0]
+}
+
+// Quantile returns the estimated value at quantile q (0 <= q <= 1)
+func (d *tDigest) Quantile(q float64) float64 {
+	d.merge()
+	cs := d.centroids
+	if len(cs) == 0 {
+		return math.NaN()
+	}
+	if len(cs) == 1 {
+		return cs[0].mean
+	}
+	target := q * d.weight
+	first, last := cs[0], cs[len(cs)-1]
+	if target < first.weight/2 {
+		return d.min + (first.mean-d.min)*target/(first.weight/2)
+	}
+	if target > d.weight-last.weight/2 {
+		return last.mean + (d.max-last.mean)*(target-(d.weight-last.weight/2))/(last.weight/2)
+	}
+	// interpolate between the centers of the two surrounding centroids
+	center := first.weight / 2
+	for i := 1; i < len(cs); i++ {
+		next := center + (cs[i-1].weight+cs[i].weight)/2
+		if target <= next {
+			return cs[i-1].mean + (cs[i].mean-cs[i-1].mean)*(target-center)/(next-center)
+		}
+		center = next
+	}
+	return d.max
+}
+
+// SumBelow returns the estimated sum of the lowest n values
+func (d *tDigest) SumBelow(n float64) float64 {
+	d.merge()
+	var sum, seen float64
+	for _, c := range d.centroids {
+		if seen+c.weight >= n {
+			return sum + c.mean*(n-seen)
+		}
+		sum += c.mean * c.weight
+		seen += c.weight
+	}
+	return sum
+}
@@ -12,20 +12,36 @@ import (
 type Float64Slice []float64
 
 type Timers struct {
-	pctls  Percentiles
-	Values map[string]Data
+	pctls       Percentiles
+	compression float64 // 0 means exact mode
+	Values      map[string]Data
 }
 
+// NewTimers creates a Timers that keeps every point, to compute exact statistics
 func NewTimers(pctls Percentiles) *Timers {
 	return &Timers{
 		pctls,
+		0,
 		make(map[string]Data),
 	}
 }
 
+// NewTDigestTimers creates a Timers that summarizes the points of each timer in a t-digest,
+// which bounds memory usage, at the expense of estimated percentiles and medians.
+// higher compression means more accuracy but more memory use.
+func NewTDigestTimers(pctls Percentiles, compression float64) *Timers {
+	return &Timers{
+		pctls,
+		compression,
+		make(map[string]Data),
+	}
+}
+
+// Data holds the state for one timer: either the points (exact mode) or the digest
 type Data struct {
 	Points           Float64Slice
 	Amount_submitted int64
+	digest           *tDigest
 }
 
 func (s Float64Slice) Len() int           { return len(s) }
@@ -33,23 +49,39 @@ func (s Float64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s Float64Slice) Less(i, j int) bool { return s[i] < s[j] }
 
 func (t *Timers) String() string {
+	if t.compression > 0 {
+		return fmt.Sprintf("<*Timers %p, percentiles '%s', tdigest compression %g, %d values>", t, t.pctls, t.compression, len(t.Values))
+	}
 	return fmt.Sprintf("<*Timers %p, percentiles '%s', %d values>", t, t.pctls, len(t.Values))
 }
 
 // Add updates the timers map, adding the metric key if needed
 func (timers *Timers) Add(metric *common.Metric) {
-	t, ok := timers.Values[metric.Bucket]
+	key := metric.Key()
+	t, ok := timers.Values[key]
 	if !ok {
-		var p Float64Slice
-		t = Data{p, 0}
+		if timers.compression > 0 {
+			t.digest = newTDigest(timers.compression)
+		}
+	}
+	if t.digest != nil {
+		t.digest.Add(metric.Value)
+	} else {
+		t.Points = append(t.Points, metric.Value)
 	}
-	t.Points = append(t.Points, metric.Value)
 	t.Amount_submitted += int64(1 / metric.Sampling)
-	timers.Values[metric.Bucket] = t
+	timers.Values[key] = t
+}
+
+// Merge adds the timers of other, which must not share keys with timers
+func (timers *Timers) Merge(other *Timers) {
+	for key, t := range other.Values {
+		timers.Values[key] = t
+	}
 }
 
-// Process computes the outbound metrics for timers and puts them in the buffer
-func (timers *Timers) Process(buf []byte, now int64, interval int, f Formatter) ([]byte, int64) {
+// Process computes the outbound points for timers
+func (timers *Timers) Process(points []Point, now int64, interval int, f Formatter) ([]Point, int64) {
 	// these are the metrics that get exposed:
 	// count estimate of original amount of metrics sent, by dividing received by samplerate
 	// count_ps  same but per second
@@ -64,7 +96,13 @@ func (timers *Timers) Process(buf []byte, now int64, interval int, f Formatter)
 	// upper_90 / lower_90
 
 	var num int64
-	for u, t := range timers.Values {
+	for key, t := range timers.Values {
+		u, tags := splitKey(key)
+		if t.digest != nil {
+			points = timers.processDigest(points, u, tags, t, now, interval, f)
+			num++
+			continue
+		}
 		if len(t.Points) > 0 {
 			seen := len(t.Points)
 			count := t.Amount_submitted
@@ -125,29 +163,82 @@ func (timers *Timers) Process(buf []byte, now int64, interval int, f Formatter)
 					mean_pct = float64(sum_pct) / float64(indexOfPerc)
 				}
 
-				var pctstr string
-				var fn func(metric_in, p1, p2, p2ne, percentile, timespec string) string
+				points = appendPercentile(points, u, tags, pct, maxAtThreshold, mean_pct, sum_pct, now, f)
+			}
+			points = appendTimerStats(points, u, tags, mean, median, stddev, sum, max, min, count, count_ps, now, f)
+		}
+	}
+	return points, num
+}
+
+// processDigest computes the outbound points for a timer in t-digest mode.
+// the percentile based metrics and the median are estimates, the others are exact.
+func (timers *Timers) processDigest(points []Point, u string, tags []string, t Data, now int64, interval int, f Formatter) []Point {
+	d := t.digest
+	seen := float64(d.count)
+	count := t.Amount_submitted
+	count_ps := float64(count) / float64(interval)
+
+	mean := d.sum / seen
+	stddev := math.Sqrt(math.Max(d.sumSq/seen-mean*mean, 0))
+	median := d.Quantile(0.5)
+
+	for _, pct := range timers.pctls {
+		maxAtThreshold := d.max
+		sum_pct := d.sum
+		mean_pct := mean
+		if d.count > 1 {
+			abs := pct.float
+			if abs < 0 {
+				abs = 100 + abs
+			}
+			// like exact mode, the amount of points within the percentile is rounded
+			n := math.Floor(abs/100*seen + 0.5)
+			maxAtThreshold = d.Quantile(abs / 100)
+			if n > 0 {
 				if pct.float >= 0 {
-					pctstr = pct.str
-					fn = m20.Max
+					sum_pct = d.SumBelow(n)
 				} else {
-					pctstr = pct.str[1:]
-					fn = m20.Min
+					sum_pct = d.sum - d.SumBelow(seen-n)
 				}
-				buf = WriteFloat64(buf, []byte(fn(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, "")), maxAtThreshold, now)
-				buf = WriteFloat64(buf, []byte(m20.Mean(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, "")), mean_pct, now)
-				buf = WriteFloat64(buf, []byte(m20.Sum(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, "")), sum_pct, now)
+				mean_pct = sum_pct / n
 			}
-
-			buf = WriteFloat64(buf, []byte(m20.Mean(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", "")), mean, now)
-			buf = WriteFloat64(buf, []byte(m20.Median(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", "")), median, now)
-			buf = WriteFloat64(buf, []byte(m20.Std(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", "")), stddev, now)
-			buf = WriteFloat64(buf, []byte(m20.Sum(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", "")), sum, now)
-			buf = WriteFloat64(buf, []byte(m20.Max(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", "")), max, now)
-			buf = WriteFloat64(buf, []byte(m20.Min(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", "")), min, now)
-			buf = WriteInt64(buf, []byte(m20.CountPckt(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers)), count, now)
-			buf = WriteFloat64(buf, []byte(m20.RatePckt(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers)), count_ps, now)
 		}
+		points = appendPercentile(points, u, tags, pct, maxAtThreshold, mean_pct, sum_pct, now, f)
+	}
+	return appendTimerStats(points, u, tags, mean, median, stddev, d.sum, d.max, d.min, count, count_ps, now, f)
+}
+
+// appendPercentile adds the points for one percentile, i.e. upper_<pct> or lower_<pct>, mean_<pct> and sum_<pct>
+func appendPercentile(points []Point, u string, tags []string, pct *Percentile, maxAtThreshold, mean_pct, sum_pct float64, now int64, f Formatter) []Point {
+	var pctstr, stat string
+	var fn func(metric_in, p1, p2, p2ne, percentile, timespec string) string
+	if pct.float >= 0 {
+		pctstr = pct.str
+		stat = "upper_"
+		fn = m20.Max
+	} else {
+		pctstr = pct.str[1:]
+		stat = "lower_"
+		fn = m20.Min
 	}
-	return buf, num
+	return append(points,
+		NewPoint(u, stat+pctstr, fn(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, ""), tags, maxAtThreshold, now, "gauge"),
+		NewPoint(u, "mean_"+pctstr, m20.Mean(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, ""), tags, mean_pct, now, "gauge"),
+		NewPoint(u, "sum_"+pctstr, m20.Sum(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, pctstr, ""), tags, sum_pct, now, "gauge"),
+	)
+}
+
+// appendTimerStats adds the points that don't depend on the percentiles
+func appendTimerStats(points []Point, u string, tags []string, mean, median, stddev, sum, max, min float64, count int64, count_ps float64, now int64, f Formatter) []Point {
+	return append(points,
+		NewPoint(u, "mean", m20.Mean(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", ""), tags, mean, now, "gauge"),
+		NewPoint(u, "median", m20.Median(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", ""), tags, median, now, "gauge"),
+		NewPoint(u, "std", m20.Std(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", ""), tags, stddev, now, "gauge"),
+		NewPoint(u, "sum", m20.Sum(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", ""), tags, sum, now, "gauge"),
+		NewPoint(u, "upper", m20.Max(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", ""), tags, max, now, "gauge"),
+		NewPoint(u, "lower", m20.Min(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers, "", ""), tags, min, now, "gauge"),
+		NewPoint(u, "count", m20.CountPckt(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers), tags, float64(count), now, "count"),
+		NewPoint(u, "count_ps", m20.RatePckt(u, f.Prefix_timers, f.Prefix_m20_timers, f.Prefix_m20ne_timers), tags, count_ps, now, "rate"),
+	)
 }
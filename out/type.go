@@ -6,5 +6,5 @@ import (
 
 type Type interface {
 	Add(metric *common.Metric)
-	Process(buf []byte, now int64, interval int, f Formatter) ([]byte, int64)
+	Process(points []Point, now int64, interval int, f Formatter) ([]Point, int64)
 }
@@ -1,21 +1,32 @@
 package out
 
-import "strconv"
+import (
+	"strconv"
+	"strings"
+)
 
-func WriteFloat64(buf []byte, key []byte, val float64, now int64) []byte {
-	buf = append(buf, key...)
-	buf = append(buf, ' ')
-	buf = strconv.AppendFloat(buf, val, 'f', -1, 64)
-	buf = append(buf, ' ')
-	buf = strconv.AppendInt(buf, now, 10)
-	return append(buf, '\n')
+// splitKey splits an aggregation key into the bucket and its graphite tags, if any.
+// the naming functions only operate on the bucket, the tags should be attached to the resulting point.
+func splitKey(key string) (string, []string) {
+	if pos := strings.IndexByte(key, ';'); pos != -1 {
+		return key[:pos], strings.Split(key[pos+1:], ";")
+	}
+	return key, nil
 }
 
-func WriteInt64(buf []byte, key []byte, val, now int64) []byte {
-	buf = append(buf, key...)
-	buf = append(buf, ' ')
-	buf = strconv.AppendInt(buf, val, 10)
-	buf = append(buf, ' ')
-	buf = strconv.AppendInt(buf, now, 10)
-	return append(buf, '\n')
+// WriteGraphite renders the points in graphite's plaintext format, appending to buf
+func WriteGraphite(buf []byte, points []Point) []byte {
+	for _, p := range points {
+		buf = append(buf, p.Name...)
+		for _, tag := range p.Tags {
+			buf = append(buf, ';')
+			buf = append(buf, tag...)
+		}
+		buf = append(buf, ' ')
+		buf = strconv.AppendFloat(buf, p.Value, 'f', -1, 64)
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, p.Time, 10)
+		buf = append(buf, '\n')
+	}
+	return buf
 }
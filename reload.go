@@ -0,0 +1,134 @@
+package statsdaemon
+
+import (
+	"reflect"
+
+	"github.com/raintank/statsdaemon/out"
+	"github.com/raintank/statsdaemon/rules"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config holds the settings that can be changed while running, see ReloadFunc
+type Config struct {
+	Formatter   out.Formatter // the PrefixInternal can't be changed
+	FlushRates  bool
+	FlushCounts bool
+	Pct         out.Percentiles
+	LogLevel    log.Level
+	Backends    BackendConfig
+	Rules       rules.Rules
+}
+
+// BackendConfig holds the output destinations. when any of it changes, all backends are recreated.
+type BackendConfig struct {
+	Names []string
+
+	GraphiteAddr            string
+	GraphiteProtocol        string
+	GraphitePickleBatchSize int
+	GraphiteRouting         string
+
+	TsdbgwAddr   string
+	TsdbgwApiKey string
+
+	InfluxdbAddr      string
+	InfluxdbBatchSize int
+	InfluxdbGzip      bool
+
+	OpentsdbAddr      string
+	OpentsdbBatchSize int
+}
+
+// backendConfig returns the current output destinations
+func (s *StatsDaemon) backendConfig() BackendConfig {
+	return BackendConfig{
+		Names:                   s.backendNames,
+		GraphiteAddr:            s.graphite_addr,
+		GraphiteProtocol:        s.graphite_protocol,
+		GraphitePickleBatchSize: s.graphite_pickle_batch_size,
+		GraphiteRouting:         s.graphite_routing,
+		TsdbgwAddr:              s.tsdbgw_addr,
+		TsdbgwApiKey:            s.tsdbgw_api_key,
+		InfluxdbAddr:            s.influxdb_addr,
+		InfluxdbBatchSize:       s.influxdb_batch_size,
+		InfluxdbGzip:            s.influxdb_gzip,
+		OpentsdbAddr:            s.opentsdb_addr,
+		OpentsdbBatchSize:       s.opentsdb_batch_size,
+	}
+}
+
+func (s *StatsDaemon) setBackendConfig(c BackendConfig) {
+	s.backendNames = c.Names
+	s.graphite_addr = c.GraphiteAddr
+	s.graphite_protocol = c.GraphiteProtocol
+	s.graphite_pickle_batch_size = c.GraphitePickleBatchSize
+	s.graphite_routing = c.GraphiteRouting
+	s.tsdbgw_addr = c.TsdbgwAddr
+	s.tsdbgw_api_key = c.TsdbgwApiKey
+	s.influxdb_addr = c.InfluxdbAddr
+	s.influxdb_batch_size = c.InfluxdbBatchSize
+	s.influxdb_gzip = c.InfluxdbGzip
+	s.opentsdb_addr = c.OpentsdbAddr
+	s.opentsdb_batch_size = c.OpentsdbBatchSize
+}
+
+// reload asks ReloadFunc for new settings. they are returned rather than applied,
+// as that has to wait for the next flush.
+func (s *StatsDaemon) reload() *Config {
+	if s.ReloadFunc == nil {
+		log.Warn("reload: not supported, ignoring")
+		return nil
+	}
+	c, err := s.ReloadFunc()
+	if err != nil {
+		log.Errorf("reload failed, keeping the current settings: %s", err)
+		return nil
+	}
+	log.Info("reload: new settings will be applied at the next flush")
+	return c
+}
+
+// applyConfig switches to new settings. it must be called between flushes, when nothing else uses them.
+// the prefixes and output destinations apply to the data that is about to be flushed,
+// the percentiles, flush_rates/flush_counts and the filter rules to the interval that is about to start.
+// when the output destinations changed, new backends are started right away, and the previous ones are stopped
+// in the background, so that ingestion doesn't wait for them. they get up to shutdown_timeout to write their
+// queued data, after which what's left is handed to the new backend for the same destination, if any.
+func (s *StatsDaemon) applyConfig(c *Config) {
+	prefixInternal := s.fmt.PrefixInternal
+	s.fmt = c.Formatter
+	s.fmt.PrefixInternal = prefixInternal
+	s.flush_rates = c.FlushRates
+	s.flush_counts = c.FlushCounts
+	s.pct = c.Pct
+	if s.prometheus != nil {
+		s.prometheus.SetPercentiles(c.Pct)
+	}
+	log.SetLevel(c.LogLevel)
+	s.rules.Store(c.Rules)
+
+	prev := s.backendConfig()
+	if !reflect.DeepEqual(prev, c.Backends) {
+		s.setBackendConfig(c.Backends)
+		backends, err := s.newBackends(c.Backends.Names)
+		if err != nil {
+			log.Errorf("reload: %s. keeping the previous output destinations", err)
+			s.setBackendConfig(prev)
+		} else {
+			old := s.backends
+			s.backends = backends
+			for _, b := range s.backends {
+				b.Start()
+			}
+			log.Infof("reload: output destinations changed, giving the previous backends up to %s to write their data", s.shutdown_timeout)
+			s.replacing.Add(1)
+			go func() {
+				defer s.replacing.Done()
+				if lost := replaceBackends(old, backends, s.shutdown_timeout); lost > 0 {
+					log.Errorf("reload: %d payloads were lost", lost)
+				}
+			}()
+		}
+	}
+	log.Info("reload: new settings applied")
+}
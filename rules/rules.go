@@ -0,0 +1,181 @@
+// Package rules filters and renames buckets before they are aggregated.
+//
+// a rules file has one rule per line. empty lines and lines starting with # are ignored.
+//
+//	allow   <regex>                [types=<modifier>,...] [name=<name>]
+//	deny    <regex>                [types=<modifier>,...] [name=<name>]
+//	rewrite <regex> <replacement>  [types=<modifier>,...] [name=<name>]
+//
+// the rules are applied in order to the bucket of each metric. the first allow or deny rule that matches
+// decides whether the metric is kept or dropped. a rewrite rule replaces the matches of the regex with the
+// replacement, which can refer to submatches like $1, and the next rules see the new bucket.
+// metrics that no allow or deny rule matches are kept, so a rules file that ends with "deny ." only keeps
+// what is explicitly allowed.
+// types restricts a rule to metrics with the given modifiers (c, g, ms, h, s).
+// name identifies the rule in the internal metrics. it defaults to the position of the rule, starting at 1.
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/raintank/statsdaemon/common"
+)
+
+const (
+	Allow   = "allow"
+	Deny    = "deny"
+	Rewrite = "rewrite"
+)
+
+var modifiers = map[string]bool{"c": true, "g": true, "ms": true, "h": true, "s": true}
+
+type Rule struct {
+	Name        string
+	Action      string
+	Pattern     *regexp.Regexp
+	Replacement string
+	Types       map[string]bool // nil means all types
+}
+
+// String returns the rule as it would appear in a rules file
+func (r *Rule) String() string {
+	s := r.Action + " " + r.Pattern.String()
+	if r.Action == Rewrite {
+		s += " " + r.Replacement
+	}
+	if r.Types != nil {
+		var types []string
+		for _, mod := range []string{"c", "g", "ms", "h", "s"} {
+			if r.Types[mod] {
+				types = append(types, mod)
+			}
+		}
+		s += " types=" + strings.Join(types, ",")
+	}
+	return s + " name=" + r.Name
+}
+
+// applies returns whether the rule applies to metrics with the given modifier
+func (r *Rule) applies(modifier string) bool {
+	return r.Types == nil || r.Types[modifier]
+}
+
+// Rules is an ordered list of rules
+type Rules []*Rule
+
+// ParseRule parses a single rule. pos is its position, for the default name
+func ParseRule(line string, pos int) (*Rule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("rule %q: expected an action and a regex", line)
+	}
+	r := &Rule{Name: strconv.Itoa(pos), Action: fields[0]}
+	pattern := fields[1]
+	switch r.Action {
+	case Allow, Deny:
+		fields = fields[2:]
+	case Rewrite:
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("rule %q: rewrite needs a replacement", line)
+		}
+		r.Replacement = fields[2]
+		fields = fields[3:]
+	default:
+		return nil, fmt.Errorf("rule %q: unknown action %q", line, r.Action)
+	}
+	var err error
+	r.Pattern, err = regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("rule %q: %s", line, err)
+	}
+	for _, opt := range fields {
+		switch {
+		case strings.HasPrefix(opt, "types="):
+			r.Types = make(map[string]bool)
+			for _, mod := range strings.Split(strings.TrimPrefix(opt, "types="), ",") {
+				if !modifiers[mod] {
+					return nil, fmt.Errorf("rule %q: unknown type %q", line, mod)
+				}
+				r.Types[mod] = true
+			}
+		case strings.HasPrefix(opt, "name="):
+			r.Name = strings.TrimPrefix(opt, "name=")
+			if r.Name == "" {
+				return nil, fmt.Errorf("rule %q: empty name", line)
+			}
+		default:
+			return nil, fmt.Errorf("rule %q: unknown option %q", line, opt)
+		}
+	}
+	return r, nil
+}
+
+// Parse parses a rules file
+func Parse(in io.Reader) (Rules, error) {
+	var rules Rules
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r, err := ParseRule(line, len(rules)+1)
+		if err != nil {
+			return nil, err
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("rule %q: duplicate name %q", line, r.Name)
+		}
+		names[r.Name] = true
+		rules = append(rules, r)
+	}
+	return rules, scanner.Err()
+}
+
+// Load reads the rules from the given file
+func Load(path string) (Rules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return rules, nil
+}
+
+// Apply applies the rules to the metric. it returns the bucket, which differs from that of the metric
+// if a rewrite rule matched, and false if the metric is to be dropped. the metric is not modified.
+// matched, if not nil, is called with the index of each rule that matches, and the bucket as the rule saw it.
+func (rules Rules) Apply(m *common.Metric, matched func(i int, bucket string)) (string, bool) {
+	bucket := m.Bucket
+	for i, r := range rules {
+		if !r.applies(m.Modifier) || !r.Pattern.MatchString(bucket) {
+			continue
+		}
+		if matched != nil {
+			matched(i, bucket)
+		}
+		switch r.Action {
+		case Allow:
+			return bucket, true
+		case Deny:
+			return bucket, false
+		case Rewrite:
+			bucket = r.Pattern.ReplaceAllString(bucket, r.Replacement)
+			if bucket == "" {
+				return bucket, false
+			}
+		}
+	}
+	return bucket, true
+}
@@ -0,0 +1,81 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/raintank/statsdaemon/common"
+)
+
+func TestParse(t *testing.T) {
+	rules, err := Parse(strings.NewReader(`
+# drop the per user latencies, but keep their total
+rewrite ^user\.[0-9]+\.latency$  user.all.latency  types=ms name=user_latency
+deny    ^user\.
+allow   ^api\.   types=c,g
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(rules), 3)
+	assert.Equal(t, rules[0].String(), `rewrite ^user\.[0-9]+\.latency$ user.all.latency types=ms name=user_latency`)
+	assert.Equal(t, rules[1].String(), `deny ^user\. name=2`)
+	assert.Equal(t, rules[2].String(), `allow ^api\. types=c,g name=3`)
+
+	for _, in := range []string{
+		"deny",
+		"block foo",
+		"rewrite foo",
+		"deny (foo",
+		"deny foo types=x",
+		"deny foo name=",
+		"deny foo bar",
+		"deny foo name=a\nallow bar name=a",
+	} {
+		if _, err := Parse(strings.NewReader(in)); err == nil {
+			t.Fatalf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	rules, err := Parse(strings.NewReader(`
+rewrite ^user\.[0-9]+\.(.*)$ user.all.$1 types=ms
+deny    ^user\.[0-9]+\.
+allow   ^api\.
+rewrite ^api   web
+deny    .
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		bucket   string
+		modifier string
+		exp      string
+		keep     bool
+		matched  []int
+	}{
+		{"user.123.latency", "ms", "user.all.latency", false, []int{0, 4}},
+		{"user.123.latency", "c", "user.123.latency", false, []int{1}},
+		{"api.requests", "c", "api.requests", true, []int{2}},
+		{"other", "g", "other", false, []int{4}},
+	}
+	for _, c := range cases {
+		m := &common.Metric{Bucket: c.bucket, Modifier: c.modifier}
+		var matched []int
+		bucket, keep := rules.Apply(m, func(i int, bucket string) {
+			matched = append(matched, i)
+		})
+		assert.Equal(t, bucket, c.exp)
+		assert.Equal(t, keep, c.keep)
+		assert.Equal(t, matched, c.matched)
+		assert.Equal(t, m.Bucket, c.bucket)
+	}
+
+	// without rules, everything is kept as is
+	bucket, keep := Rules(nil).Apply(&common.Metric{Bucket: "foo"}, nil)
+	assert.Equal(t, bucket, "foo")
+	assert.Equal(t, keep, true)
+}
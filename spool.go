@@ -0,0 +1,332 @@
+package statsdaemon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raintank/statsdaemon/out"
+	log "github.com/sirupsen/logrus"
+)
+
+// spoolHeaderSize is the size of the header of each record: the length of the payload, and the time it was spooled
+const spoolHeaderSize = 12
+
+// spoolReadOffsetFile is the file that the read position is saved in
+const spoolReadOffsetFile = "read_offset"
+
+// spoolMaxSegmentSize is the max size of a segment file. smaller spools use smaller segments,
+// as the size limit is enforced by removing whole segments.
+const spoolMaxSegmentSize = 64 * 1024 * 1024
+
+// spool is an on-disk queue of payloads, for backends to buffer data in while their destination is unreachable.
+// payloads are appended to numbered segment files in the spool directory, and read back in order.
+// segments are removed once they have been read completely. when the spool exceeds its max size,
+// its oldest segments are dropped, and payloads that are older than the max age (if set) are dropped when read back.
+// the read position is saved when the spool is closed. after a crash, a partially read segment is replayed from the start.
+type spool struct {
+	dir         string
+	maxSize     int64
+	maxAge      time.Duration
+	segmentSize int64
+	now         func() time.Time
+
+	sync.Mutex
+	segments []*spoolSegment // oldest first. the last one is being written to, if w is set
+	seq      uint64          // of the last segment
+	w        *os.File
+	r        *os.File // reads segments[0]
+	rOff     int64
+	count    int   // unread payloads
+	size     int64 // of all segments
+	notify   chan struct{}
+}
+
+type spoolSegment struct {
+	path  string
+	size  int64
+	count int // unread payloads
+}
+
+// openSpool opens the spool in dir, creating it if needed, and picks up the payloads left behind by a previous run
+func openSpool(dir string, maxSize int64, maxAge time.Duration) (*spool, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("spool %s: max size must be positive", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &spool{
+		dir:         dir,
+		maxSize:     maxSize,
+		maxAge:      maxAge,
+		segmentSize: maxSize / 4,
+		now:         time.Now,
+		notify:      make(chan struct{}, 1),
+	}
+	if s.segmentSize > spoolMaxSegmentSize {
+		s.segmentSize = spoolMaxSegmentSize
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	readSeg, readOff := s.loadReadOffset()
+	for i, path := range paths {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		var off int64
+		if i == 0 && filepath.Base(path) == readSeg {
+			off = readOff
+		}
+		seg, err := scanSegment(path, off)
+		if err != nil {
+			return nil, err
+		}
+		if len(s.segments) == 0 {
+			s.rOff = off
+		}
+		if seq > s.seq {
+			s.seq = seq
+		}
+		if seg.count == 0 {
+			os.Remove(path)
+			continue
+		}
+		s.segments = append(s.segments, seg)
+		s.count += seg.count
+		s.size += seg.size
+	}
+	if s.count > 0 {
+		log.Infof("spool %s: found %d payloads (%d bytes) to replay", dir, s.count, s.size)
+		s.notify <- struct{}{}
+	}
+	return s, nil
+}
+
+// loadReadOffset returns the segment and offset that reading stopped at when the spool was closed.
+// the file is removed, as the position isn't kept up to date while reading.
+func (s *spool) loadReadOffset() (string, int64) {
+	path := filepath.Join(s.dir, spoolReadOffsetFile)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", 0
+	}
+	os.Remove(path)
+	var seg string
+	var off int64
+	if _, err := fmt.Sscanf(string(data), "%s %d", &seg, &off); err != nil {
+		log.Warnf("spool: ignoring invalid %s: %s", path, err)
+		return "", 0
+	}
+	return seg, off
+}
+
+// scanSegment counts the payloads in a segment that start at or after readOff. a record that was only
+// partially written, e.g. because the process crashed, is truncated.
+func scanSegment(path string, readOff int64) (*spoolSegment, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	seg := &spoolSegment{path: path}
+	header := make([]byte, spoolHeaderSize)
+	for {
+		if _, err := f.ReadAt(header, seg.size); err != nil {
+			break
+		}
+		next := seg.size + spoolHeaderSize + int64(binary.BigEndian.Uint32(header))
+		if next > info.Size() {
+			break
+		}
+		if seg.size >= readOff {
+			seg.count++
+		}
+		seg.size = next
+	}
+	if seg.size < info.Size() {
+		log.Warnf("spool: truncating %s from %d to %d bytes", path, info.Size(), seg.size)
+		if err := f.Truncate(seg.size); err != nil {
+			return nil, err
+		}
+	}
+	return seg, nil
+}
+
+// len returns the amount of unread payloads
+func (s *spool) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.count
+}
+
+// push appends the payload to the spool. it returns the amount of payloads it had to drop
+// to stay within the max size.
+func (s *spool) push(points []out.Point) (int, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, spoolHeaderSize))
+	if err := gob.NewEncoder(&buf).Encode(points); err != nil {
+		return 0, err
+	}
+	rec := buf.Bytes()
+	binary.BigEndian.PutUint32(rec, uint32(len(rec)-spoolHeaderSize))
+	binary.BigEndian.PutUint64(rec[4:], uint64(s.now().Unix()))
+
+	s.Lock()
+	defer s.Unlock()
+	if s.w == nil || s.segments[len(s.segments)-1].size >= s.segmentSize {
+		if err := s.newSegment(); err != nil {
+			return 0, err
+		}
+	}
+	seg := s.segments[len(s.segments)-1]
+	if n, err := s.w.Write(rec); err != nil {
+		// don't leave a partial record behind
+		if n > 0 {
+			s.w.Truncate(seg.size)
+			s.w.Seek(seg.size, io.SeekStart)
+		}
+		return 0, err
+	}
+	seg.size += int64(len(rec))
+	seg.count++
+	s.size += int64(len(rec))
+	s.count++
+	dropped := 0
+	for s.size > s.maxSize && len(s.segments) > 1 {
+		dropped += s.removeOldest()
+	}
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return dropped, nil
+}
+
+func (s *spool) newSegment() error {
+	if s.w != nil {
+		s.w.Close()
+	}
+	s.seq++
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d.seg", s.seq))
+	w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		s.w = nil
+		return err
+	}
+	s.w = w
+	s.segments = append(s.segments, &spoolSegment{path: path})
+	return nil
+}
+
+// removeOldest removes the oldest segment, and returns the amount of unread payloads in it
+func (s *spool) removeOldest() int {
+	seg := s.segments[0]
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+	s.rOff = 0
+	if len(s.segments) == 1 && s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+	if err := os.Remove(seg.path); err != nil {
+		log.Errorf("spool: %s", err)
+	}
+	s.size -= seg.size
+	s.count -= seg.count
+	s.segments = s.segments[1:]
+	return seg.count
+}
+
+// pop returns the oldest payload, if there is one. it also returns the amount of payloads it dropped,
+// because they were too old or could not be read.
+func (s *spool) pop() ([]out.Point, int, bool) {
+	s.Lock()
+	defer s.Unlock()
+	dropped := 0
+	for s.count > 0 {
+		seg := s.segments[0]
+		points, age, ok, err := s.read(seg)
+		if err != nil {
+			log.Errorf("spool: can't read %s: %s. dropping %d payloads", seg.path, err, seg.count)
+			dropped += s.removeOldest()
+			continue
+		}
+		seg.count--
+		s.count--
+		if seg.count == 0 {
+			s.removeOldest()
+		}
+		if !ok || s.maxAge > 0 && age > s.maxAge {
+			dropped++
+			continue
+		}
+		return points, dropped, true
+	}
+	return nil, dropped, false
+}
+
+// read reads the next record of the oldest segment. ok is false if the record can't be decoded.
+func (s *spool) read(seg *spoolSegment) (points []out.Point, age time.Duration, ok bool, err error) {
+	if s.r == nil {
+		s.r, err = os.Open(seg.path)
+		if err != nil {
+			return nil, 0, false, err
+		}
+	}
+	header := make([]byte, spoolHeaderSize)
+	if _, err := s.r.ReadAt(header, s.rOff); err != nil {
+		return nil, 0, false, err
+	}
+	rec := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := s.r.ReadAt(rec, s.rOff+spoolHeaderSize); err != nil {
+		return nil, 0, false, err
+	}
+	s.rOff += spoolHeaderSize + int64(len(rec))
+	age = s.now().Sub(time.Unix(int64(binary.BigEndian.Uint64(header[4:])), 0))
+	if err := gob.NewDecoder(bytes.NewReader(rec)).Decode(&points); err != nil {
+		log.Errorf("spool: can't decode payload in %s: %s", seg.path, err)
+		return nil, age, false, nil
+	}
+	return points, age, true, nil
+}
+
+// close closes the files, leaving the unread payloads for the next run
+func (s *spool) close() {
+	s.Lock()
+	defer s.Unlock()
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+	if s.rOff > 0 && len(s.segments) > 0 {
+		data := fmt.Sprintf("%s %d\n", filepath.Base(s.segments[0].path), s.rOff)
+		if err := ioutil.WriteFile(filepath.Join(s.dir, spoolReadOffsetFile), []byte(data), 0644); err != nil {
+			log.Errorf("spool: can't save read position: %s", err)
+		}
+	}
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+}
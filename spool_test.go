@@ -0,0 +1,162 @@
+package statsdaemon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/raintank/statsdaemon/out"
+)
+
+func payload(i int) []out.Point {
+	return []out.Point{{Name: "foo", Tags: []string{"a=b"}, Value: float64(i), Time: 1500000000, Mtype: "gauge"}}
+}
+
+func popAll(t *testing.T, s *spool) (values []float64, dropped int) {
+	for {
+		points, d, ok := s.pop()
+		dropped += d
+		if !ok {
+			return values, dropped
+		}
+		values = append(values, points[0].Value)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openSpool(dir, 1024*1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.segmentSize = 500 // a few payloads per segment
+	for i := 0; i < 20; i++ {
+		if _, err := s.push(payload(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, s.len(), 20)
+	assert.T(t, len(s.segments) > 2, len(s.segments))
+
+	// read some, then pick up the rest after a restart
+	points, _, _ := s.pop()
+	assert.Equal(t, points, payload(0))
+	s.close()
+	s, err = openSpool(dir, 1024*1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, s.len(), 19)
+	s.push(payload(20))
+	values, dropped := popAll(t, s)
+	assert.Equal(t, dropped, 0)
+	assert.Equal(t, len(values), 20)
+	for i, v := range values {
+		assert.Equal(t, v, float64(i+1))
+	}
+	assert.Equal(t, s.len(), 0)
+	assert.Equal(t, s.size, int64(0))
+	files, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	assert.Equal(t, len(files), 0)
+}
+
+func TestSpoolLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openSpool(dir, 2000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.segmentSize = 500
+	now := time.Unix(1500000000, 0)
+	s.now = func() time.Time { return now }
+	dropped := 0
+	for i := 0; i < 20; i++ {
+		d, err := s.push(payload(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropped += d
+	}
+	// the oldest segments were dropped to stay within the max size
+	assert.T(t, s.size <= 2000, s.size)
+	assert.T(t, dropped > 0)
+	assert.Equal(t, s.len(), 20-dropped)
+
+	values, _ := popAll(t, s)
+	assert.Equal(t, values[0], float64(dropped))
+	assert.Equal(t, values[len(values)-1], 19.0)
+
+	// payloads that are too old by the time they are read are dropped
+	s.push(payload(1))
+	now = now.Add(2 * time.Hour)
+	s.push(payload(2))
+	values, dropped = popAll(t, s)
+	assert.Equal(t, values, []float64{2})
+	assert.Equal(t, dropped, 1)
+}
+
+func TestSpoolTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openSpool(dir, 1024*1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.push(payload(1))
+	s.push(payload(2))
+	s.close()
+
+	// a crash in the middle of writing the last payload
+	path := s.segments[0].path
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-5)
+
+	s, err = openSpool(dir, 1024*1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, dropped := popAll(t, s)
+	assert.Equal(t, values, []float64{1})
+	assert.Equal(t, dropped, 0)
+}
+
+func TestSpoolCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openSpool(dir, 1024*1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.push(payload(1))
+	s.push(payload(2))
+	s.pop()
+
+	// without closing, the read position isn't saved, so the segment is replayed from the start
+	s, err = openSpool(dir, 1024*1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, _ := popAll(t, s)
+	assert.Equal(t, values, []float64{1, 2})
+}
@@ -1,12 +1,8 @@
 package statsdaemon
 
 import (
-	"bufio"
-	"bytes"
-	"crypto/tls"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -14,28 +10,29 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/benbjohnson/clock"
-	"github.com/golang/snappy"
-	"github.com/jpillora/backoff"
-	"github.com/raintank/schema"
-	"github.com/raintank/schema/msg"
 	"github.com/raintank/statsdaemon/common"
 	"github.com/raintank/statsdaemon/out"
+	"github.com/raintank/statsdaemon/stream"
 	"github.com/raintank/statsdaemon/ticker"
 	"github.com/raintank/statsdaemon/udp"
 	log "github.com/sirupsen/logrus"
 	"github.com/tv42/topic"
 )
 
+// metricsStatsReq is a request for metricStatsMonitor. the result is sent to Reply if set,
+// otherwise it is written to Conn, after which the telnet api resumes handling the connection.
 type metricsStatsReq struct {
 	Command []string
 	Conn    *net.Conn
+	Reply   chan<- interface{}
 }
 
-type SubmitFunc func(c *out.Counters, g *out.Gauges, t *out.Timers, deadline time.Time)
+type SubmitFunc func(c *out.Counters, g *out.Gauges, t *out.Timers, sets *out.Sets, h *out.Histograms, deadline time.Time)
 type StatsDaemon struct {
 	instance string
 
@@ -43,93 +40,212 @@ type StatsDaemon struct {
 	flush_rates      bool
 	flush_counts     bool
 	pct              out.Percentiles
+	timerCompression float64
+	setHllThreshold  int
+	histogramSpecs   out.HistogramSpecs
+	delete_gauges    bool
+	gauge_expiry     int
 	flushInterval    int
 	max_unprocessed  int
+	shards           int
 	max_timers_per_s uint64
 	debug            bool
 	signalchan       chan os.Signal
+	shutdown_timeout time.Duration
+	stop             chan struct{}  // closed to stop the listeners on shutdown
+	listeners        sync.WaitGroup // running listeners
 
 	Metrics             chan []*common.Metric
 	metricAmounts       chan []*common.Metric
+	clientAmounts       chan []out.ClientAmounts
 	metricStatsRequests chan metricsStatsReq
 	valid_lines         *topic.Topic
 	Invalid_lines       *topic.Topic
 	events              *topic.Topic
-	client              *http.Client
 
-	Clock         clock.Clock
-	submitFunc    SubmitFunc
-	graphiteQueue chan []byte
+	Clock      clock.Clock
+	submitFunc SubmitFunc
+	// ReloadFunc returns new settings on SIGHUP. if nil, SIGHUP is ignored
+	ReloadFunc func() (*Config, error)
+	backends   []out.Backend
+	replacing  sync.WaitGroup // backends that are being replaced after a reload
+	prometheus *out.Prometheus
+
+	// Version and GitHash are reported by the http admin api
+	Version string
+	GitHash string
+	started time.Time
 
 	listen_addr   string
 	admin_addr    string
 	graphite_addr string
 
+	graphite_protocol          string
+	graphite_pickle_batch_size int
+	graphite_routing           string
+
 	orgid          int
 	tsdbgw_addr    string
 	tsdbgw_api_key string
-	enabletsdbgw   bool
-	enablegraphite bool
+	backendNames   []string
+
+	influxdb_addr       string
+	influxdb_batch_size int
+	influxdb_gzip       bool
+
+	opentsdb_addr       string
+	opentsdb_batch_size int
+
+	spool_dir      string
+	spool_max_size int64
+	spool_max_age  time.Duration
+
+	rules   atomic.Value // rules.Rules to filter and rename the incoming metrics with
+	limiter *limiter
+	parse   func(line []byte) ([]*common.Metric, error) // parses the incoming lines, sanitizing their keys if enabled
 }
 
-func New(instance string, formatter out.Formatter, flush_rates, flush_counts bool, pct out.Percentiles, flushInterval, max_unprocessed int, max_timers_per_s uint64, signalchan chan os.Signal, orgid int, enablegraphite bool, enabletsdbgw bool, tsdbgw_addr string, tsdbgw_api_key string) *StatsDaemon {
-	return &StatsDaemon{
+// Settings holds the settings that can't be changed while running, see Config for those that can
+type Settings struct {
+	TimerCompression float64 // 0 means exact timers, otherwise timers are estimated with a t-digest
+	SetHllThreshold  int
+	HistogramSpecs   out.HistogramSpecs
+	DeleteGauges     bool
+	GaugeExpiry      int // in seconds
+	FlushInterval    int // in seconds
+	MaxUnprocessed   int
+	Shards           int
+	MaxTimersPerS    uint64
+	Orgid            int
+
+	SpoolDir        string
+	SpoolMaxSize    int64 // in bytes
+	SpoolMaxAge     time.Duration
+	ShutdownTimeout time.Duration
+
+	BucketLimits *BucketLimits
+	KeySanitizer *udp.KeySanitizer
+}
+
+// New creates a statsdaemon with the given settings. the LogLevel of c is not applied, as the logger is global.
+func New(instance string, c Config, settings Settings, signalchan chan os.Signal) *StatsDaemon {
+	s := &StatsDaemon{
 		instance:            instance,
-		fmt:                 formatter,
-		flush_rates:         flush_rates,
-		flush_counts:        flush_counts,
-		pct:                 pct,
-		flushInterval:       flushInterval,
-		max_unprocessed:     max_unprocessed,
-		max_timers_per_s:    max_timers_per_s,
+		fmt:                 c.Formatter,
+		flush_rates:         c.FlushRates,
+		flush_counts:        c.FlushCounts,
+		pct:                 c.Pct,
+		timerCompression:    settings.TimerCompression,
+		setHllThreshold:     settings.SetHllThreshold,
+		histogramSpecs:      settings.HistogramSpecs,
+		delete_gauges:       settings.DeleteGauges,
+		gauge_expiry:        settings.GaugeExpiry,
+		flushInterval:       settings.FlushInterval,
+		max_unprocessed:     settings.MaxUnprocessed,
+		shards:              settings.Shards,
+		max_timers_per_s:    settings.MaxTimersPerS,
 		signalchan:          signalchan,
-		Metrics:             make(chan []*common.Metric, max_unprocessed),
-		metricAmounts:       make(chan []*common.Metric, max_unprocessed),
+		shutdown_timeout:    settings.ShutdownTimeout,
+		stop:                make(chan struct{}),
+		Metrics:             make(chan []*common.Metric, settings.MaxUnprocessed),
+		metricAmounts:       make(chan []*common.Metric, settings.MaxUnprocessed),
+		clientAmounts:       make(chan []out.ClientAmounts, settings.MaxUnprocessed),
 		metricStatsRequests: make(chan metricsStatsReq),
 		valid_lines:         topic.New(),
 		Invalid_lines:       topic.New(),
 		events:              topic.New(),
-		orgid:               orgid,
-		enabletsdbgw:        enabletsdbgw,
-		enablegraphite: 	 enablegraphite,
-		tsdbgw_api_key:      tsdbgw_api_key,
-		tsdbgw_addr:         tsdbgw_addr,
+		orgid:               settings.Orgid,
+
+		spool_dir:      settings.SpoolDir,
+		spool_max_size: settings.SpoolMaxSize,
+		spool_max_age:  settings.SpoolMaxAge,
 	}
+	s.setBackendConfig(c.Backends)
+	s.rules.Store(c.Rules)
+	s.limiter = newLimiter(settings.BucketLimits, c.Formatter.PrefixInternal, settings.Shards)
+	s.parse = udp.ParseLine2
+	if settings.KeySanitizer.Enabled() {
+		s.parse = settings.KeySanitizer.ParseLine
+	}
+	return s
 }
 
 // start statsdaemon instance with standard network daemon behaviors
-func (s *StatsDaemon) Run(listen_addr, admin_addr, graphite_addr string) {
+// listen_sockets and listen_rcvbuf configure the udp listener, see udp.Listener.
+// listen_tcp_addr and listen_unix_path optionally enable listeners on tcp and a unix socket,
+// which is a datagram socket if listen_unix_datagram is set, a stream socket otherwise.
+// admin_http_addr optionally enables the http admin api, see adminHandler.
+// prometheus_addr optionally enables serving the last flushed metrics for prometheus.
+// on SIGTERM or SIGINT, it stops the listeners, flushes what they received, and waits up to shutdown_timeout
+// for the backends to write their queued data.
+func (s *StatsDaemon) Run(listen_addr string, listen_sockets, listen_rcvbuf int, listen_tcp_addr, listen_unix_path string, listen_unix_datagram bool, admin_addr, admin_http_addr, prometheus_addr string) {
 	s.Clock = clock.New()
-	s.submitFunc = s.GraphiteQueue
-	s.graphiteQueue = make(chan []byte, 1000)
+	s.started = s.Clock.Now()
+	s.submitFunc = s.Submit
 
 	s.listen_addr = listen_addr
 	s.admin_addr = admin_addr
-	s.graphite_addr = graphite_addr
+
+	var err error
+	s.backends, err = s.newBackends(s.backendNames)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if prometheus_addr != "" {
+		s.prometheus = out.NewPrometheus(s.pct)
+		go s.prometheusListener(prometheus_addr)
+	} else if len(s.backends) == 0 {
+		log.Warn("no backends enabled, metrics will not be sent anywhere")
+	}
 
 	log.Infof("statsdaemon instance '%s' starting", s.instance)
 	output := &out.Output{
 		Metrics:       s.Metrics,
 		MetricAmounts: s.metricAmounts,
+		Clients:       s.clientAmounts,
 		Valid_lines:   s.valid_lines,
 		Invalid_lines: s.Invalid_lines,
+		Done:          s.stop,
 	}
-	go udp.StatsListener(s.listen_addr, s.fmt.PrefixInternal, output) // set up udp listener that writes messages to output's channels (i.e. s's channels)
-	go s.adminListener()                                              // tcp admin_addr to handle requests
-	go s.metricStatsMonitor()                                         // handles requests fired by telnet api
-
-	if s.enabletsdbgw == true && s.enablegraphite == true {
-		log.Fatal("cannot use both tsdbgw and graphite outputs")
+	s.listen(func() {
+		udp.Listener(s.listen_addr, s.fmt.PrefixInternal, listen_sockets, listen_rcvbuf, output, s.parse)
+	}) // set up udp listener that writes messages to output's channels (i.e. s's channels)
+	if listen_tcp_addr != "" {
+		s.listen(func() { stream.Listener("tcp", listen_tcp_addr, s.fmt.PrefixInternal, output, s.parse) })
 	}
-	if s.enabletsdbgw == true {
-		log.Infof("starting tsdbgw writer")
-		go s.graphiteWriterM20()										  // writes to tsdbgw in the background
+	if listen_unix_path != "" {
+		if listen_unix_datagram {
+			s.listen(func() { udp.UnixgramListener(listen_unix_path, s.fmt.PrefixInternal, output, s.parse) })
+		} else {
+			s.listen(func() { stream.UnixListener(listen_unix_path, s.fmt.PrefixInternal, output, s.parse) })
+		}
 	}
-	if s.enablegraphite == true {
-		log.Infof("starting Graphite writer")
-		go s.graphiteWriter() // writes to graphite in the background
+	go s.adminListener()      // tcp admin_addr to handle requests
+	go s.metricStatsMonitor() // handles requests fired by telnet api
+	if admin_http_addr != "" {
+		go s.adminHTTPListener(admin_http_addr)
+	}
+
+	for _, b := range s.backends {
+		b.Start() // writes to its destination in the background
 	}
 	s.metricsMonitor()                                                // takes data from s.Metrics and puts them in the guage/timers/etc objects. pointers guarded by select. also listens for signals.
+	log.Infof("waiting up to %s for the backends to write their data", s.shutdown_timeout)
+	s.replacing.Wait()
+	if lost := stopBackends(s.backends, s.shutdown_timeout); lost > 0 {
+		log.Errorf("shutdown: %d payloads were lost", lost)
+	} else {
+		log.Info("shutdown complete")
+	}
+}
+
+// listen runs a listener in the background, keeping track of it so we can wait for it to stop on shutdown
+func (s *StatsDaemon) listen(listener func()) {
+	s.listeners.Add(1)
+	go func() {
+		defer s.listeners.Done()
+		listener()
+	}()
 }
 
 // start statsdaemon instance, only processing incoming metrics from the channel, and flushing
@@ -144,71 +260,151 @@ func (s *StatsDaemon) RunBare() {
 
 // metricsMonitor basically guards the metrics datastructures.
 // it typically receives metrics on the Metrics channel but also responds to
-// external signals and every flushInterval, computes and flushes the data
+// external signals and every flushInterval, computes and flushes the data.
+// on shutdown, it stops the listeners, takes in everything they still received,
+// waits for a flush that may be in progress, and does a final flush.
+// the filter rules and bucket limits are applied to the metrics before they are aggregated.
+// on SIGHUP, it reloads the settings, which are applied at the next flush, so that
+// the interval in progress isn't lost.
+// the datastructures are owned by one aggregator per shard. with multiple shards,
+// metricsMonitor routes each metric to the shardFilter of its bucket, which applies the rules
+// and limits and passes it on to the aggregator of its (new) bucket. on flush, it merges
+// the data of all shards back together.
 func (s *StatsDaemon) metricsMonitor() {
 	period := time.Duration(s.flushInterval) * time.Second
 	tick := ticker.GetAlignedTicker(s.Clock, period)
 
-	var c *out.Counters
-	var g *out.Gauges
-	var t *out.Timers
-	oneCounter := &common.Metric{
-		Bucket:   fmt.Sprintf("%sdirection_is_in.statsd_type_is_counter.mtype_is_count.unit_is_Metric", s.fmt.PrefixInternal),
-		Value:    1,
-		Sampling: 1,
+	aggs := make([]*aggregator, s.shards)
+	var filters []*shardFilter
+	for i := range aggs {
+		aggs[i] = newAggregator(s)
+		if s.shards > 1 {
+			go aggs[i].run()
+		}
 	}
-	oneGauge := &common.Metric{
-		Bucket:   fmt.Sprintf("%sdirection_is_in.statsd_type_is_gauge.mtype_is_count.unit_is_Metric", s.fmt.PrefixInternal),
-		Value:    1,
-		Sampling: 1,
+	if s.shards > 1 {
+		filters = make([]*shardFilter, s.shards)
+		for i := range filters {
+			filters[i] = newShardFilter(s, aggs)
+			go filters[i].run()
+		}
 	}
-	oneTimer := &common.Metric{
-		Bucket:   fmt.Sprintf("%sdirection_is_in.statsd_type_is_timer.mtype_is_count.unit_is_Metric", s.fmt.PrefixInternal),
-		Value:    1,
-		Sampling: 1,
+
+	// take requests the data of the interval that just ended from all aggregators.
+	// with multiple shards, it is only complete once they have processed all their
+	// pending metrics, which is up to the receiver to wait for.
+	take := func() <-chan *aggregate {
+		parts := make(chan *aggregate, len(aggs))
+		if len(aggs) == 1 {
+			parts <- aggs[0].take()
+			return parts
+		}
+		for _, a := range aggs {
+			a.in <- aggregatorMsg{flush: parts}
+		}
+		return parts
+	}
+	merge := func(parts <-chan *aggregate) *aggregate {
+		data := <-parts
+		for i := 1; i < len(aggs); i++ {
+			data.merge(<-parts)
+		}
+		return data
 	}
 
-	initializeCounters := func() {
-		c = out.NewCounters(s.flush_rates, s.flush_counts)
-		g = out.NewGauges()
-		t = out.NewTimers(s.pct)
-		for _, name := range []string{"timer", "gauge", "counter"} {
-			c.Add(&common.Metric{
-				Bucket:   fmt.Sprintf("%sdirection_is_in.statsd_type_is_%s.mtype_is_count.unit_is_Metric", s.fmt.PrefixInternal, name),
-				Sampling: 1,
-			})
+	rulesFilter := newFilter(s.currentRules(), s.fmt.PrefixInternal)
+	add := func(metrics []*common.Metric) {
+		if len(aggs) == 1 {
+			aggs[0].add(s.limiter.apply(rulesFilter.apply(metrics)))
+			return
+		}
+		for i, batch := range splitShards(metrics, len(filters)) {
+			if batch != nil {
+				filters[i].in <- shardFilterMsg{metrics: batch}
+			}
+		}
+	}
+	// syncFilters waits until the shardFilters have passed on all metrics they received to the aggregators.
+	// until more metrics are added, they're idle, so their filters and the limiter can be changed.
+	syncFilters := func() {
+		synced := make(chan struct{}, len(filters))
+		for _, f := range filters {
+			f.in <- shardFilterMsg{synced: synced}
+		}
+		for range filters {
+			<-synced
+		}
+	}
+	setRules := func() {
+		rulesFilter = newFilter(s.currentRules(), s.fmt.PrefixInternal)
+		for _, f := range filters {
+			f.filter = newFilter(s.currentRules(), s.fmt.PrefixInternal)
 		}
 	}
-	initializeCounters()
+
+	var flushing sync.WaitGroup
+	var pending *Config // settings to apply at the next flush
 	for {
 		select {
 		case sig := <-s.signalchan:
 			switch sig {
 			case syscall.SIGTERM, syscall.SIGINT:
 				fmt.Printf("!! Caught signal %s... shutting down\n", sig)
-				s.submitFunc(c, g, t, s.Clock.Now().Add(period))
+				s.drain(add)
+				syncFilters()
+				flushing.Wait()
+				data := merge(take())
+				s.submitFunc(data.c, data.g, data.t, data.sets, data.h, s.Clock.Now().Add(period))
 				return
+			case syscall.SIGHUP:
+				if c := s.reload(); c != nil {
+					pending = c
+				}
 			default:
 				fmt.Printf("unknown signal %s, ignoring\n", sig)
 			}
 		case <-tick.C:
-			go func(c *out.Counters, g *out.Gauges, t *out.Timers) {
-				s.submitFunc(c, g, t, s.Clock.Now().Add(period))
+			syncFilters()
+			if pending != nil {
+				flushing.Wait()
+				s.applyConfig(pending)
+				setRules()
+				pending = nil
+			}
+			s.limiter.reset()
+			flushing.Add(1)
+			go func(parts <-chan *aggregate) {
+				defer flushing.Done()
+				data := merge(parts)
+				s.submitFunc(data.c, data.g, data.t, data.sets, data.h, s.Clock.Now().Add(period))
 				s.events.Broadcast <- "flush"
-			}(c, g, t)
-			initializeCounters()
+			}(take())
 			tick = ticker.GetAlignedTicker(s.Clock, period)
 		case metrics := <-s.Metrics:
-			for _, m := range metrics {
-				if m.Modifier == "ms" {
-					t.Add(m)
-					c.Add(oneTimer)
-				} else if m.Modifier == "g" {
-					g.Add(m)
-					c.Add(oneGauge)
-				} else {
-					c.Add(m)
-					c.Add(oneCounter)
+			add(metrics)
+		}
+	}
+}
+
+// drain stops the listeners, and adds the metrics they still send, and those that are pending in s.Metrics
+func (s *StatsDaemon) drain(add func([]*common.Metric)) {
+	close(s.stop)
+	stopped := make(chan struct{})
+	go func() {
+		s.listeners.Wait()
+		close(stopped)
+	}()
+	for {
+		select {
+		case metrics := <-s.Metrics:
+			add(metrics)
+		case <-stopped:
+			for {
+				select {
+				case metrics := <-s.Metrics:
+					add(metrics)
+				default:
+					return
 				}
 			}
 		}
@@ -216,320 +412,80 @@ func (s *StatsDaemon) metricsMonitor() {
 }
 
 // instrument wraps around a processing function, and makes sure we track the number of metrics and duration of the call,
-// which it flushes as metrics2.0 metrics to the outgoing buffer.
-func (s *StatsDaemon) instrument(st out.Type, buf []byte, now int64, name string) ([]byte, int64) {
+// which it flushes as metrics2.0 metrics to the outgoing points.
+func (s *StatsDaemon) instrument(st out.Type, points []out.Point, now int64, name string) ([]out.Point, int64) {
 	time_start := s.Clock.Now()
-	buf, num := st.Process(buf, now, s.flushInterval, s.fmt)
+	points, num := st.Process(points, now, s.flushInterval, s.fmt)
 	time_end := s.Clock.Now()
 	duration_ms := float64(time_end.Sub(time_start).Nanoseconds()) / float64(1000000)
-	buf = out.WriteFloat64(buf, []byte(fmt.Sprintf("%s%sstatsd_type_is_%s.mtype_is_gauge.type_is_calculation.unit_is_ms", s.fmt.Prefix_m20ne_gauges, s.fmt.PrefixInternal, name)), duration_ms, now)
-	buf = out.WriteFloat64(buf, []byte(fmt.Sprintf("%s%sdirection_is_out.statsd_type_is_%s.mtype_is_rate.unit_is_Metricps", s.fmt.Prefix_m20ne_rates, s.fmt.PrefixInternal, name)), float64(num)/float64(s.flushInterval), now)
-	return buf, num
+	calculation := fmt.Sprintf("%s%sstatsd_type_is_%s.mtype_is_gauge.type_is_calculation.unit_is_ms", s.fmt.Prefix_m20ne_gauges, s.fmt.PrefixInternal, name)
+	rate := fmt.Sprintf("%s%sdirection_is_out.statsd_type_is_%s.mtype_is_rate.unit_is_Metricps", s.fmt.Prefix_m20ne_rates, s.fmt.PrefixInternal, name)
+	points = append(points,
+		out.NewPoint(calculation, "value", calculation, nil, duration_ms, now, "gauge"),
+		out.NewPoint(rate, "value", rate, nil, float64(num)/float64(s.flushInterval), now, "rate"),
+	)
+	return points, num
 }
 
+// Submit invokes the processing function (instrumented) and submits the points to all backends
+func (s *StatsDaemon) Submit(c *out.Counters, g *out.Gauges, t *out.Timers, sets *out.Sets, h *out.Histograms, deadline time.Time) {
+	var points []out.Point
 
-func LineScanner(buf []byte) []string {
-	var lines []string
-	msgs := strings.TrimSpace(string(buf))
-	scanner := bufio.NewScanner(strings.NewReader(msgs))
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+	now := s.Clock.Now().Unix()
+	points, _ = s.instrument(c, points, now, "counter")
+	points, _ = s.instrument(g, points, now, "gauge")
+	points, _ = s.instrument(t, points, now, "timer")
+	points, _ = s.instrument(sets, points, now, "set")
+	points, _ = s.instrument(h, points, now, "histogram")
+	for _, b := range s.backends {
+		b.Submit(points)
 	}
-	return lines
-}
-
-func parseMetric(s *StatsDaemon, buf []byte) ([]*schema.MetricData, error) {
-	errFmt3Fields := "%q: need 3 fields"
-	errFmt := "%q: %s"
-	msgs := LineScanner(buf)
-	var metrics []*schema.MetricData
-
-	log.Debugf("Parsing lines: %s", msgs)
-
-	for _, msg := range msgs {
-		
-		log.Debugf("parsing metric to 2.0 %s", msg)
-
-		elements := strings.Fields(msg)
-		if len(elements) != 3 {
-			log.Errorf("%s", msg)
-			return nil, fmt.Errorf(errFmt3Fields, msg)
-		}
-
-		val, err := strconv.ParseFloat(elements[1], 64)
-		if err != nil {
-			log.Errorf("%s", msg)
-			return nil, fmt.Errorf(errFmt, msg, err)
-		}
-
-		timestamp, err := strconv.ParseUint(elements[2], 10, 32)
-		if err != nil {
-			log.Errorf("%s", msg)
-			return nil, fmt.Errorf(errFmt, msg, err)
-		}
-
-		nameWithTags := elements[0]
-		elements = strings.Split(nameWithTags, ";")
-		name := elements[0]
-		tags := elements[1:]
-		sort.Strings(tags)
-		nameWithTags = fmt.Sprintf("%s;%s", name, strings.Join(tags, ";"))
-		log.Debugf("converting %v %v", name, tags)
-		md := &schema.MetricData{
-			Name:     name,
-			Interval: s.flushInterval,
-			Value:    val,
-			Unit:     "unknown",
-			Time:     int64(timestamp),
-			Mtype:    "gauge",
-			Tags:     tags,
-			OrgId:    s.orgid,
-		}
-		md.SetId()
-		log.Debugf("metric: %v", md)
-		metrics = append(metrics, md)
-
+	if s.prometheus != nil {
+		s.prometheus.Update(c, g, t, sets, h, s.gaugeMaxIdle())
 	}
-	log.Debugf("metrics created: %d", len(metrics))
-	return metrics, nil
 }
 
-func (s *StatsDaemon) flush(req *http.Request) (time.Duration, error) {
-	pre := time.Now()
-	log.Debugf("request is %v", req)
-	resp, err := s.client.Do(req)
-	dur := time.Since(pre)
-	if err != nil {
-		return dur, err
-	}
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		return dur, nil
-	}
-	buf := make([]byte, 300)
-	n, _ := resp.Body.Read(buf)
-	ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	log.Debugf("http %d - %v", resp.StatusCode, resp)
-	return dur, fmt.Errorf("http %d - %s", resp.StatusCode, buf[:n])
+// prometheusListener serves the metrics of the last flush on /metrics
+func (s *StatsDaemon) prometheusListener(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.prometheus)
+	log.Infof("prometheus endpoint listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
 }
 
-func (s *StatsDaemon) retryFlush(metrics []*schema.MetricData, buffer *bytes.Buffer) []*schema.MetricData {
-	if len(metrics) == 0 {
-		return metrics
-	}
-
-	data, err := msg.CreateMsg(metrics, int64(s.orgid), msg.FormatMetricDataArrayMsgp)
-	if err != nil {
-		panic(err)
-	}
-	buffer.Reset()
-
-	snappyBody := snappy.NewBufferedWriter(buffer)
-	snappyBody.Write(data)
-	snappyBody.Close()
-	body := buffer.Bytes()
-	log.Debugf("sending to %s", s.tsdbgw_addr)
-	req, err := http.NewRequest("POST", s.tsdbgw_addr, bytes.NewReader(body))
-	if err != nil {
-		panic(err)
-	}
-	req.Header.Add("Authorization", "Bearer "+s.tsdbgw_api_key)
-	req.Header.Add("Content-Type", "rt-metric-binary-snappy")
-	boff := &backoff.Backoff{
-		Min:    100 * time.Millisecond,
-		Max:    30 * time.Second,
-		Factor: 1.5,
-		Jitter: true,
-	}
-	var dur time.Duration
-	for {
-		dur, err = s.flush(req)
-		if err == nil {
-			break
-		}
-		b := boff.Duration()
-		log.Infof("grafanaNet failed to submit data: %s - will try again in %s (this attempt took %s)", err.Error(), b, dur)
-		time.Sleep(b)
-		// re-instantiate body, since the previous .Do() attempt would have Read it all the way
-		req.Body = ioutil.NopCloser(bytes.NewReader(body))
-	}
-	log.Debugf("GrafanaNet sent metrics in %s -msg size %d", dur, len(metrics))
-	//route.durationTickFlush.Update(dur)
-	//route.tickFlushSize.Update(int64(len(metrics)))
-
-	return metrics[:0]
+// Amounts is a datastructure to track numbers of packets, in particular:
+// * Submitted is "triggered" inside statsd client libs, not necessarily sent
+// * Seen is the amount we see. I.e. after sampling, network loss and udp packet drops
+type Amounts struct {
+	Submitted uint64
+	Seen      uint64
 }
 
-func (s *StatsDaemon) graphiteWriterM20() {
-
-	lock := &sync.Mutex{}
-
-	var concurrency = 1  // number of concurrent connections to tsdb-gw, running statsdaemon in sidecar mode you probably only want 1
-	var timeout time.Duration// in ms
-	timeout = 10 * time.Second
-
-	// Most of this is copy paste from https://github.com/graphite-ng/carbon-relay-ng/blob/master/route/grafananet.go
-	// start off with a transport the same as Go's DefaultTransport
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          concurrency,
-		MaxIdleConnsPerHost:   concurrency,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
-	}
-
-	// disable http 2.0 because there seems to be a compatibility problem between nginx hosts and the golang http2 implementation
-	// which would occasionally result in bogus `400 Bad Request` errors.
-	transport.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
-
-
-	s.client = &http.Client{
-		Timeout:   timeout,
-		Transport: transport,
-	}
-
-	buffer := new(bytes.Buffer)
-
-	for buf := range s.graphiteQueue {
-		lock.Lock()
-		md, err := parseMetric(s, buf)
-		if err != nil {
-			log.Errorf("metric parse error for %v", err)
-		}
-
-		log.Debugf("md was: %v", md)
-		s.retryFlush(md, buffer)
-		lock.Unlock()
-	}
-	lock.Unlock()
-
+// SampleRate is the result of a sample_rate request: the ideal sample rate for the bucket
+// to stay within max_timers_per_s, and the estimated amount of packets per second sent for it
+type SampleRate struct {
+	Bucket          string  `json:"bucket"`
+	IdealSampleRate float64 `json:"ideal_sample_rate"`
+	SubmittedPerS   float64 `json:"submitted_per_s"`
 }
 
-
-// graphiteWriter is the background workers that connects to graphite and submits all pending data to it
-// TODO: conn.Write() returns no error for a while when the remote endpoint is down, the reconnect happens with a delay
-func (s *StatsDaemon) graphiteWriter() {
-	lock := &sync.Mutex{}
-	connectTicker := s.Clock.Tick(2 * time.Second)
-	var conn net.Conn
-	var err error
-	go func() {
-		for range connectTicker {
-			lock.Lock()
-			if conn == nil {
-				conn, err = net.Dial("tcp", s.graphite_addr)
-				if err == nil {
-					log.Infof("now connected to %s", s.graphite_addr)
-				} else {
-					log.Warnf("dialing %s failed: %s. will retry", s.graphite_addr, err.Error())
-				}
-			}
-			lock.Unlock()
-		}
-	}()
-	for buf := range s.graphiteQueue {
-		lock.Lock()
-		haveConn := (conn != nil)
-		lock.Unlock()
-		for !haveConn {
-			s.Clock.Sleep(time.Second)
-			lock.Lock()
-			haveConn = (conn != nil)
-			lock.Unlock()
-		}
-		if log.IsLevelEnabled(log.DebugLevel) {
-			for _, line := range bytes.Split(buf, []byte("\n")) {
-				if len(line) == 0 {
-					continue
-				}
-				log.Debugf("writing %s", line)
-			}
-		}
-		ok := false
-		var duration float64
-		var pre time.Time
-		for !ok {
-			pre = s.Clock.Now()
-			lock.Lock()
-			_, err = conn.Write(buf)
-			if err == nil {
-				ok = true
-				duration = float64(s.Clock.Now().Sub(pre).Nanoseconds()) / float64(1000000)
-				log.Debug("wrote metrics payload to graphite!")
-			} else {
-				log.Errorf("failed to write to graphite: %s (took %s). will retry...", err, s.Clock.Now().Sub(pre))
-				conn.Close()
-				conn = nil
-				haveConn = false
-			}
-			lock.Unlock()
-			for !ok && !haveConn {
-				s.Clock.Sleep(2 * time.Second)
-				lock.Lock()
-				haveConn = (conn != nil)
-				lock.Unlock()
-			}
-		}
-		buf = buf[:0]
-		buf = out.WriteFloat64(buf, []byte(fmt.Sprintf("%s%smtype_is_gauge.type_is_send.unit_is_ms", s.fmt.Prefix_m20ne_gauges, s.fmt.PrefixInternal)), duration, pre.Unix())
-		ok = false
-		for !ok {
-			lock.Lock()
-			_, err = conn.Write(buf)
-			if err == nil {
-				ok = true
-				log.Debug("wrote sendtime to graphite!")
-			} else {
-				log.Errorf("failed to write mtype_is_gauge.type_is_send.unit_is_ms: %s. will retry...", err)
-				conn.Close()
-				conn = nil
-				haveConn = false
-			}
-			lock.Unlock()
-			for !ok && !haveConn {
-				s.Clock.Sleep(2 * time.Second)
-				lock.Lock()
-				haveConn = (conn != nil)
-				lock.Unlock()
-			}
-		}
-	}
-	lock.Lock()
-	if conn != nil {
-		conn.Close()
-	}
-	lock.Unlock()
+// MetricStats is one line of the result of a metric_stats request, covering the past 10s interval
+type MetricStats struct {
+	Bucket        string  `json:"bucket"`
+	SubmittedPerS float64 `json:"submitted_per_s"`
+	SeenPerS      float64 `json:"seen_per_s"`
 }
 
-// GraphiteQuepue invokes the processing function (instrumented) and enqueues data for writing to graphite
-func (s *StatsDaemon) GraphiteQueue(c *out.Counters, g *out.Gauges, t *out.Timers, deadline time.Time) {
-	buf := make([]byte, 0)
-
-	now := s.Clock.Now().Unix()
-	buf, _ = s.instrument(c, buf, now, "counter")
-	buf, _ = s.instrument(g, buf, now, "gauge")
-	buf, _ = s.instrument(t, buf, now, "timer")
-	s.graphiteQueue <- buf
+// ClientStats is one line of the result of a clients request, covering the past 10s interval
+type ClientStats struct {
+	Source      string  `json:"source"`
+	PacketsPerS float64 `json:"packets_per_s"`
+	LinesPerS   float64 `json:"lines_per_s"`
+	InvalidPerS float64 `json:"invalid_per_s"`
 }
 
-// Amounts is a datastructure to track numbers of packets, in particular:
-// * Submitted is "triggered" inside statsd client libs, not necessarily sent
-// * Seen is the amount we see. I.e. after sampling, network loss and udp packet drops
-type Amounts struct {
-	Submitted uint64
-	Seen      uint64
-}
+// defaultTopClients is how many clients a clients request lists by default
+const defaultTopClients = 20
 
 // metricsStatsMonitor basically maintains and guards the Amounts datastructures, and pulls
 // information out of it to satisfy requests.
@@ -538,6 +494,7 @@ type Amounts struct {
 // while having another so that at any time we have at least 10 seconds worth of data (upto 20s)
 // upon incoming requests we use the "old" buffer and the new one for the timeperiod it applies to.
 // (this way we have the absolute latest information)
+// it does the same for what each client sent, as read from the clientAmounts channel.
 func (s *StatsDaemon) metricStatsMonitor() {
 	period := 10 * time.Second
 	tick := s.Clock.Ticker(period)
@@ -547,6 +504,8 @@ func (s *StatsDaemon) metricStatsMonitor() {
 	_countsB := make(map[string]Amounts)
 	cur_counts := &_countsA
 	prev_counts := &_countsB
+	cur_clients := make(map[string]out.ClientAmounts)
+	prev_clients := make(map[string]out.ClientAmounts)
 	var swap_ts time.Time
 	for {
 		select {
@@ -554,7 +513,17 @@ func (s *StatsDaemon) metricStatsMonitor() {
 			prev_counts = cur_counts
 			new_counts := make(map[string]Amounts)
 			cur_counts = &new_counts
+			prev_clients = cur_clients
+			cur_clients = make(map[string]out.ClientAmounts)
 			swap_ts = s.Clock.Now()
+		case clients := <-s.clientAmounts:
+			for _, client := range clients {
+				el := cur_clients[client.Source]
+				el.Packets += client.Packets
+				el.Lines += client.Lines
+				el.Invalid += client.Invalid
+				cur_clients[client.Source] = el
+			}
 		case metrics := <-s.metricAmounts:
 			for _, metric := range metrics {
 				el, ok := (*cur_counts)[metric.Bucket]
@@ -568,7 +537,7 @@ func (s *StatsDaemon) metricStatsMonitor() {
 		case req := <-s.metricStatsRequests:
 			current_ts := s.Clock.Now()
 			interval := current_ts.Sub(swap_ts).Seconds() + 10
-			var buf []byte
+			var res interface{}
 			switch req.Command[0] {
 			case "sample_rate":
 				bucket := req.Command[1]
@@ -587,14 +556,54 @@ func (s *StatsDaemon) metricStatsMonitor() {
 				if uint64(submitted_per_s) > s.max_timers_per_s {
 					ideal_sample_rate = float64(s.max_timers_per_s) / submitted_per_s
 				}
-				buf = append(buf, []byte(fmt.Sprintf("%s %f %f\n", bucket, ideal_sample_rate, submitted_per_s))...)
+				res = SampleRate{bucket, ideal_sample_rate, submitted_per_s}
 				// this needs to be less realtime, so for simplicity (and performance?) we just use the prev 10s bucket.
 			case "metric_stats":
+				stats := make([]MetricStats, 0, len(*prev_counts))
 				for bucket, el := range *prev_counts {
-					buf = append(buf, []byte(fmt.Sprintf("%s %f %f\n", bucket, float64(el.Submitted)/10, float64(el.Seen)/10))...)
+					stats = append(stats, MetricStats{bucket, float64(el.Submitted) / 10, float64(el.Seen) / 10})
+				}
+				sort.Slice(stats, func(i, j int) bool { return stats[i].Bucket < stats[j].Bucket })
+				res = stats
+			case "clients":
+				top := defaultTopClients
+				if len(req.Command) > 1 {
+					top, _ = strconv.Atoi(req.Command[1])
+				}
+				stats := make([]ClientStats, 0, len(prev_clients))
+				for source, el := range prev_clients {
+					stats = append(stats, ClientStats{source, float64(el.Packets) / 10, float64(el.Lines) / 10, float64(el.Invalid) / 10})
 				}
+				// the top senders first
+				sort.Slice(stats, func(i, j int) bool {
+					if stats[i].LinesPerS != stats[j].LinesPerS {
+						return stats[i].LinesPerS > stats[j].LinesPerS
+					}
+					return stats[i].Source < stats[j].Source
+				})
+				if top > 0 && len(stats) > top {
+					stats = stats[:top]
+				}
+				res = stats
+			}
+			if req.Reply != nil {
+				req.Reply <- res
+				continue
 			}
 
+			var buf []byte
+			switch res := res.(type) {
+			case SampleRate:
+				buf = append(buf, []byte(fmt.Sprintf("%s %f %f\n", res.Bucket, res.IdealSampleRate, res.SubmittedPerS))...)
+			case []MetricStats:
+				for _, el := range res {
+					buf = append(buf, []byte(fmt.Sprintf("%s %f %f\n", el.Bucket, el.SubmittedPerS, el.SeenPerS))...)
+				}
+			case []ClientStats:
+				for _, el := range res {
+					buf = append(buf, []byte(fmt.Sprintf("%s %f %f %f\n", el.Source, el.PacketsPerS, el.LinesPerS, el.InvalidPerS))...)
+				}
+			}
 			go s.handleApiRequest(*req.Conn, buf)
 		}
 	}
@@ -610,8 +619,18 @@ commands:
                                 <key> <Pckt/s sent (estim)> <Pckt/s received>
     peek_valid                  stream all valid lines seen in real time
                                 until you disconnect or can't keep up.
-    peek_invalid                stream all invalid lines seen in real time
-                                until you disconnect or can't keep up.
+    clients [<n>]               in the past 10s interval, for the top n (default 20, 0 for all)
+                                senders show:
+                                <source> <Pckt/s> <Lines/s> <Invalid lines/s>
+                                a source is an ip address, or a tcp/unix connection.
+    peek_invalid [source]       stream all invalid lines seen in real time
+                                until you disconnect or can't keep up, as:
+                                [<source>] <reason> <line>
+                                the source that sent the line is only shown if requested.
+    rules_test <line>           apply the filter rules to the metrics of a statsd line, and show
+                                which rules match and what they are aggregated as.
+    bucket_limits               for every bucket limit, show for the last interval:
+                                <limit> <buckets>/<max> <metrics rejected>
     wait_flush                  after the next flush, writes 'flush' and closes connection.
                                 this is convenient to restart statsdaemon
                                 with a minimal loss of data like so:
@@ -654,7 +673,7 @@ func (s *StatsDaemon) handleApiRequest(conn net.Conn, write_first []byte) {
 				writeHelp(conn)
 				continue
 			}
-			s.metricStatsRequests <- metricsStatsReq{command, &conn}
+			s.metricStatsRequests <- metricsStatsReq{Command: command, Conn: &conn}
 			return
 		case "metric_stats":
 			if len(command) != 1 {
@@ -662,14 +681,60 @@ func (s *StatsDaemon) handleApiRequest(conn net.Conn, write_first []byte) {
 				writeHelp(conn)
 				continue
 			}
-			s.metricStatsRequests <- metricsStatsReq{command, &conn}
+			s.metricStatsRequests <- metricsStatsReq{Command: command, Conn: &conn}
+			return
+		case "clients":
+			if len(command) > 2 {
+				conn.Write([]byte("invalid request\n"))
+				writeHelp(conn)
+				continue
+			}
+			if len(command) == 2 {
+				if n, err := strconv.Atoi(command[1]); err != nil || n < 0 {
+					conn.Write([]byte("invalid request\n"))
+					writeHelp(conn)
+					continue
+				}
+			}
+			s.metricStatsRequests <- metricsStatsReq{Command: command, Conn: &conn}
 			return
+		case "rules_test":
+			if len(command) != 2 {
+				conn.Write([]byte("invalid request\n"))
+				writeHelp(conn)
+				continue
+			}
+			results, err := s.dryRun(command[1], "")
+			if err != nil {
+				conn.Write([]byte(err.Error() + "\n"))
+				continue
+			}
+			for _, res := range results {
+				for _, m := range res.Matches {
+					conn.Write([]byte(fmt.Sprintf("%s matches %s\n", m.Bucket, m.Rule)))
+				}
+				if res.Kept {
+					conn.Write([]byte(fmt.Sprintf("%s kept as %s\n", res.Bucket, res.Result)))
+				} else {
+					conn.Write([]byte(fmt.Sprintf("%s dropped\n", res.Bucket)))
+				}
+			}
+		case "bucket_limits":
+			for _, l := range s.limiter.stats() {
+				conn.Write([]byte(fmt.Sprintf("%s %d/%d %d\n", l.Limit, l.Buckets, l.Max, int64(l.Rejected))))
+			}
 		case "peek_invalid":
+			if len(command) > 2 || (len(command) == 2 && command[1] != "source") {
+				conn.Write([]byte("invalid request\n"))
+				writeHelp(conn)
+				continue
+			}
+			withSource := len(command) == 2
 			consumer := make(chan interface{}, 100)
 			s.Invalid_lines.Register(consumer)
 			conn.(*net.TCPConn).SetNoDelay(false)
 			for line := range consumer {
-				conn.Write(line.([]byte))
+				conn.Write(invalidLine(line.(out.InvalidLine), withSource))
 				conn.Write([]byte("\n"))
 			}
 			conn.(*net.TCPConn).SetNoDelay(true)
@@ -699,6 +764,17 @@ func (s *StatsDaemon) handleApiRequest(conn net.Conn, write_first []byte) {
 		}
 	}
 }
+
+// invalidLine formats an invalid line for peek_invalid: prefixed with the reason why it is invalid,
+// and optionally its source before that
+func invalidLine(line out.InvalidLine, withSource bool) []byte {
+	prefix := line.Reason + " "
+	if withSource {
+		prefix = line.Source + " " + prefix
+	}
+	return append([]byte(prefix), line.Line...)
+}
+
 func (s *StatsDaemon) adminListener() {
 	l, err := net.Listen("tcp", s.admin_addr)
 	if err != nil {
@@ -2,8 +2,14 @@ package statsdaemon
 
 import (
 	"fmt"
+	"math"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -11,7 +17,9 @@ import (
 	"github.com/bmizerany/assert"
 	"github.com/raintank/statsdaemon/common"
 	"github.com/raintank/statsdaemon/out"
+	"github.com/raintank/statsdaemon/rules"
 	"github.com/raintank/statsdaemon/udp"
+	log "github.com/sirupsen/logrus"
 )
 
 var output = out.NullOutput()
@@ -23,6 +31,7 @@ var formatM1Legacy = out.Formatter{
 	Prefix_counters:  "stats_counts.",
 	Prefix_timers:    "stats.timers.",
 	Prefix_gauges:    "stats.gauges.",
+	Prefix_sets:      "stats.sets.",
 }
 
 var formatM1Recommended = out.Formatter{
@@ -32,6 +41,7 @@ var formatM1Recommended = out.Formatter{
 	Prefix_counters:  "stats.counters.",
 	Prefix_timers:    "stats.timers.",
 	Prefix_gauges:    "stats.gauges.",
+	Prefix_sets:      "stats.sets.",
 }
 
 var formatM20 = out.Formatter{
@@ -48,6 +58,33 @@ var formatM20NE = out.Formatter{
 	Prefix_m20ne_timers:   "timers-2NE.",
 }
 
+// testConfig returns the settings that the tests create a daemon with, see testSettings
+func testConfig() Config {
+	return Config{
+		Formatter: formatM1Legacy,
+		Backends: BackendConfig{
+			Names:                   []string{"graphite"},
+			GraphiteProtocol:        "plaintext",
+			GraphitePickleBatchSize: 1,
+			GraphiteRouting:         "hash",
+			TsdbgwAddr:              "localhost:8081",
+			TsdbgwApiKey:            "unsecure",
+			InfluxdbBatchSize:       1,
+			OpentsdbBatchSize:       1,
+		},
+	}
+}
+
+func testSettings() Settings {
+	return Settings{
+		SetHllThreshold: 10000,
+		FlushInterval:   10,
+		Shards:          1,
+		MaxTimersPerS:   1000,
+		Orgid:           1,
+	}
+}
+
 func TestPacketParse(t *testing.T) {
 	d := []byte("gaugor:333|g")
 	packets := udp.ParseMessage(d, formatM1Legacy.PrefixInternal, output, udp.ParseLine)
@@ -118,17 +155,16 @@ func TestPacketParse(t *testing.T) {
 	assert.Equal(t, "g", packet.Modifier)
 	assert.Equal(t, float32(1), packet.Sampling)
 
-	errors_key := "internal.mtype_is_count.type_is_invalid_line.unit_is_Err"
 	d = []byte("a.key.with-0.dash:4\ngauge3|g")
 	packets = udp.ParseMessage(d, formatM1Legacy.PrefixInternal, output, udp.ParseLine)
 	assert.Equal(t, len(packets), 2)
-	assert.Equal(t, packets[0].Bucket, errors_key)
-	assert.Equal(t, packets[1].Bucket, errors_key)
+	assert.Equal(t, packets[0].Bucket, "internal.mtype_is_count.type_is_invalid_line.reason_is_missing_value_sep.unit_is_Err")
+	assert.Equal(t, packets[1].Bucket, "internal.mtype_is_count.type_is_invalid_line.reason_is_missing_key_sep.unit_is_Err")
 
 	d = []byte("a.key.with-0.dash:4")
 	packets = udp.ParseMessage(d, formatM1Legacy.PrefixInternal, output, udp.ParseLine)
 	assert.Equal(t, len(packets), 1)
-	assert.Equal(t, packets[0].Bucket, errors_key)
+	assert.Equal(t, packets[0].Bucket, "internal.mtype_is_count.type_is_invalid_line.reason_is_missing_value_sep.unit_is_Err")
 }
 
 func processTimer(ti *out.Timers, input string, f out.Formatter) (string, int64) {
@@ -136,8 +172,8 @@ func processTimer(ti *out.Timers, input string, f out.Formatter) (string, int64)
 	for _, p := range packets {
 		ti.Add(p)
 	}
-	buf, num := ti.Process(nil, time.Now().Unix(), 10, f)
-	return string(buf), num
+	points, num := ti.Process(nil, time.Now().Unix(), 10, f)
+	return string(out.WriteGraphite(nil, points)), num
 }
 
 func processCounter(cnt *out.Counters, input string, f out.Formatter) (string, int64) {
@@ -146,8 +182,8 @@ func processCounter(cnt *out.Counters, input string, f out.Formatter) (string, i
 		cnt.Add(p)
 	}
 
-	buf, num := cnt.Process(nil, 1, 10, f)
-	return string(buf), num
+	points, num := cnt.Process(nil, 1, 10, f)
+	return string(out.WriteGraphite(nil, points)), num
 }
 
 func TestTimerM1(t *testing.T) {
@@ -234,6 +270,143 @@ func TestCountersM1Legacy(t *testing.T) {
 	assert.Equal(t, "stats_counts.logins 6 1\nstats.logins 0.6 1\n", dataForGraphite)
 }
 
+func TestCountersTags(t *testing.T) {
+	cnt := out.NewCounters(true, true)
+	dataForGraphite, num := processCounter(cnt, "logins:1|c|#env:prod\nlogins:2|c|#region:eu,env:prod\nlogins:3|c|#env:prod", formatM1Recommended)
+
+	assert.Equal(t, num, int64(2))
+	exps := []string{
+		"stats.counters.logins.count;env=prod 4 1\n",
+		"stats.counters.logins.rate;env=prod 0.4 1\n",
+		"stats.counters.logins.count;env=prod;region=eu 2 1\n",
+		"stats.counters.logins.rate;env=prod;region=eu 0.2 1\n",
+	}
+	for _, exp := range exps {
+		if !strings.Contains(dataForGraphite, exp) {
+			t.Fatalf("output %q does not contain %q", dataForGraphite, exp)
+		}
+	}
+}
+
+func TestTimerTags(t *testing.T) {
+	got, num := processTimer(out.NewTimers(out.Percentiles{}), "direction_is_out.unit_is_ms.mtype_is_gauge:0|ms|#env:prod\ndirection_is_out.unit_is_ms.mtype_is_gauge:30|ms|#env:prod", formatM20NE)
+	assert.Equal(t, num, int64(1))
+	exp := "timers-2NE.direction_is_out.unit_is_ms.mtype_is_gauge.stat_is_mean;env=prod 15 "
+	if !strings.Contains(got, exp) {
+		t.Fatalf("output %q does not contain %q", got, exp)
+	}
+}
+
+func TestTimerTDigestM1(t *testing.T) {
+	pct, _ := out.NewPercentiles("75")
+	got, num := processTimer(out.NewTDigestTimers(*pct, 100), "response_time:0|ms\nresponse_time:30|ms\nresponse_time:30|ms", formatM1Legacy)
+	assert.Equal(t, num, int64(1))
+	exps := []string{
+		"stats.timers.response_time.mean 20 ",
+		"stats.timers.response_time.sum 60 ",
+		"stats.timers.response_time.lower 0 ",
+		"stats.timers.response_time.upper 30 ",
+		"stats.timers.response_time.upper_75 30 ",
+		"stats.timers.response_time.mean_75 15 ",
+		"stats.timers.response_time.median 30 ",
+		"stats.timers.response_time.std 14.142135623730951 ",
+		"stats.timers.response_time.count 3 ",
+	}
+	for _, exp := range exps {
+		if !strings.Contains(got, exp) {
+			t.Fatalf("output %q does not contain %q", got, exp)
+		}
+	}
+}
+
+// parseOutput parses graphite lines into a map of key to value
+func parseOutput(t *testing.T, buf []byte) map[string]float64 {
+	values := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		fields := strings.Fields(line)
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			t.Fatalf("bad line %q: %s", line, err)
+		}
+		values[fields[0]] = v
+	}
+	return values
+}
+
+func TestTimerTDigestAccuracy(t *testing.T) {
+	metrics := getSameTimers(100000)
+	pct, _ := out.NewPercentiles("99,90,-10")
+	exact := out.NewTimers(*pct)
+	digest := out.NewTDigestTimers(*pct, 100)
+	for i := range metrics {
+		exact.Add(&metrics[i])
+		digest.Add(&metrics[i])
+	}
+	pointsExact, _ := exact.Process(nil, 1, 10, formatM1Legacy)
+	pointsDigest, _ := digest.Process(nil, 1, 10, formatM1Legacy)
+	exp := parseOutput(t, out.WriteGraphite(nil, pointsExact))
+	got := parseOutput(t, out.WriteGraphite(nil, pointsDigest))
+	assert.Equal(t, len(got), len(exp))
+
+	// these are tracked exactly, modulo float rounding due to the order of summing
+	for _, stat := range []string{"count", "count_ps", "lower", "upper", "sum", "mean", "std"} {
+		key := "stats.timers.timer." + stat
+		if math.Abs(got[key]-exp[key]) > 1e-9*math.Abs(exp[key]) {
+			t.Fatalf("%s: expected %v, got %v", key, exp[key], got[key])
+		}
+	}
+	// the values are uniformly distributed between 0 and 1, so an absolute error bound will do
+	for _, stat := range []string{"median", "upper_99", "mean_99", "sum_99", "upper_90", "mean_90", "lower_10", "mean_10"} {
+		key := "stats.timers.timer." + stat
+		tolerance := 0.005
+		if strings.HasPrefix(stat, "sum_") {
+			tolerance *= exp["stats.timers.timer.count"]
+		}
+		if math.Abs(got[key]-exp[key]) > tolerance {
+			t.Fatalf("%s: expected %v, got %v", key, exp[key], got[key])
+		}
+	}
+}
+
+func TestMetricDataTags(t *testing.T) {
+	g := out.NewGauges()
+	g.Add(&common.Metric{Bucket: "temperature", Value: 21.5, Tags: []string{"env=prod", "region=eu"}, Sampling: 1})
+	points, _ := g.Process(nil, 1500000000, 10, formatM1Legacy)
+	metrics := metricData(points, 10, 1)
+	assert.Equal(t, len(metrics), 1)
+	assert.Equal(t, metrics[0].Name, "stats.gauges.temperature")
+	assert.Equal(t, metrics[0].Tags, []string{"env=prod", "region=eu"})
+	assert.Equal(t, metrics[0].Value, 21.5)
+	assert.Equal(t, metrics[0].Time, int64(1500000000))
+	assert.Equal(t, metrics[0].Mtype, "gauge")
+	assert.Equal(t, metrics[0].Unit, "unknown")
+}
+
+func TestMetricDataMetrics20(t *testing.T) {
+	pct, _ := out.NewPercentiles("90")
+	ti := out.NewTimers(*pct)
+	ti.Add(&common.Metric{Bucket: "service_is_api.unit_is_ms.mtype_is_gauge", Value: 10, Sampling: 1})
+	c := out.NewCounters(true, true)
+	c.Add(&common.Metric{Bucket: "service_is_api.unit_is_Req.mtype_is_count", Value: 10, Sampling: 1})
+	points, _ := ti.Process(nil, 1500000000, 10, formatM20NE)
+	points, _ = c.Process(points, 1500000000, 10, formatM20NE)
+
+	got := make(map[string][2]string)
+	for _, md := range metricData(points, 10, 1) {
+		got[md.Name] = [2]string{md.Mtype, md.Unit}
+	}
+	for name, exp := range map[string][2]string{
+		"timers-2NE.service_is_api.unit_is_ms.mtype_is_gauge.stat_is_max_90":                                      {"gauge", "ms"},
+		"timers-2NE.service_is_api.unit_is_Pckt.mtype_is_count.orig_unit_is_ms.pckt_type_is_sent.direction_is_in": {"count", "Pckt"},
+		"counters-2NE.service_is_api.unit_is_Req.mtype_is_count":                                                  {"count", "Req"},
+		"rates-2NE.service_is_api.unit_is_Reqps.mtype_is_rate":                                                    {"rate", "Reqps"},
+	} {
+		if got[name] != exp {
+			t.Fatalf("%s: expected mtype and unit %v, got %v (all: %v)", name, exp, got[name], got)
+		}
+	}
+}
+
 func TestCountersM1LegacyFlushCountsFalse(t *testing.T) {
 	cnt := out.NewCounters(true, false)
 	dataForGraphite, num := processCounter(cnt, "logins:1|c\nlogins:2|c\nlogins:3|c", formatM1Legacy)
@@ -242,6 +415,427 @@ func TestCountersM1LegacyFlushCountsFalse(t *testing.T) {
 	assert.Equal(t, "stats.logins 0.6 1\n", dataForGraphite)
 }
 
+func processSets(sets *out.Sets, input string, f out.Formatter) (string, int64) {
+	packets := udp.ParseMessage([]byte(input), "", output, udp.ParseLine)
+	for _, p := range packets {
+		sets.Add(p)
+	}
+
+	points, num := sets.Process(nil, 1, 10, f)
+	return string(out.WriteGraphite(nil, points)), num
+}
+
+func TestSetsM1(t *testing.T) {
+	got, num := processSets(out.NewSets(100), "users:alice|s\nusers:bob|s\nusers:alice|s", formatM1Legacy)
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, "stats.sets.users.count 2 1\n", got)
+}
+
+func TestSetsM20(t *testing.T) {
+	got, num := processSets(out.NewSets(100), "what=users.unit=User.mtype=gauge:alice|s\nwhat=users.unit=User.mtype=gauge:bob|s", formatM20)
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, "what=users.unit=User.mtype=count.stat=count_unique 2 1\n", got)
+
+	got, num = processSets(out.NewSets(100), "what_is_users.unit_is_User:alice|s", formatM20NE)
+	assert.Equal(t, num, int64(1))
+	assert.Equal(t, "what_is_users.unit_is_User.mtype_is_count.stat_is_count_unique 1 1\n", got)
+}
+
+func TestSetsHyperLogLog(t *testing.T) {
+	sets := out.NewSets(1000)
+	for i := 0; i < 100000; i++ {
+		sets.Add(&common.Metric{Bucket: "users", SetValue: strconv.Itoa(i % 50000), Modifier: "s", Sampling: 1})
+	}
+	count := sets.Values["users"].Count()
+	// standard error is about 0.8%, allow for 3 sigma
+	if count < 48800 || count > 51200 {
+		t.Fatalf("expected estimate close to 50000, got %d", count)
+	}
+}
+
+func processHistograms(h *out.Histograms, input string, f out.Formatter) (string, int64) {
+	packets := udp.ParseMessage([]byte(input), "", output, udp.ParseLine)
+	for _, p := range packets {
+		h.Add(p)
+	}
+
+	points, num := h.Process(nil, 1, 10, f)
+	return string(out.WriteGraphite(nil, points)), num
+}
+
+func TestHistogramSpecs(t *testing.T) {
+	specs, err := out.NewHistogramSpecs("api.latency:100,500,inf;:0.5")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(*specs), 2)
+	assert.Equal(t, (*specs)[0].String(), "api.latency:lt_100,lt_500,inf")
+	assert.Equal(t, (*specs)[1].String(), ":lt_0_5,inf")
+
+	for _, bad := range []string{"api.latency", "api.latency:", "api.latency:500,100", "api.latency:inf,100", "api.latency:foo"} {
+		_, err := out.NewHistogramSpecs(bad)
+		if err == nil {
+			t.Fatalf("expected error for histogram spec %q", bad)
+		}
+	}
+}
+
+func TestHistogramsM1(t *testing.T) {
+	specs, _ := out.NewHistogramSpecs("api.latency:100,500")
+	got, num := processHistograms(out.NewHistograms(*specs), "api.latency:50|ms\napi.latency:100|h\napi.latency:700|ms|@0.5\nother:50|ms", formatM1Legacy)
+	assert.Equal(t, num, int64(1))
+	exps := []string{
+		"stats.timers.api.latency.histogram.bin_lt_100 1 1\n",
+		"stats.timers.api.latency.histogram.bin_lt_500 2 1\n",
+		"stats.timers.api.latency.histogram.bin_inf 4 1\n",
+	}
+	for _, exp := range exps {
+		if !strings.Contains(got, exp) {
+			t.Fatalf("output %q does not contain %q", got, exp)
+		}
+	}
+}
+
+func TestHistogramsM20(t *testing.T) {
+	specs, _ := out.NewHistogramSpecs(":10")
+	got, num := processHistograms(out.NewHistograms(*specs), "direction=out.unit=ms.mtype=gauge:5|h", formatM20)
+	assert.Equal(t, num, int64(1))
+	exps := []string{
+		"timers-2.direction=out.unit=ms.mtype=count.stat=bin_lt_10 1 1\n",
+		"timers-2.direction=out.unit=ms.mtype=count.stat=bin_inf 1 1\n",
+	}
+	for _, exp := range exps {
+		if !strings.Contains(got, exp) {
+			t.Fatalf("output %q does not contain %q", got, exp)
+		}
+	}
+}
+
+func TestGaugesDelta(t *testing.T) {
+	d := []byte("queue:10|g\nqueue:+5|g\nqueue:-3|g\nqueue2:-3|g")
+	packets := udp.ParseMessage(d, "", output, udp.ParseLine)
+
+	g := out.NewGauges()
+	for _, p := range packets {
+		g.Add(p)
+	}
+	assert.Equal(t, g.Values["queue"], float64(12))
+	assert.Equal(t, g.Values["queue2"], float64(-3))
+}
+
+func TestGaugesCarryOver(t *testing.T) {
+	g := out.NewGauges()
+	g.Add(&common.Metric{Bucket: "a", Value: 1, Modifier: "g", Sampling: 1})
+	g.Add(&common.Metric{Bucket: "b", Value: 2, Modifier: "g", Sampling: 1})
+
+	g = g.CarryOver(2)
+	g.Add(&common.Metric{Bucket: "a", Value: 1, Relative: true, Modifier: "g", Sampling: 1})
+	assert.Equal(t, g.Values, map[string]float64{"a": 2, "b": 2})
+
+	// b wasn't updated for 2 intervals now, which is still within the limit
+	g = g.CarryOver(2)
+	assert.Equal(t, g.Values, map[string]float64{"a": 2, "b": 2})
+
+	g = g.CarryOver(2)
+	assert.Equal(t, g.Values, map[string]float64{"a": 2})
+
+	g = g.CarryOver(2)
+	assert.Equal(t, g.Values, map[string]float64{})
+
+	g.Add(&common.Metric{Bucket: "c", Value: 3, Modifier: "g", Sampling: 1})
+	for i := 0; i < 100; i++ {
+		g = g.CarryOver(0)
+	}
+	assert.Equal(t, g.Values, map[string]float64{"c": 3})
+}
+
+func TestGaugeExpiry(t *testing.T) {
+	settings := testSettings()
+	settings.GaugeExpiry = 30
+	daemon := New("test", testConfig(), settings, nil)
+	a := newAggregator(daemon)
+	a.add([]*common.Metric{{Bucket: "queue", Value: 10, Modifier: "g", Sampling: 1}})
+	a.take()
+	assert.Equal(t, a.g.Values, map[string]float64{"queue": 10})
+
+	// with 10s intervals, it would be kept for 2 more, but the expiry follows the flush interval
+	daemon.flushInterval = 30
+	a.take()
+	assert.Equal(t, a.g.Values, map[string]float64{})
+}
+
+func TestGaugesRetainedAcrossFlushes(t *testing.T) {
+	// with an unbuffered Metrics channel, a send returning means the previous flush (if any) is fully handled.
+	daemon := New("test", testConfig(), testSettings(), nil)
+	daemon.Clock = clock.NewMock()
+	flushes := make(chan map[string]float64)
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, sets *out.Sets, h *out.Histograms, deadline time.Time) {
+		flushes <- g.Values
+	}
+	go daemon.RunBare()
+
+	daemon.Metrics <- []*common.Metric{{Bucket: "queue", Value: 10, Modifier: "g", Sampling: 1}}
+	daemon.Clock.(*clock.Mock).Add(10 * time.Second)
+	assert.Equal(t, <-flushes, map[string]float64{"queue": 10})
+
+	daemon.Metrics <- []*common.Metric{{Bucket: "queue", Value: 5, Relative: true, Modifier: "g", Sampling: 1}}
+	daemon.Clock.(*clock.Mock).Add(10 * time.Second)
+	assert.Equal(t, <-flushes, map[string]float64{"queue": 15})
+
+	daemon.Metrics <- []*common.Metric{{Bucket: "other", Value: 1, Modifier: "c", Sampling: 1}}
+	daemon.Clock.(*clock.Mock).Add(10 * time.Second)
+	assert.Equal(t, <-flushes, map[string]float64{"queue": 15})
+}
+
+func TestShardedAggregation(t *testing.T) {
+	settings := testSettings()
+	settings.Shards = 4
+	daemon := New("test", testConfig(), settings, nil)
+	daemon.Clock = clock.NewMock()
+	type flush struct {
+		c map[string]float64
+		g map[string]float64
+		t int
+	}
+	flushes := make(chan flush)
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, sets *out.Sets, h *out.Histograms, deadline time.Time) {
+		flushes <- flush{c.Values, g.Values, len(t.Values)}
+	}
+	go daemon.RunBare()
+
+	expCounters := make(map[string]float64)
+	expGauges := make(map[string]float64)
+	for i := 0; i < 20; i++ {
+		counter := fmt.Sprintf("counter-%d", i)
+		gauge := fmt.Sprintf("gauge-%d", i)
+		daemon.Metrics <- []*common.Metric{
+			{Bucket: counter, Value: float64(i), Modifier: "c", Sampling: 1},
+			{Bucket: counter, Value: 1, Modifier: "c", Sampling: 1},
+			{Bucket: gauge, Value: float64(i), Modifier: "g", Sampling: 1},
+			{Bucket: gauge, Value: 1, Relative: true, Modifier: "g", Sampling: 1},
+			{Bucket: fmt.Sprintf("timer-%d", i), Value: 1, Modifier: "ms", Sampling: 1},
+		}
+		expCounters[counter] = float64(i + 1)
+		expGauges[gauge] = float64(i + 1)
+	}
+	expCounters["internal.direction_is_in.statsd_type_is_counter.mtype_is_count.unit_is_Metric"] = 40
+	expCounters["internal.direction_is_in.statsd_type_is_gauge.mtype_is_count.unit_is_Metric"] = 40
+	expCounters["internal.direction_is_in.statsd_type_is_timer.mtype_is_count.unit_is_Metric"] = 20
+	expCounters["internal.direction_is_in.statsd_type_is_set.mtype_is_count.unit_is_Metric"] = 0
+	expCounters["internal.direction_is_in.statsd_type_is_histogram.mtype_is_count.unit_is_Metric"] = 0
+
+	daemon.Clock.(*clock.Mock).Add(10 * time.Second)
+	got := <-flushes
+	assert.Equal(t, got.c, expCounters)
+	assert.Equal(t, got.g, expGauges)
+	assert.Equal(t, got.t, 20)
+
+	// gauges are carried over by the shard that owns them
+	daemon.Clock.(*clock.Mock).Add(10 * time.Second)
+	got = <-flushes
+	assert.Equal(t, got.g, expGauges)
+	assert.Equal(t, got.t, 0)
+}
+
+func TestShardedFilterAndLimits(t *testing.T) {
+	r, err := rules.Parse(strings.NewReader("rewrite ^user\\.[0-9]+\\. user.all. name=users\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits, err := NewBucketLimits(5, "", "", "drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig()
+	config.Rules = r
+	settings := testSettings()
+	settings.Shards = 4
+	settings.BucketLimits = limits
+	daemon := New("test", config, settings, nil)
+	daemon.Clock = clock.NewMock()
+	flushes := make(chan map[string]float64)
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, sets *out.Sets, h *out.Histograms, deadline time.Time) {
+		flushes <- c.Values
+	}
+	go daemon.RunBare()
+
+	// the users end up in the same bucket, even though they come in on different shards
+	for i := 0; i < 20; i++ {
+		daemon.Metrics <- []*common.Metric{{Bucket: fmt.Sprintf("user.%d.logins", i), Value: 1, Modifier: "c", Sampling: 1}}
+	}
+	// the limit applies to all shards together
+	for i := 0; i < 20; i++ {
+		daemon.Metrics <- []*common.Metric{{Bucket: fmt.Sprintf("counter-%d", i), Value: 1, Modifier: "c", Sampling: 1}}
+	}
+	daemon.Clock.(*clock.Mock).Add(10 * time.Second)
+	got := <-flushes
+	assert.Equal(t, got["user.all.logins"], 20.0)
+	assert.Equal(t, got["internal.mtype_is_count.type_is_rule_match.rule_is_users.unit_is_Metric"], 20.0)
+	assert.Equal(t, got["internal.mtype_is_count.type_is_bucket_limit.limit_is_global.unit_is_Metric"], 16.0)
+	counters := 0
+	for key := range got {
+		if strings.HasPrefix(key, "counter-") {
+			counters++
+		}
+	}
+	assert.Equal(t, counters, 4)
+	assert.Equal(t, daemon.limiter.stats(), []LimitStats{{Limit: "global", Max: 5, Buckets: 5, Rejected: 16}})
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	settings := testSettings()
+	settings.MaxUnprocessed = 10
+	daemon := New("test", testConfig(), settings, signals)
+	daemon.Clock = clock.NewMock()
+	flushes := make(chan map[string]float64, 1)
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, sets *out.Sets, h *out.Histograms, deadline time.Time) {
+		flushes <- c.Values
+	}
+	// a listener that still receives a metric after it is asked to stop
+	daemon.listen(func() {
+		<-daemon.stop
+		daemon.Metrics <- []*common.Metric{{Bucket: "late", Value: 1, Modifier: "c", Sampling: 1}}
+	})
+	done := make(chan struct{})
+	go func() {
+		daemon.RunBare()
+		close(done)
+	}()
+
+	daemon.Metrics <- []*common.Metric{{Bucket: "pending", Value: 1, Modifier: "c", Sampling: 1}}
+	signals <- syscall.SIGTERM
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for shutdown")
+	}
+	c := <-flushes
+	assert.Equal(t, c["pending"], 1.0)
+	assert.Equal(t, c["late"], 1.0)
+}
+
+func TestReload(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	config := testConfig()
+	config.FlushRates = true
+	daemon := New("test", config, testSettings(), signals)
+	daemon.Clock = clock.NewMock()
+	flushes := make(chan map[string]float64)
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, sets *out.Sets, h *out.Histograms, deadline time.Time) {
+		points, _ := c.Process(nil, 0, 10, daemon.fmt)
+		got := make(map[string]float64)
+		for _, p := range points {
+			got[p.Name] = p.Value
+		}
+		flushes <- got
+	}
+	reloaded := make(chan struct{})
+	daemon.ReloadFunc = func() (*Config, error) {
+		defer close(reloaded)
+		f := formatM1Legacy
+		f.Prefix_rates = "reloaded."
+		f.PrefixInternal = "ignored."
+		rule, _ := rules.ParseRule("rewrite ^foo$ bar", 1)
+		return &Config{
+			Rules:       rules.Rules{rule},
+			Formatter:   f,
+			FlushRates:  true,
+			FlushCounts: true,
+			LogLevel:    log.GetLevel(),
+			Backends:    daemon.backendConfig(),
+		}, nil
+	}
+	go daemon.RunBare()
+
+	daemon.Metrics <- []*common.Metric{{Bucket: "foo", Value: 10, Modifier: "c", Sampling: 1}}
+	signals <- syscall.SIGHUP
+	<-reloaded
+	// the interval in progress is flushed with the new prefixes, but was already counting without flush_counts,
+	// and without the rules
+	daemon.Clock.(*clock.Mock).Add(10 * time.Second)
+	got := <-flushes
+	assert.Equal(t, got["reloaded.foo"], 1.0)
+	_, ok := got["stats_counts.foo"]
+	assert.Equal(t, ok, false)
+	assert.Equal(t, daemon.fmt.PrefixInternal, "internal.")
+
+	daemon.Metrics <- []*common.Metric{{Bucket: "foo", Value: 10, Modifier: "c", Sampling: 1}}
+	daemon.Clock.(*clock.Mock).Add(10 * time.Second)
+	got = <-flushes
+	assert.Equal(t, got["reloaded.bar"], 1.0)
+	assert.Equal(t, got["stats_counts.bar"], 10.0)
+}
+
+// closedAddr returns an address that nothing listens on
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestReloadStopsBackends(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	config := testConfig()
+	config.FlushRates = true
+	config.Backends.TsdbgwAddr = ""
+	config.Backends.TsdbgwApiKey = ""
+	settings := testSettings()
+	settings.ShutdownTimeout = 100 * time.Millisecond
+	daemon := New("test", config, settings, signals)
+	daemon.Clock = clock.NewMock()
+	daemon.graphite_addr = closedAddr(t)
+	flushes := make(chan struct{})
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, sets *out.Sets, h *out.Histograms, deadline time.Time) {
+		daemon.Submit(c, g, t, sets, h, deadline)
+		flushes <- struct{}{}
+	}
+	var err error
+	daemon.backends, err = daemon.newBackends(daemon.backendNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range daemon.backends {
+		b.Start()
+	}
+	reloaded := make(chan struct{})
+	daemon.ReloadFunc = func() (*Config, error) {
+		defer close(reloaded)
+		c := daemon.backendConfig()
+		c.GraphiteAddr = closedAddr(t)
+		return &Config{
+			Formatter: formatM1Legacy,
+			LogLevel:  log.GetLevel(),
+			Backends:  c,
+		}, nil
+	}
+	go daemon.RunBare()
+
+	// the writer is stuck waiting for a connection
+	daemon.Metrics <- []*common.Metric{{Bucket: "foo", Value: 1, Modifier: "c", Sampling: 1}}
+	daemon.Clock.(*clock.Mock).Add(10 * time.Second)
+	<-flushes
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	signals <- syscall.SIGHUP
+	<-reloaded
+	daemon.Clock.(*clock.Mock).Add(10 * time.Second)
+	<-flushes
+
+	// once the old backend gave up, only the goroutines of the new one are left
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines after the reload, expected %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stopBackends(daemon.backends, 100*time.Millisecond)
+}
+
 func TestUpperPercentile(t *testing.T) {
 	d := []byte("time:0|ms\ntime:1|ms\ntime:2|ms\ntime:3|ms")
 	packets := udp.ParseMessage(d, "", output, udp.ParseLine)
@@ -253,12 +847,11 @@ func TestUpperPercentile(t *testing.T) {
 		ti.Add(p)
 	}
 
-	var buf []byte
-	buf, num := ti.Process(buf, time.Now().Unix(), 60, formatM1Legacy)
+	points, num := ti.Process(nil, time.Now().Unix(), 60, formatM1Legacy)
 	assert.Equal(t, num, int64(1))
 
 	exp := "stats.timers.time.upper_75 2 "
-	got := string(buf)
+	got := string(out.WriteGraphite(nil, points))
 	if !strings.Contains(got, exp) {
 		t.Fatalf("output %q does not contain %q", got, exp)
 	}
@@ -273,12 +866,12 @@ func TestMetrics20Count(t *testing.T) {
 		c.Add(p)
 	}
 
-	var buf []byte
-	var num int64
-	buf, n := c.Process(buf, time.Now().Unix(), 10, formatM20)
-	num += n
+	points, n := c.Process(nil, time.Now().Unix(), 10, formatM20)
+	assert.Equal(t, n, int64(1))
 
-	assert.T(t, strings.Contains(string(buf), "foo=bar.mtype=rate.unit=Bps 1.5"))
+	assert.T(t, strings.Contains(string(out.WriteGraphite(nil, points)), "foo=bar.mtype=rate.unit=Bps 1.5"))
+	assert.Equal(t, points[0].Mtype, "rate")
+	assert.Equal(t, points[0].Unit, "Bps")
 }
 
 func TestLowerPercentile(t *testing.T) {
@@ -292,15 +885,11 @@ func TestLowerPercentile(t *testing.T) {
 		ti.Add(p)
 	}
 
-	var buf []byte
-	var num int64
-	buf, n := ti.Process(buf, time.Now().Unix(), 10, formatM1Legacy)
-	num += n
-
+	points, num := ti.Process(nil, time.Now().Unix(), 10, formatM1Legacy)
 	assert.Equal(t, num, int64(1))
 
 	exp := "time.upper_75 1 "
-	got := string(buf)
+	got := string(out.WriteGraphite(nil, points))
 	if strings.Contains(got, exp) {
 		t.Fatalf("output %q contains %q", got, exp)
 	}
@@ -318,7 +907,7 @@ func BenchmarkDifferentCountersAddAndProcessM1Recommended(b *testing.B) {
 	for i := 0; i < len(metrics); i++ {
 		c.Add(&metrics[i])
 	}
-	c.Process(make([]byte, 0), time.Now().Unix(), 10, formatM1Recommended)
+	c.Process(nil, time.Now().Unix(), 10, formatM1Recommended)
 }
 
 func BenchmarkDifferentCountersAddAndProcessM1Legacy(b *testing.B) {
@@ -328,7 +917,7 @@ func BenchmarkDifferentCountersAddAndProcessM1Legacy(b *testing.B) {
 	for i := 0; i < len(metrics); i++ {
 		c.Add(&metrics[i])
 	}
-	c.Process(make([]byte, 0), time.Now().Unix(), 10, formatM1Legacy)
+	c.Process(nil, time.Now().Unix(), 10, formatM1Legacy)
 }
 
 func BenchmarkSameCountersAddAndProcessM1Recommended(b *testing.B) {
@@ -338,7 +927,7 @@ func BenchmarkSameCountersAddAndProcessM1Recommended(b *testing.B) {
 	for i := 0; i < len(metrics); i++ {
 		c.Add(&metrics[i])
 	}
-	c.Process(make([]byte, 0), time.Now().Unix(), 10, formatM1Recommended)
+	c.Process(nil, time.Now().Unix(), 10, formatM1Recommended)
 }
 
 func BenchmarkSameCountersAddAndProcessM1Legacy(b *testing.B) {
@@ -348,7 +937,7 @@ func BenchmarkSameCountersAddAndProcessM1Legacy(b *testing.B) {
 	for i := 0; i < len(metrics); i++ {
 		c.Add(&metrics[i])
 	}
-	c.Process(make([]byte, 0), time.Now().Unix(), 10, formatM1Legacy)
+	c.Process(nil, time.Now().Unix(), 10, formatM1Legacy)
 }
 
 func BenchmarkDifferentGaugesAddAndProcess(b *testing.B) {
@@ -358,7 +947,7 @@ func BenchmarkDifferentGaugesAddAndProcess(b *testing.B) {
 	for i := 0; i < len(metrics); i++ {
 		g.Add(&metrics[i])
 	}
-	g.Process(make([]byte, 0), time.Now().Unix(), 10, formatM1Legacy)
+	g.Process(nil, time.Now().Unix(), 10, formatM1Legacy)
 }
 
 func BenchmarkSameGaugesAddAndProcess(b *testing.B) {
@@ -368,7 +957,7 @@ func BenchmarkSameGaugesAddAndProcess(b *testing.B) {
 	for i := 0; i < len(metrics); i++ {
 		g.Add(&metrics[i])
 	}
-	g.Process(make([]byte, 0), time.Now().Unix(), 10, formatM1Legacy)
+	g.Process(nil, time.Now().Unix(), 10, formatM1Legacy)
 }
 
 func BenchmarkDifferentTimersAddAndProcess(b *testing.B) {
@@ -379,36 +968,75 @@ func BenchmarkDifferentTimersAddAndProcess(b *testing.B) {
 	for i := 0; i < len(metrics); i++ {
 		t.Add(&metrics[i])
 	}
-	t.Process(make([]byte, 0), time.Now().Unix(), 10, formatM1Legacy)
+	t.Process(nil, time.Now().Unix(), 10, formatM1Legacy)
 }
 
 func BenchmarkSameTimersAddAndProcess(b *testing.B) {
-	metrics := getSameTimers(b.N)
-	b.ResetTimer()
 	pct, _ := out.NewPercentiles("99")
-	t := out.NewTimers(*pct)
-	for i := 0; i < len(metrics); i++ {
-		t.Add(&metrics[i])
+	modes := []struct {
+		name      string
+		newTimers func() *out.Timers
+	}{
+		{"exact", func() *out.Timers { return out.NewTimers(*pct) }},
+		{"tdigest", func() *out.Timers { return out.NewTDigestTimers(*pct, 100) }},
+	}
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			metrics := getSameTimers(b.N)
+			b.ResetTimer()
+			t := mode.newTimers()
+			for i := 0; i < len(metrics); i++ {
+				t.Add(&metrics[i])
+			}
+			t.Process(nil, time.Now().Unix(), 10, formatM1Legacy)
+		})
 	}
-	t.Process(make([]byte, 0), time.Now().Unix(), 10, formatM1Legacy)
 }
 
 func BenchmarkIncomingMetrics(b *testing.B) {
-	daemon := New("test", formatM1Legacy, false, false, out.Percentiles{}, 10, 1000, 1000, nil,1, true, false, "localhost:8081", "unsecure")
+	// rules that don't match, so that all metrics are still counted, and limits that aren't hit
+	r, err := rules.Parse(strings.NewReader("deny ^foo\\.[0-9]+\\.bar$\nrewrite ^test-([a-z]+)-x$ test-$1\n"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	limits, err := NewBucketLimits(1000, "test-:100", "service:10", "drop")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			benchmarkIncomingMetrics(b, shards, nil, nil)
+		})
+		b.Run(fmt.Sprintf("shards-%d-rules-limits", shards), func(b *testing.B) {
+			benchmarkIncomingMetrics(b, shards, r, limits)
+		})
+	}
+}
+
+func benchmarkIncomingMetrics(b *testing.B, shards int, r rules.Rules, limits *BucketLimits) {
+	config := testConfig()
+	config.Rules = r
+	settings := testSettings()
+	settings.DeleteGauges = true
+	settings.MaxUnprocessed = 1000
+	settings.Shards = shards
+	settings.BucketLimits = limits
+	daemon := New("test", config, settings, nil)
 	daemon.Clock = clock.NewMock()
 	total := float64(0)
 	totalLock := sync.Mutex{}
-	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, deadline time.Time) {
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, sets *out.Sets, h *out.Histograms, deadline time.Time) {
 		totalLock.Lock()
 		total += c.Values["internal.direction_is_in.statsd_type_is_counter.mtype_is_count.unit_is_Metric"]
 		totalLock.Unlock()
 	}
 	go daemon.RunBare()
 	b.ResetTimer()
+	// spread the counters over different buckets, so they can be spread over the shards
 	counters := make([]*common.Metric, 10)
 	for i := 0; i < 10; i++ {
 		counters[i] = &common.Metric{
-			Bucket:   "test-counter",
+			Bucket:   fmt.Sprintf("test-counter-%d", i),
 			Value:    float64(1),
 			Modifier: "c",
 			Sampling: float32(1),
@@ -427,19 +1055,30 @@ func BenchmarkIncomingMetrics(b *testing.B) {
 			daemon.Clock.(*clock.Mock).Add(1 * time.Second)
 		}
 		daemon.Clock.(*clock.Mock).Add(10 * time.Second)
-		totalLock.Lock()
-		if total != float64(1000000) {
-			panic(fmt.Sprintf("didn't see 1M counters. only saw %f", total))
+		// the flush completes asynchronously, after all shards are drained
+		deadline := time.Now().Add(time.Second)
+		for {
+			totalLock.Lock()
+			seen := total
+			totalLock.Unlock()
+			if seen == float64(1000000) {
+				break
+			}
+			if time.Now().After(deadline) {
+				panic(fmt.Sprintf("didn't see 1M counters. only saw %f", seen))
+			}
+			time.Sleep(time.Millisecond)
 		}
-		totalLock.Unlock()
 	}
 
 }
-
 func BenchmarkIncomingMetricAmounts(b *testing.B) {
-	daemon := New("test", formatM1Legacy, false, false, out.Percentiles{}, 10, 1000, 1000, nil, 1, true, false, "localhost:8081", "unsecure")
+	settings := testSettings()
+	settings.DeleteGauges = true
+	settings.MaxUnprocessed = 1000
+	daemon := New("test", testConfig(), settings, nil)
 	daemon.Clock = clock.NewMock()
-	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, deadline time.Time) {
+	daemon.submitFunc = func(c *out.Counters, g *out.Gauges, t *out.Timers, sets *out.Sets, h *out.Histograms, deadline time.Time) {
 	}
 	go daemon.RunBare()
 	b.ResetTimer()
@@ -0,0 +1,173 @@
+// Package stream implements statsd listeners for stream sockets (tcp and unix),
+// where metrics are sent as newline delimited lines.
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+	"github.com/raintank/statsdaemon/udp"
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxLineSize is the longest line we accept. longer lines are treated as invalid
+const MaxLineSize = udp.MaxUdpPacketSize
+
+// connsInterval is how often the amount of open connections is reported
+const connsInterval = time.Second
+
+// stopGrace is how long open connections can still be read from after the listener is stopped
+const stopGrace = time.Second
+
+// UnixListener listens on a unix stream socket at path, replacing any stale socket file.
+func UnixListener(path, prefix_internal string, output *out.Output, parse func(line []byte) ([]*common.Metric, error)) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	Listener("unix", path, prefix_internal, output, parse)
+}
+
+// Listener accepts connections on a stream socket, and parses the lines sent over them,
+// feeding both the Metrics and the MetricAmounts channel, like udp.Listener.
+// it also reports the amount of accepted and open connections as internal metrics.
+// every connection is a client of its own, identified by its remote address, or for unix sockets,
+// where clients typically don't have one, by the number of the connection.
+// once output.Done is closed, it stops accepting connections, reads what the open ones send within stopGrace,
+// and returns when they're all closed.
+func Listener(network, listen_addr, prefix_internal string, output *out.Output, parse func(line []byte) ([]*common.Metric, error)) {
+	listener, err := net.Listen(network, listen_addr)
+	if err != nil {
+		log.Fatalf("listen %s - %s", network, err)
+	}
+	defer listener.Close()
+	log.Infof("listening on %s %s", network, listener.Addr())
+	go func() {
+		<-output.Done
+		listener.Close()
+	}()
+
+	var open int64
+	go reportConnections(network, prefix_internal, &open, output)
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	conns := make(map[net.Conn]struct{})
+	accepted := 0
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if output.Stopped() {
+				break
+			}
+			log.Errorf("accepting %s connection - %s", network, err)
+			continue
+		}
+		lock.Lock()
+		conns[conn] = struct{}{}
+		lock.Unlock()
+		accepted++
+		source := conn.RemoteAddr().String()
+		if source == "" || source == "@" {
+			source = fmt.Sprintf("%s#%d", network, accepted)
+		}
+		wg.Add(1)
+		atomic.AddInt64(&open, 1)
+		output.Metrics <- []*common.Metric{{
+			Bucket:   fmt.Sprintf("%smtype_is_count.type_is_connection.proto_is_%s.unit_is_Conn", prefix_internal, network),
+			Value:    float64(1),
+			Modifier: "c",
+			Sampling: float32(1),
+		}}
+		go func() {
+			handle(conn, source, prefix_internal, output, parse)
+			atomic.AddInt64(&open, -1)
+			lock.Lock()
+			delete(conns, conn)
+			lock.Unlock()
+			wg.Done()
+		}()
+	}
+	lock.Lock()
+	for conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(stopGrace))
+	}
+	lock.Unlock()
+	wg.Wait()
+}
+
+// reportConnections periodically reports the amount of open connections
+func reportConnections(network, prefix_internal string, open *int64, output *out.Output) {
+	bucket := fmt.Sprintf("%smtype_is_gauge.type_is_open_connection.proto_is_%s.unit_is_Conn", prefix_internal, network)
+	tick := time.NewTicker(connsInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-output.Done:
+			return
+		}
+		output.Metrics <- []*common.Metric{{
+			Bucket:   bucket,
+			Value:    float64(atomic.LoadInt64(open)),
+			Modifier: "g",
+			Sampling: float32(1),
+		}}
+	}
+}
+
+// handle reads lines from the connection until it is closed.
+// lines can span multiple reads, so we only process the data up to the last newline,
+// and keep the partial line for the next read.
+// what the client sent is reported under source.
+func handle(conn net.Conn, source, prefix_internal string, output *out.Output, parse func(line []byte) ([]*common.Metric, error)) {
+	defer conn.Close()
+	process := func(data []byte) {
+		client := out.ClientAmounts{Source: source}
+		metrics := udp.ParseClientMessage(data, &client, prefix_internal, output, parse)
+		output.Metrics <- metrics
+		output.MetricAmounts <- metrics
+		output.ReportClients([]out.ClientAmounts{client})
+	}
+	buf := make([]byte, MaxLineSize)
+	pending := 0
+	discard := false // whether we're skipping the remainder of a line that was too long
+	for {
+		n, err := conn.Read(buf[pending:])
+		data := buf[:pending+n]
+		if end := bytes.LastIndexByte(data, '\n'); end >= 0 {
+			if discard {
+				data = data[bytes.IndexByte(data, '\n')+1:]
+				end = bytes.LastIndexByte(data, '\n')
+				discard = false
+			}
+			if end >= 0 {
+				process(data[:end])
+			}
+			pending = copy(buf, data[end+1:])
+		} else {
+			pending = len(data)
+		}
+		if pending == len(buf) {
+			// the line is too long to ever fit. report the start of it as invalid, and skip the rest
+			if !discard {
+				process(buf)
+			}
+			pending = 0
+			discard = true
+		}
+		if err != nil {
+			// the last line doesn't need to be terminated
+			if pending > 0 && !discard {
+				process(buf[:pending])
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package stream
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+	"github.com/raintank/statsdaemon/udp"
+	"github.com/tv42/topic"
+)
+
+func newOutput() *out.Output {
+	output := &out.Output{
+		Metrics:       make(chan []*common.Metric, 100),
+		MetricAmounts: make(chan []*common.Metric, 100),
+		Clients:       make(chan []out.ClientAmounts, 100),
+		Valid_lines:   topic.New(),
+		Invalid_lines: topic.New(),
+	}
+	return output
+}
+
+// buckets returns the buckets of all metrics received until the timeout passes without new metrics
+func buckets(output *out.Output) []string {
+	var buckets []string
+	for {
+		select {
+		case metrics := <-output.Metrics:
+			for _, m := range metrics {
+				buckets = append(buckets, m.Bucket)
+			}
+		case <-time.After(100 * time.Millisecond):
+			return buckets
+		}
+	}
+}
+
+func TestHandlePartialLines(t *testing.T) {
+	client, server := net.Pipe()
+	output := newOutput()
+	go handle(server, "pipe", "internal.", output, udp.ParseLine2)
+
+	for _, chunk := range []string{"a:1|c\nb:", "2|c", "\nc:3|c\n\nd:4", "|c"} {
+		client.Write([]byte(chunk))
+	}
+	client.Close()
+
+	got := strings.Join(buckets(output), ",")
+	if got != "a,b,c,d" {
+		t.Fatalf("expected buckets a,b,c,d, got %s", got)
+	}
+}
+
+func TestHandleLongLine(t *testing.T) {
+	client, server := net.Pipe()
+	output := newOutput()
+	go handle(server, "pipe", "internal.", output, udp.ParseLine2)
+
+	go func() {
+		client.Write([]byte("a:1|c\n"))
+		client.Write([]byte("b:" + strings.Repeat("1", MaxLineSize+10) + "|c\n"))
+		client.Write([]byte("c:3|c\n"))
+		client.Close()
+	}()
+
+	got := strings.Join(buckets(output), ",")
+	exp := "a,internal.mtype_is_count.type_is_invalid_line.reason_is_missing_value_sep.unit_is_Err,c"
+	if got != exp {
+		t.Fatalf("expected buckets %s, got %s", exp, got)
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	dir, err := os.MkdirTemp("", "statsdaemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.sock")
+	output := newOutput()
+	go UnixListener(path, "internal.", output, udp.ParseLine2)
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		conn, err = net.Dial("unix", path)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("a:1|c\nb:2|c\n"))
+	conn.Close()
+
+	got := strings.Join(buckets(output), ",")
+	exp := "internal.mtype_is_count.type_is_connection.proto_is_unix.unit_is_Conn,a,b"
+	if got != exp {
+		t.Fatalf("expected buckets %s, got %s", exp, got)
+	}
+	// the lines may have been read in one go or not
+	lines := uint64(0)
+	for len(output.Clients) > 0 {
+		for _, client := range <-output.Clients {
+			if client.Source != "unix#1" {
+				t.Fatalf("expected client unix#1, got %s", client.Source)
+			}
+			lines += client.Lines
+		}
+	}
+	if lines != 2 {
+		t.Fatalf("expected 2 lines from the client, got %d", lines)
+	}
+}
+
+func TestListenerStop(t *testing.T) {
+	dir, err := os.MkdirTemp("", "statsdaemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.sock")
+	output := newOutput()
+	done := make(chan struct{})
+	output.Done = done
+	stopped := make(chan struct{})
+	go func() {
+		UnixListener(path, "internal.", output, udp.ParseLine2)
+		close(stopped)
+	}()
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		conn, err = net.Dial("unix", path)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	metrics := <-output.Metrics
+	if metrics[0].Bucket != "internal.mtype_is_count.type_is_connection.proto_is_unix.unit_is_Conn" {
+		t.Fatalf("unexpected metrics %v", metrics)
+	}
+
+	// the open connection is still read from, but the listener returns once the grace period is over
+	close(done)
+	conn.Write([]byte("a:1|c\n"))
+	select {
+	case <-stopped:
+	case <-time.After(stopGrace + 5*time.Second):
+		t.Fatal("listener didn't stop")
+	}
+	if _, err := net.Dial("unix", path); err == nil {
+		t.Fatal("listener still accepts connections")
+	}
+	got := strings.Join(buckets(output), ",")
+	if got != "a" {
+		t.Fatalf("expected buckets a, got %s", got)
+	}
+}
@@ -0,0 +1,137 @@
+package statsdaemon
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/raintank/schema"
+	"github.com/raintank/schema/msg"
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+	log "github.com/sirupsen/logrus"
+)
+
+// tsdbgwBackend submits the data to tsdb-gw as metrics 2.0 MetricData
+type tsdbgwBackend struct {
+	backendQueue
+	addr     string
+	apiKey   string
+	orgid    int
+	interval int
+	client   *http.Client
+}
+
+func newTsdbgwBackend(addr, apiKey string, orgid, interval int, prefixInternal string, internal chan<- []*common.Metric) *tsdbgwBackend {
+	var concurrency = 1       // number of concurrent connections to tsdb-gw, running statsdaemon in sidecar mode you probably only want 1
+	var timeout time.Duration // in ms
+	timeout = 10 * time.Second
+
+	// Most of this is copy paste from https://github.com/graphite-ng/carbon-relay-ng/blob/master/route/grafananet.go
+	// start off with a transport the same as Go's DefaultTransport
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          concurrency,
+		MaxIdleConnsPerHost:   concurrency,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+
+	// disable http 2.0 because there seems to be a compatibility problem between nginx hosts and the golang http2 implementation
+	// which would occasionally result in bogus `400 Bad Request` errors.
+	transport.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
+
+	return &tsdbgwBackend{
+		backendQueue: newBackendQueue("tsdbgw", "", prefixInternal, internal),
+		addr:         addr,
+		apiKey:       apiKey,
+		orgid:        orgid,
+		interval:     interval,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+		},
+	}
+}
+
+func (t *tsdbgwBackend) Start() {
+	log.Infof("starting tsdbgw writer")
+	go t.run()
+}
+
+// run is the background worker that writes the queued data to tsdbgw
+func (t *tsdbgwBackend) run() {
+	defer close(t.done)
+	buffer := new(bytes.Buffer)
+	for {
+		points, ok := t.next()
+		if !ok {
+			break
+		}
+		md := metricData(points, t.interval, t.orgid)
+		pre := time.Now()
+		if t.flush(md, buffer) {
+			t.sent(time.Since(pre))
+		} else {
+			t.dropped()
+		}
+	}
+}
+
+// metricData converts the points to metrics for tsdbgw
+func metricData(points []out.Point, interval, orgid int) []*schema.MetricData {
+	metrics := make([]*schema.MetricData, len(points))
+	for i, p := range points {
+		md := &schema.MetricData{
+			Name:     p.Name,
+			Interval: interval,
+			Value:    p.Value,
+			Unit:     p.Unit,
+			Time:     p.Time,
+			Mtype:    p.Mtype,
+			Tags:     p.Tags,
+			OrgId:    orgid,
+		}
+		md.SetId()
+		metrics[i] = md
+	}
+	log.Debugf("metrics created: %d", len(metrics))
+	return metrics
+}
+
+// flush encodes the metrics and posts them to tsdbgw, retrying until it succeeds, or tsdbgw rejects them.
+// it returns whether they were delivered.
+func (t *tsdbgwBackend) flush(metrics []*schema.MetricData, buffer *bytes.Buffer) bool {
+	if len(metrics) == 0 {
+		return true
+	}
+	data, err := msg.CreateMsg(metrics, int64(t.orgid), msg.FormatMetricDataArrayMsgp)
+	if err != nil {
+		log.Errorf("tsdbgw: cannot encode %d metrics, dropping them: %s", len(metrics), err)
+		return false
+	}
+	buffer.Reset()
+	snappyBody := snappy.NewBufferedWriter(buffer)
+	snappyBody.Write(data)
+	if err := snappyBody.Close(); err != nil {
+		log.Errorf("tsdbgw: cannot compress %d metrics, dropping them: %s", len(metrics), err)
+		return false
+	}
+	header := http.Header{}
+	header.Add("Authorization", "Bearer "+t.apiKey)
+	header.Add("Content-Type", "rt-metric-binary-snappy")
+	log.Debugf("sending to %s", t.addr)
+	return retryPost(t.client, t.name, t.addr, header, buffer.Bytes(), t.stop)
+}
@@ -0,0 +1,209 @@
+//go:build linux
+// +build linux
+
+package udp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// readBatchSize is the max amount of packets read at once
+const readBatchSize = 32
+
+// dropsInterval is how often the kernel drop counters are checked
+const dropsInterval = time.Second
+
+func listenConfig(reusePort bool) (net.ListenConfig, error) {
+	if !reusePort {
+		return net.ListenConfig{}, nil
+	}
+	return net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}, nil
+}
+
+// batchReader is what ipv4.PacketConn and ipv6.PacketConn have in common
+type batchReader interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// mmsgReader reads up to readBatchSize packets at once. on linux, x/net uses recvmmsg for that
+type mmsgReader struct {
+	conn    batchReader
+	msgs    []ipv4.Message
+	packets [][]byte
+	sources []netip.Addr
+}
+
+func newPacketReader(conn *net.UDPConn) (packetReader, error) {
+	r := &mmsgReader{
+		msgs:    make([]ipv4.Message, readBatchSize),
+		packets: make([][]byte, 0, readBatchSize),
+		sources: make([]netip.Addr, 0, readBatchSize),
+	}
+	// sockets on an ipv6 or unspecified address are dual stack
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		r.conn = ipv4.NewPacketConn(conn)
+	} else {
+		r.conn = ipv6.NewPacketConn(conn)
+	}
+	for i := range r.msgs {
+		r.msgs[i].Buffers = [][]byte{make([]byte, MaxUdpPacketSize)}
+	}
+	return r, nil
+}
+
+func (r *mmsgReader) ReadBatch() ([][]byte, []netip.Addr, error) {
+	n, err := r.conn.ReadBatch(r.msgs, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.packets = r.packets[:0]
+	r.sources = r.sources[:0]
+	for _, msg := range r.msgs[:n] {
+		r.packets = append(r.packets, msg.Buffers[0][:msg.N])
+		// ipv4 addresses mapped to ipv6, as seen on dual stack sockets, are reported as ipv4
+		var source netip.Addr
+		if addr, ok := msg.Addr.(*net.UDPAddr); ok {
+			source = addr.AddrPort().Addr().Unmap()
+		}
+		r.sources = append(r.sources, source)
+	}
+	return r.packets, r.sources, nil
+}
+
+// socketInode returns the inode of the socket, which identifies it in /proc/net/udp
+func socketInode(conn *net.UDPConn) (uint64, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var st unix.Stat_t
+	var statErr error
+	err = rc.Control(func(fd uintptr) {
+		statErr = unix.Fstat(int(fd), &st)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return st.Ino, statErr
+}
+
+// parseProcNetUDP reads the drop counters from /proc/net/udp or /proc/net/udp6 style content
+// into drops, keyed by socket inode
+func parseProcNetUDP(r io.Reader, drops map[uint64]uint64) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ref pointer drops
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			continue
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return err
+		}
+		d, err := strconv.ParseUint(fields[12], 10, 64)
+		if err != nil {
+			return err
+		}
+		drops[inode] = d
+	}
+	return scanner.Err()
+}
+
+func readDrops() (map[uint64]uint64, error) {
+	drops := make(map[uint64]uint64)
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = parseProcNetUDP(f, drops)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return drops, nil
+}
+
+// monitorDrops periodically reports the packets the kernel dropped for each socket
+// since the previous check, as internal metrics
+func monitorDrops(conns []*net.UDPConn, prefix_internal string, output *out.Output) {
+	inodes := make([]uint64, len(conns))
+	for i, conn := range conns {
+		inode, err := socketInode(conn)
+		if err != nil {
+			log.Errorf("cannot monitor drops of %s - %s", conn.LocalAddr(), err)
+			return
+		}
+		inodes[i] = inode
+	}
+	prev := make([]uint64, len(conns))
+	tick := time.NewTicker(dropsInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-output.Done:
+			return
+		}
+		drops, err := readDrops()
+		if err != nil {
+			log.Errorf("cannot read udp drops - %s", err)
+			continue
+		}
+		if metrics := newDrops(prefix_internal, inodes, prev, drops); len(metrics) > 0 {
+			output.Metrics <- metrics
+		}
+	}
+}
+
+// newDrops returns the drop metrics of the sockets since the previous readings in prev, and updates prev.
+// sockets that are missing from drops are skipped. when a counter went down, it was reset (the kernel's
+// counter is 32 bits, and wraps), so all of the new reading counts.
+func newDrops(prefix_internal string, inodes, prev []uint64, drops map[uint64]uint64) []*common.Metric {
+	var metrics []*common.Metric
+	for i, inode := range inodes {
+		cur, ok := drops[inode]
+		if !ok {
+			continue
+		}
+		n := cur - prev[i]
+		if cur < prev[i] {
+			n = cur
+		}
+		metrics = append(metrics, dropMetric(prefix_internal, i, n))
+		prev[i] = cur
+	}
+	return metrics
+}
@@ -0,0 +1,210 @@
+//go:build linux
+// +build linux
+
+package udp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
+	"github.com/tv42/topic"
+)
+
+func TestParseProcNetUDP(t *testing.T) {
+	in := `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000  1000        0 412345 2 0000000000000000 17
+  456: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 412346 2 0000000000000000 0
+`
+	drops := make(map[uint64]uint64)
+	err := parseProcNetUDP(strings.NewReader(in), drops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[uint64]uint64{412345: 17, 412346: 0}
+	if !reflect.DeepEqual(drops, exp) {
+		t.Fatalf("expected %v, got %v", exp, drops)
+	}
+}
+
+func TestNewDrops(t *testing.T) {
+	inodes := []uint64{1, 2, 3}
+	prev := []uint64{10, 4000000000, 5}
+	// socket 1 dropped 5 more, the counter of socket 2 wrapped, socket 3 is missing
+	metrics := newDrops("internal.", inodes, prev, map[uint64]uint64{1: 15, 2: 7})
+	got := make(map[string]float64)
+	for _, m := range metrics {
+		got[m.Bucket] = m.Value
+	}
+	exp := map[string]float64{
+		"internal.mtype_is_count.type_is_udp_drop.socket_is_0.unit_is_Pckt": 5,
+		"internal.mtype_is_count.type_is_udp_drop.socket_is_1.unit_is_Pckt": 7,
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+	if exp := []uint64{15, 7, 5}; !reflect.DeepEqual(prev, exp) {
+		t.Fatalf("expected previous readings %v, got %v", exp, prev)
+	}
+}
+
+func TestPacketReaderBatch(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	exp := []string{"a:1|c", "b:2|c", "c:3|c"}
+	for _, packet := range exp {
+		_, err = client.Write([]byte(packet))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := newPacketReader(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got []string
+	for len(got) < len(exp) {
+		packets, sources, err := r.ReadBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, packet := range packets {
+			got = append(got, string(packet))
+			if sources[i].String() != "127.0.0.1" {
+				t.Fatalf("expected source 127.0.0.1, got %s", sources[i])
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %q, got %q", exp, got)
+	}
+}
+
+func TestPacketReaderDualStack(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		t.Skipf("no ipv6: %s", err)
+	}
+	defer conn.Close()
+	client, err := net.Dial("udp4", fmt.Sprintf("127.0.0.1:%d", conn.LocalAddr().(*net.UDPAddr).Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("a:1|c"))
+
+	r, err := newPacketReader(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	packets, sources, err := r.ReadBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 1 || string(packets[0]) != "a:1|c" || sources[0].String() != "127.0.0.1" {
+		t.Fatalf("unexpected packets %q from %v", packets, sources)
+	}
+}
+
+func TestListenerReusePort(t *testing.T) {
+	// find a free port
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	output := &out.Output{
+		Metrics:       make(chan []*common.Metric, 100),
+		MetricAmounts: make(chan []*common.Metric, 100),
+		Valid_lines:   topic.New(),
+		Invalid_lines: topic.New(),
+	}
+	go Listener(addr, "", 4, 1<<20, output, ParseLine2)
+
+	// sockets aren't necessarily open yet, nor do we know which one receives our packets,
+	// so keep sending from different source ports until we receive something
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		client, err := net.Dial("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte("a:1|c"))
+		client.Close()
+		select {
+		case metrics := <-output.Metrics:
+			if len(metrics) != 1 || metrics[0].Bucket != "a" {
+				t.Fatalf("unexpected metrics %v", metrics)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("no metrics received")
+}
+
+func TestUnixgramListener(t *testing.T) {
+	dir, err := os.MkdirTemp("", "statsdaemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.sock")
+	output := &out.Output{
+		Metrics:       make(chan []*common.Metric, 100),
+		MetricAmounts: make(chan []*common.Metric, 100),
+		Clients:       make(chan []out.ClientAmounts, 100),
+		Valid_lines:   topic.New(),
+		Invalid_lines: topic.New(),
+	}
+	go UnixgramListener(path, "", output, ParseLine2)
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		conn, err = net.Dial("unixgram", path)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("a:1|c\nb:2|c"))
+
+	select {
+	case metrics := <-output.Metrics:
+		if len(metrics) != 2 || metrics[0].Bucket != "a" || metrics[1].Bucket != "b" {
+			t.Fatalf("unexpected metrics %v", metrics)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no metrics received")
+	}
+	clients := <-output.Clients
+	exp := []out.ClientAmounts{{Source: "unixgram", Packets: 1, Lines: 2}}
+	if !reflect.DeepEqual(clients, exp) {
+		t.Fatalf("expected %v, got %v", exp, clients)
+	}
+}
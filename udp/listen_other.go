@@ -0,0 +1,50 @@
+//go:build !linux
+// +build !linux
+
+package udp
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/raintank/statsdaemon/out"
+)
+
+func listenConfig(reusePort bool) (net.ListenConfig, error) {
+	if reusePort {
+		return net.ListenConfig{}, errors.New("multiple sockets are only supported on linux")
+	}
+	return net.ListenConfig{}, nil
+}
+
+// udpReader reads one packet at a time
+type udpReader struct {
+	conn    *net.UDPConn
+	buf     []byte
+	packets [][]byte
+	sources []netip.Addr
+}
+
+func newPacketReader(conn *net.UDPConn) (packetReader, error) {
+	return &udpReader{
+		conn:    conn,
+		buf:     make([]byte, MaxUdpPacketSize),
+		packets: make([][]byte, 1),
+		sources: make([]netip.Addr, 1),
+	}, nil
+}
+
+func (r *udpReader) ReadBatch() ([][]byte, []netip.Addr, error) {
+	n, addr, err := r.conn.ReadFromUDPAddrPort(r.buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.packets[0] = r.buf[:n]
+	r.sources[0] = addr.Addr().Unmap()
+	return r.packets, r.sources, nil
+}
+
+// monitorDrops is not supported outside of linux
+func monitorDrops(conns []*net.UDPConn, prefix_internal string, output *out.Output) {
+}
@@ -6,13 +6,25 @@ import (
 	"strconv"
 )
 
+// the lexer supports multiple values per line. each segment consists of one or more values,
+// separated by colons, followed by the modifier and optional sample rate, which apply to all of them.
+// segments are separated by colons as well. tags can only be specified at the end of the line
+// and apply to all values. e.g. key:1:2|ms|@0.5:3|ms|#tag:value
 type lexer struct {
-	input []byte
-	len   int
-	start int
-	pos   int
-	m     common.Metric
-	err   error
+	input   []byte
+	len     int
+	start   int
+	pos     int
+	vals    [][]byte      // values of the current segment, not interpreted yet
+	m       common.Metric // metric template for the current segment
+	tags    []string
+	metrics []*common.Metric
+	err     error
+
+	// storage for the common case of a single value per line, to avoid allocations
+	valsArr    [1][]byte
+	metricsArr [1]*common.Metric
+	first      common.Metric
 }
 
 // assumes we don't have \x00 bytes in input
@@ -31,18 +43,99 @@ func (l *lexer) run() {
 	for state := lexKeySep; state != nil; {
 		state = state(l)
 	}
-	if l.err == nil && l.m.Sampling == 0 {
+	if l.err == nil {
+		l.emit()
+	}
+	if l.err == nil && l.tags != nil {
+		for _, m := range l.metrics {
+			m.Tags = l.tags
+		}
+	}
+}
+
+// emit creates the metrics for the values of the current segment,
+// now that we know their modifier and sample rate
+func (l *lexer) emit() {
+	if l.m.Sampling == 0 {
 		l.m.Sampling = float32(1)
 	}
+	for _, val := range l.vals {
+		m := &l.first
+		if len(l.metrics) > 0 {
+			m = &common.Metric{}
+		}
+		*m = l.m
+		if m.Modifier == "s" {
+			if len(val) == 0 {
+				l.err = errEmptySetValue
+				return
+			}
+			m.SetValue = string(val)
+		} else {
+			v, err := strconv.ParseFloat(string(val), 64)
+			if err != nil {
+				l.err = &ParseError{ReasonInvalidValue, err}
+				return
+			}
+			m.Value = v
+			if m.Modifier == "g" && (val[0] == '+' || val[0] == '-') {
+				m.Relative = true
+			}
+		}
+		l.metrics = append(l.metrics, m)
+	}
+	l.vals = l.vals[:0]
+	l.m = common.Metric{Bucket: l.m.Bucket}
+}
+
+// reasons why a line is invalid, as reported in the internal metrics
+const (
+	ReasonMissingKeySep   = "missing_key_sep"
+	ReasonEmptyKey        = "empty_key"
+	ReasonMissingValueSep = "missing_value_sep"
+	ReasonEmptySetValue   = "empty_set_value"
+	ReasonInvalidValue    = "invalid_value"
+	ReasonInvalidModifier = "invalid_modifier"
+	ReasonInvalidSampling = "invalid_sampling"
+	ReasonInvalidTags     = "invalid_tags"
+	ReasonUnknown         = "unknown"
+)
+
+// ParseError is returned for invalid lines. Reason is one of the Reason constants
+type ParseError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
 
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func parseError(reason, msg string) *ParseError {
+	return &ParseError{reason, errors.New(msg)}
+}
+
+// ParseErrorReason returns the reason of a parse error, or ReasonUnknown if it isn't a ParseError
+func ParseErrorReason(err error) string {
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		return pe.Reason
+	}
+	return ReasonUnknown
 }
 
 var (
-	errMissingKeySep   = errors.New("missing key separator")
-	errEmptyKey        = errors.New("key zero len")
-	errMissingValueSep = errors.New("missing value separator")
-	errInvalidModifier = errors.New("invalid modifier")
-	errInvalidSampling = errors.New("invalid sampling")
+	errMissingKeySep   = parseError(ReasonMissingKeySep, "missing key separator")
+	errEmptyKey        = parseError(ReasonEmptyKey, "key zero len")
+	errMissingValueSep = parseError(ReasonMissingValueSep, "missing value separator")
+	errEmptySetValue   = parseError(ReasonEmptySetValue, "set value zero len")
+	errInvalidModifier = parseError(ReasonInvalidModifier, "invalid modifier")
+	errInvalidSampling = parseError(ReasonInvalidSampling, "invalid sampling")
+	errInvalidTags     = parseError(ReasonInvalidTags, "invalid tags")
 )
 
 type stateFn func(*lexer) stateFn
@@ -71,13 +164,17 @@ func lexKey(l *lexer) stateFn {
 	return lexValueSep
 }
 
-// lex until we find the pipe separator between value and modifier
+// lex until we find the pipe separator between value and modifier,
+// or a colon separating the value from the next value
 func lexValueSep(l *lexer) stateFn {
 	for {
 		// cheap check here. ParseFloat will do it.
 		switch b := l.next(); b {
 		case '|':
 			return lexValue
+		case ':':
+			l.vals = append(l.vals, l.input[l.start:l.pos-1])
+			l.start = l.pos
 		case eof:
 			l.err = errMissingValueSep
 			return nil
@@ -85,14 +182,9 @@ func lexValueSep(l *lexer) stateFn {
 	}
 }
 
-// lex the value
+// lex the value. we can only interpret it once we know the modifier
 func lexValue(l *lexer) stateFn {
-	v, err := strconv.ParseFloat(string(l.input[l.start:l.pos-1]), 64)
-	if err != nil {
-		l.err = err
-		return nil
-	}
-	l.m.Value = v
+	l.vals = append(l.vals, l.input[l.start:l.pos-1])
 	l.start = l.pos
 	return lexModifier
 }
@@ -104,25 +196,28 @@ func lexModifier(l *lexer) stateFn {
 	case 'g':
 		fallthrough
 	case 'c':
+		fallthrough
+	case 's':
+		fallthrough
+	case 'h':
 		l.m.Modifier = string(b)
-		l.start = l.pos
-		return lexModifierSep
 	case 'm':
 		if b := l.next(); b != 's' {
 			l.err = errInvalidModifier
 			return nil
 		}
-		l.start = l.pos
 		l.m.Modifier = "ms"
-		return lexModifierSep
 	default:
 		l.err = errInvalidModifier
 		return nil
 
 	}
+	l.start = l.pos
+	return lexModifierSep
 }
 
-// lex the possible separator between modifier and samplerate
+// lex the possible separator between modifier and samplerate or tags,
+// or the colon that starts the next segment
 func lexModifierSep(l *lexer) stateFn {
 	b := l.next()
 	switch b {
@@ -130,39 +225,99 @@ func lexModifierSep(l *lexer) stateFn {
 		return nil
 	case '|':
 		l.start = l.pos
-		return lexSampleRate
+		return lexExtension
+	case ':':
+		return lexNextSegment
 	}
 	l.err = errInvalidModifier
 	return nil
 }
 
-// lex the sample rate
-func lexSampleRate(l *lexer) stateFn {
-	b := l.next()
-	if b != '@' {
-		l.err = errInvalidSampling
+// finish the current segment and start lexing the next one
+func lexNextSegment(l *lexer) stateFn {
+	l.emit()
+	if l.err != nil {
+		return nil
 	}
 	l.start = l.pos
+	return lexValueSep
+}
+
+// lex the type of extension following the modifier: sample rate or tags
+func lexExtension(l *lexer) stateFn {
+	b := l.next()
+	switch b {
+	case '@':
+		l.start = l.pos
+		return lexSampleRate
+	case '#':
+		l.start = l.pos
+		return lexTags
+	}
+	l.err = errInvalidSampling
+	return nil
+}
+
+// lex the sample rate, which may be followed by tags or the next segment
+func lexSampleRate(l *lexer) stateFn {
+	for {
+		switch b := l.next(); b {
+		case '|':
+			if !l.parseSampleRate(l.input[l.start : l.pos-1]) {
+				return nil
+			}
+			l.start = l.pos
+			return lexTagsStart
+		case ':':
+			if !l.parseSampleRate(l.input[l.start : l.pos-1]) {
+				return nil
+			}
+			return lexNextSegment
+		case eof:
+			l.parseSampleRate(l.input[l.start:])
+			return nil
+		}
+	}
+}
 
-	v, err := strconv.ParseFloat(string(l.input[l.start:]), 32)
+func (l *lexer) parseSampleRate(in []byte) bool {
+	v, err := strconv.ParseFloat(string(in), 32)
 	if err != nil {
-		l.err = err
-		return nil
+		l.err = &ParseError{ReasonInvalidSampling, err}
+		return false
 	}
 	l.m.Sampling = float32(v)
+	return true
+}
+
+// lex the start of the tags after a sample rate
+func lexTagsStart(l *lexer) stateFn {
+	if b := l.next(); b != '#' {
+		l.err = errInvalidTags
+		return nil
+	}
+	l.start = l.pos
+	return lexTags
+}
+
+// lex the tags, which run until the end of the line
+func lexTags(l *lexer) stateFn {
+	l.tags = parseTags(l.input[l.start:])
 	return nil
 }
 
 // ParseLine with lexer impl
-func ParseLine2(line []byte) (*common.Metric, error) {
+func ParseLine2(line []byte) ([]*common.Metric, error) {
 	llen := len(line)
 	if llen == 0 {
 		return nil, nil
 	}
 	l := &lexer{input: line, len: llen}
+	l.vals = l.valsArr[:0]
+	l.metrics = l.metricsArr[:0]
 	l.run()
 	if l.err != nil {
 		return nil, l.err
 	}
-	return &l.m, nil
+	return l.metrics, nil
 }
@@ -0,0 +1,160 @@
+package udp
+
+import (
+	"fmt"
+
+	m20 "github.com/metrics20/go-metrics20/carbon20"
+	"github.com/raintank/statsdaemon/common"
+)
+
+// ReasonInvalidKey is the reason for lines with a key that the KeySanitizer rejects
+const ReasonInvalidKey = "invalid_key"
+
+// SanitizeMode is what the KeySanitizer does with the keys of a metrics version
+type SanitizeMode int
+
+const (
+	SanitizeOff       SanitizeMode = iota // keys are taken as is
+	SanitizeNormalize                     // keys are normalized, and rejected if they're still invalid
+	SanitizeReject                        // keys that need normalization or are invalid are rejected
+)
+
+// KeySanitizer cleans up the keys of incoming metrics, so they don't end up as broken graphite paths.
+// normalization is like etsy statsd does it: whitespace becomes _, / becomes -, and all other characters
+// except letters, digits, _, - and . (and = for metrics 2.0 keys) are removed.
+// validation is done with the carbon20 package, at the configured level.
+// legacy and metrics 2.0 keys are configured separately.
+type KeySanitizer struct {
+	Legacy      SanitizeMode
+	LevelLegacy m20.ValidationLevelLegacy
+	M20         SanitizeMode
+	LevelM20    m20.ValidationLevelM20
+}
+
+// NewKeySanitizer parses the settings. the modes are off, normalize or reject.
+// the legacy level is strict, medium or none, the metrics 2.0 level medium or none.
+func NewKeySanitizer(legacy, levelLegacy, m2, levelM20 string) (*KeySanitizer, error) {
+	s := &KeySanitizer{}
+	modes := map[string]SanitizeMode{"off": SanitizeOff, "normalize": SanitizeNormalize, "reject": SanitizeReject}
+	var ok bool
+	if s.Legacy, ok = modes[legacy]; !ok {
+		return nil, fmt.Errorf("unknown key_sanitize_legacy %q", legacy)
+	}
+	if s.M20, ok = modes[m2]; !ok {
+		return nil, fmt.Errorf("unknown key_sanitize_m20 %q", m2)
+	}
+	switch levelLegacy {
+	case "strict":
+		s.LevelLegacy = m20.StrictLegacy
+	case "medium":
+		s.LevelLegacy = m20.MediumLegacy
+	case "none":
+		s.LevelLegacy = m20.NoneLegacy
+	default:
+		return nil, fmt.Errorf("unknown key_validation_legacy %q", levelLegacy)
+	}
+	switch levelM20 {
+	case "medium":
+		s.LevelM20 = m20.MediumM20
+	case "none":
+		s.LevelM20 = m20.NoneM20
+	default:
+		return nil, fmt.Errorf("unknown key_validation_m20 %q", levelM20)
+	}
+	return s, nil
+}
+
+// Enabled returns whether the sanitizer does anything
+func (s *KeySanitizer) Enabled() bool {
+	return s != nil && (s.Legacy != SanitizeOff || s.M20 != SanitizeOff)
+}
+
+// keyChar returns whether a character can be kept as is in a key
+func keyChar(ch byte, equals bool) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9') || ch == '_' || ch == '-' || ch == '.' || (equals && ch == '=')
+}
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == '\v' || ch == '\f'
+}
+
+// normalizeKey returns the key normalized. equals is whether = is kept
+func normalizeKey(key string, equals bool) string {
+	clean := true
+	for i := 0; i < len(key); i++ {
+		if !keyChar(key[i], equals) {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return key
+	}
+	out := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		ch := key[i]
+		switch {
+		case isSpace(ch):
+			// a run of whitespace becomes one _
+			if i == 0 || !isSpace(key[i-1]) {
+				out = append(out, '_')
+			}
+		case ch == '/':
+			out = append(out, '-')
+		case keyChar(ch, equals):
+			out = append(out, ch)
+		}
+	}
+	return string(out)
+}
+
+// Sanitize returns the key to use for the given key, or a ParseError if it is rejected
+func (s *KeySanitizer) Sanitize(key string) (string, error) {
+	version := m20.GetVersion(key)
+	mode := s.Legacy
+	if version != m20.Legacy {
+		mode = s.M20
+	}
+	if mode == SanitizeOff {
+		return key, nil
+	}
+	normalized := normalizeKey(key, version == m20.M20)
+	if normalized == "" {
+		return "", &ParseError{ReasonInvalidKey, fmt.Errorf("invalid key %q: nothing left after normalizing", key)}
+	}
+	if mode == SanitizeReject && normalized != key {
+		return "", &ParseError{ReasonInvalidKey, fmt.Errorf("invalid key %q: invalid characters", key)}
+	}
+	var err error
+	switch version {
+	case m20.M20:
+		err = m20.ValidateKeyM20(normalized, s.LevelM20)
+	case m20.M20NoEquals:
+		err = m20.ValidateKeyM20NoEquals(normalized, s.LevelM20)
+	default:
+		err = m20.ValidateKeyLegacy(normalized, s.LevelLegacy)
+	}
+	if err != nil {
+		return "", &ParseError{ReasonInvalidKey, fmt.Errorf("invalid key %q: %s", key, err)}
+	}
+	return normalized, nil
+}
+
+// ParseLine is like ParseLine2, and sanitizes the key of the metrics
+func (s *KeySanitizer) ParseLine(line []byte) ([]*common.Metric, error) {
+	metrics, err := ParseLine2(line)
+	if err != nil || len(metrics) == 0 {
+		return metrics, err
+	}
+	// all metrics of a line have the same key
+	key, err := s.Sanitize(metrics[0].Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if key != metrics[0].Bucket {
+		for _, m := range metrics {
+			m.Bucket = key
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,110 @@
+package udp
+
+import (
+	"testing"
+)
+
+func TestNewKeySanitizer(t *testing.T) {
+	s, err := NewKeySanitizer("normalize", "strict", "reject", "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Enabled() {
+		t.Fatal("expected sanitizer to be enabled")
+	}
+	s, err = NewKeySanitizer("off", "medium", "off", "medium")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Enabled() {
+		t.Fatal("expected sanitizer to be disabled")
+	}
+	for _, args := range [][4]string{
+		{"foo", "medium", "off", "medium"},
+		{"off", "foo", "off", "medium"},
+		{"off", "medium", "foo", "medium"},
+		{"off", "medium", "off", "strict"},
+	} {
+		if _, err := NewKeySanitizer(args[0], args[1], args[2], args[3]); err == nil {
+			t.Errorf("%v: expected error", args)
+		}
+	}
+}
+
+func TestKeySanitizer(t *testing.T) {
+	cases := []struct {
+		legacy, levelLegacy, m2, levelM20 string
+		in                                string
+		out                               string // empty if rejected
+	}{
+		// legacy, normalized
+		{"normalize", "medium", "off", "medium", "foo.bar", "foo.bar"},
+		{"normalize", "medium", "off", "medium", "foo bar\t baz", "foo_bar_baz"},
+		{"normalize", "medium", "off", "medium", "api/v1/users", "api-v1-users"},
+		{"normalize", "medium", "off", "medium", "caf\xc3\xa9.l*tency!", "caf.ltency"},
+		{"normalize", "medium", "off", "medium", "foo..bar", "foo..bar"},
+		{"normalize", "strict", "off", "medium", "foo..bar", ""},
+		{"normalize", "medium", "off", "medium", "#%!", ""},
+		// legacy, rejected
+		{"reject", "medium", "off", "medium", "foo.bar-baz_1", "foo.bar-baz_1"},
+		{"reject", "medium", "off", "medium", "foo bar", ""},
+		{"reject", "none", "off", "medium", "api/v1", ""},
+		{"reject", "strict", "off", "medium", "foo..bar", ""},
+		// legacy, off. metrics 2.0 settings don't apply
+		{"off", "strict", "reject", "medium", "foo bar/baz", "foo bar/baz"},
+		// metrics 2.0, normalized
+		{"off", "medium", "normalize", "medium", "unit=B.mtype=gauge.host=a b", "unit=B.mtype=gauge.host=a_b"},
+		{"off", "medium", "normalize", "medium", "unit_is_B.mtype_is_gauge.path_is_/var", "unit_is_B.mtype_is_gauge.path_is_-var"},
+		{"off", "medium", "normalize", "medium", "unit=B.mtype=gauge", ""},
+		{"off", "medium", "normalize", "none", "unit=B.mtype=gauge", "unit=B.mtype=gauge"},
+		// metrics 2.0, rejected
+		{"off", "medium", "reject", "medium", "unit=B.mtype=gauge.host=a", "unit=B.mtype=gauge.host=a"},
+		{"off", "medium", "reject", "medium", "unit=B.mtype=gauge.host=a b", ""},
+		{"off", "medium", "reject", "medium", "unit=B.host_is_a.mtype=gauge", ""},
+		{"off", "medium", "reject", "none", "host=a", "host=a"},
+		// metrics 2.0, off. legacy settings don't apply
+		{"reject", "strict", "off", "medium", "host=a b", "host=a b"},
+	}
+	for _, c := range cases {
+		s, err := NewKeySanitizer(c.legacy, c.levelLegacy, c.m2, c.levelM20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := s.Sanitize(c.in)
+		if c.out == "" {
+			if err == nil {
+				t.Errorf("%q with %v: expected rejection, got %q", c.in, c, out)
+			} else if reason := ParseErrorReason(err); reason != ReasonInvalidKey {
+				t.Errorf("%q with %v: expected reason %s, got %s", c.in, c, ReasonInvalidKey, reason)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q with %v: unexpected error %s", c.in, c, err)
+		} else if out != c.out {
+			t.Errorf("%q with %v: expected %q, got %q", c.in, c, c.out, out)
+		}
+	}
+}
+
+func TestKeySanitizerParseLine(t *testing.T) {
+	s, err := NewKeySanitizer("normalize", "medium", "reject", "medium")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := s.ParseLine([]byte("api/users latency:12:15|ms"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 2 || metrics[0].Bucket != "api-users_latency" || metrics[1].Bucket != "api-users_latency" {
+		t.Fatalf("unexpected metrics %v", metrics)
+	}
+	_, err = s.ParseLine([]byte("unit=B.mtype=gauge.host=a b:1|g"))
+	if reason := ParseErrorReason(err); reason != ReasonInvalidKey {
+		t.Fatalf("expected reason %s, got %s (%v)", ReasonInvalidKey, reason, err)
+	}
+	_, err = s.ParseLine([]byte("foo"))
+	if reason := ParseErrorReason(err); reason != ReasonMissingKeySep {
+		t.Fatalf("expected reason %s, got %s (%v)", ReasonMissingKeySep, reason, err)
+	}
+}
@@ -2,129 +2,325 @@ package udp
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"github.com/raintank/statsdaemon/common"
 	"github.com/raintank/statsdaemon/out"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"net/netip"
+	"os"
+	"sort"
 	"strconv"
+	"sync"
 )
 
 const (
 	MaxUdpPacketSize = 65535
 )
 
-// ParseLine turns a line into a *Metric (or not) and returns an error if the line was invalid.
-// note that *Metric can be nil when the line was valid (if the line was empty)
-// input format: key:value|modifier[|@samplerate]
-func ParseLine(line []byte) (metric *common.Metric, err error) {
+// parseTags turns DogStatsD style tags like "env:prod,region:eu" into a sorted
+// list of graphite style tags like "env=prod". tags without a value are dropped.
+func parseTags(in []byte) []string {
+	var tags []string
+	for _, tag := range bytes.Split(in, []byte(",")) {
+		pos := bytes.IndexByte(tag, ':')
+		if pos < 1 || pos == len(tag)-1 {
+			continue
+		}
+		tags = append(tags, string(tag[:pos])+"="+string(tag[pos+1:]))
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// ParseLine turns a line into a slice of *Metric and returns an error if the line was invalid.
+// note that the slice can be empty when the line was valid (if the line was empty)
+// input format: key:value|modifier[|@samplerate][|#tag:value,...]
+// multiple values can be packed into one line, either sharing the modifier and sample rate
+// (key:value:value|modifier) or not (key:value|modifier:value|modifier). tags apply to all of them.
+// for sets (modifier s) the value is an arbitrary string rather than a number
+// for gauges, a leading + or - means the value is a delta rather than an absolute value
+func ParseLine(line []byte) (metrics []*common.Metric, err error) {
 	if len(line) == 0 {
 		return nil, nil
 	}
-	parts := bytes.SplitN(bytes.TrimSpace(line), []byte(":"), 2)
-	if len(parts) != 2 {
-		return nil, errors.New("bad amount of colons")
+	line = bytes.TrimSpace(line)
+	var tags []string
+	if pos := bytes.Index(line, []byte("|#")); pos != -1 {
+		tags = parseTags(line[pos+2:])
+		line = line[:pos]
 	}
-	if bytes.Contains(parts[1], []byte(":")) {
-		return nil, errors.New("bad amount of colons")
+	parts := bytes.Split(line, []byte(":"))
+	if len(parts) < 2 {
+		return nil, parseError(ReasonMissingKeySep, "bad amount of colons")
 	}
 	bucket := parts[0]
 	if len(bucket) == 0 {
-		return nil, errors.New("key zero len")
-	}
-	parts = bytes.SplitN(parts[1], []byte("|"), 3)
-	if len(parts) < 2 {
-		return nil, errors.New("bad amount of pipes")
-	}
-	modifier := string(parts[1])
-	if modifier != "g" && modifier != "c" && modifier != "ms" {
-		return nil, errors.New("unsupported metric type")
+		return nil, errEmptyKey
 	}
-	sampleRate := float64(1)
-	if len(parts) == 3 {
-		if parts[2][0] != byte('@') {
-			return nil, errors.New("invalid sampling")
+	var values [][]byte
+	for _, part := range parts[1:] {
+		fields := bytes.SplitN(part, []byte("|"), 3)
+		values = append(values, fields[0])
+		if len(fields) < 2 {
+			// packed value, the modifier follows later
+			continue
 		}
-		var err error
-		sampleRate, err = strconv.ParseFloat(string(parts[2])[1:], 32)
-		if err != nil {
-			return nil, err
+		modifier := string(fields[1])
+		if modifier != "g" && modifier != "c" && modifier != "ms" && modifier != "s" && modifier != "h" {
+			return nil, parseError(ReasonInvalidModifier, "unsupported metric type")
+		}
+		sampleRate := float64(1)
+		if len(fields) == 3 {
+			if len(fields[2]) == 0 || fields[2][0] != byte('@') {
+				return nil, errInvalidSampling
+			}
+			sampleRate, err = strconv.ParseFloat(string(fields[2])[1:], 32)
+			if err != nil {
+				return nil, &ParseError{ReasonInvalidSampling, err}
+			}
 		}
+		for _, value := range values {
+			metric, err := newMetric(bucket, value, modifier, sampleRate, tags)
+			if err != nil {
+				return nil, err
+			}
+			metrics = append(metrics, metric)
+		}
+		values = values[:0]
 	}
-	value, err := strconv.ParseFloat(string(parts[0]), 64)
-	if err != nil {
-		return nil, err
+	if len(values) > 0 {
+		return nil, parseError(ReasonMissingValueSep, "bad amount of pipes")
 	}
-	metric = &common.Metric{
+	return metrics, nil
+}
+
+func newMetric(bucket, value []byte, modifier string, sampleRate float64, tags []string) (*common.Metric, error) {
+	metric := &common.Metric{
 		Bucket:   string(bucket),
-		Value:    value,
 		Modifier: modifier,
 		Sampling: float32(sampleRate),
+		Tags:     tags,
+	}
+	if modifier == "s" {
+		if len(value) == 0 {
+			return nil, errEmptySetValue
+		}
+		metric.SetValue = string(value)
+		return metric, nil
+	}
+	var err error
+	metric.Value, err = strconv.ParseFloat(string(value), 64)
+	if err != nil {
+		return nil, &ParseError{ReasonInvalidValue, err}
+	}
+	if modifier == "g" && (value[0] == '+' || value[0] == '-') {
+		metric.Relative = true
 	}
 	return metric, nil
 }
 
 // ParseMessage turns byte data into a slice of metric pointers
-// note that it creates "invalid line" metrics itself, upon invalid lines,
+// note that it creates "invalid line" metrics itself, upon invalid lines, one per reason (see ParseError),
 // which will get passed on and aggregated along with the other metrics
 func ParseMessage(data []byte, prefix_internal string, output *out.Output, parse parseLineFunc) (metrics []*common.Metric) {
+	return ParseClientMessage(data, &out.ClientAmounts{}, prefix_internal, output, parse)
+}
+
+// ParseClientMessage is like ParseMessage, for a packet sent by client. it counts the packet and its
+// (invalid) lines in client, and reports the invalid lines along with the source of the client.
+func ParseClientMessage(data []byte, client *out.ClientAmounts, prefix_internal string, output *out.Output, parse parseLineFunc) (metrics []*common.Metric) {
+	client.Packets++
 	for _, line := range bytes.Split(data, []byte("\n")) {
-		metric, err := parse(line)
+		if len(line) > 0 {
+			client.Lines++
+		}
+		lineMetrics, err := parse(line)
 		if err != nil {
+			client.Invalid++
 			// data will be repurposed by the udpListener
 			report_line := make([]byte, len(line), len(line))
 			copy(report_line, line)
-			output.Invalid_lines.Broadcast <- report_line
-			metric = &common.Metric{
-				Bucket:   fmt.Sprintf("%smtype_is_count.type_is_invalid_line.unit_is_Err", prefix_internal),
+			reason := ParseErrorReason(err)
+			output.Invalid_lines.Broadcast <- out.InvalidLine{Source: client.Source, Reason: reason, Line: report_line}
+			metrics = append(metrics, &common.Metric{
+				Bucket:   fmt.Sprintf("%smtype_is_count.type_is_invalid_line.reason_is_%s.unit_is_Err", prefix_internal, reason),
 				Value:    float64(1),
 				Modifier: "c",
 				Sampling: float32(1),
-			}
+			})
 		} else {
 			// data will be repurposed by the udpListener
 			report_line := make([]byte, len(line), len(line))
 			copy(report_line, line)
 			output.Valid_lines.Broadcast <- report_line
-		}
-		if metric != nil {
-			metrics = append(metrics, metric)
+			metrics = append(metrics, lineMetrics...)
 		}
 	}
 	return metrics
 }
 
-type parseLineFunc func(line []byte) (metric *common.Metric, err error)
+// clientBatch sums up what each source ip sent in a batch of packets
+type clientBatch struct {
+	index   map[netip.Addr]int
+	amounts []out.ClientAmounts
+}
+
+// get returns the amounts of the source. the pointer is only valid until the next call
+func (b *clientBatch) get(addr netip.Addr) *out.ClientAmounts {
+	i, ok := b.index[addr]
+	if !ok {
+		i = len(b.amounts)
+		b.index[addr] = i
+		b.amounts = append(b.amounts, out.ClientAmounts{Source: addr.String()})
+	}
+	return &b.amounts[i]
+}
+
+// take returns the amounts of the batch, and starts a new one
+func (b *clientBatch) take() []out.ClientAmounts {
+	amounts := b.amounts
+	b.amounts = nil
+	for addr := range b.index {
+		delete(b.index, addr)
+	}
+	return amounts
+}
 
-func StatsListener(listen_addr, prefix_internal string, output *out.Output) {
-	Listener(listen_addr, prefix_internal, output, ParseLine2)
+type parseLineFunc func(line []byte) (metrics []*common.Metric, err error)
+
+func StatsListener(listen_addr, prefix_internal string, sockets, rcvbuf int, output *out.Output) {
+	Listener(listen_addr, prefix_internal, sockets, rcvbuf, output, ParseLine2)
+}
+
+func StatsUnixgramListener(path, prefix_internal string, output *out.Output) {
+	UnixgramListener(path, prefix_internal, output, ParseLine2)
 }
 
 // Listener receives packets from the udp buffer, parses them and feeds both the Metrics channel
-// as well as the metricAmounts channel
-func Listener(listen_addr, prefix_internal string, output *out.Output, parse parseLineFunc) {
-	address, err := net.ResolveUDPAddr("udp", listen_addr)
+// as well as the metricAmounts channel, until output.Done is closed.
+// with more than 1 socket, it opens them all on listen_addr with SO_REUSEPORT, each with their own
+// reader, and the kernel spreads the incoming packets over them.
+// rcvbuf sets the receive buffer size of the sockets (SO_RCVBUF). 0 means the system default.
+func Listener(listen_addr, prefix_internal string, sockets, rcvbuf int, output *out.Output, parse parseLineFunc) {
+	lc, err := listenConfig(sockets > 1)
 	if err != nil {
-		log.Fatalf("cannot resolve '%s' - %s", listen_addr, err)
+		log.Fatalf("cannot listen on %d sockets - %s", sockets, err)
+	}
+	conns := make([]*net.UDPConn, sockets)
+	for i := range conns {
+		conn, err := lc.ListenPacket(context.Background(), "udp", listen_addr)
+		if err != nil {
+			log.Fatalf("listenUDP - %s", err)
+		}
+		conns[i] = conn.(*net.UDPConn)
+		if rcvbuf > 0 {
+			err = conns[i].SetReadBuffer(rcvbuf)
+			if err != nil {
+				log.Fatalf("cannot set receive buffer to %d bytes - %s", rcvbuf, err)
+			}
+		}
 	}
+	log.Infof("listening on %s (%d sockets)", conns[0].LocalAddr(), sockets)
 
-	listener, err := net.ListenUDP("udp", address)
+	go monitorDrops(conns, prefix_internal, output)
+	go func() {
+		// unblocks the readers
+		<-output.Done
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *net.UDPConn) {
+			defer wg.Done()
+			defer conn.Close()
+			read(conn, prefix_internal, output, parse)
+		}(conn)
+	}
+	wg.Wait()
+}
+
+// UnixgramListener is like Listener, but for a unix datagram socket at path, replacing any stale socket file
+func UnixgramListener(path, prefix_internal string, output *out.Output, parse parseLineFunc) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
 	if err != nil {
-		log.Fatalf("listenUDP - %s", err)
+		log.Fatalf("listen unixgram - %s", err)
 	}
-	defer listener.Close()
-	log.Infof("listening on %s", address)
+	defer conn.Close()
+	log.Infof("listening on unixgram %s", path)
+	go func() {
+		<-output.Done
+		conn.Close()
+	}()
 
 	message := make([]byte, MaxUdpPacketSize)
 	for {
-		n, remaddr, err := listener.ReadFromUDP(message)
+		n, addr, err := conn.ReadFromUnix(message)
 		if err != nil {
-			log.Errorf("reading UDP packet from %+v - %s", remaddr, err)
+			if output.Stopped() {
+				return
+			}
+			log.Errorf("reading unixgram packet on %s - %s", path, err)
 			continue
 		}
-		metrics := ParseMessage(message[:n], prefix_internal, output, parse)
+		// senders only have an address if they bound their socket
+		client := out.ClientAmounts{Source: "unixgram"}
+		if addr != nil && addr.Name != "" {
+			client.Source = addr.Name
+		}
+		metrics := ParseClientMessage(message[:n], &client, prefix_internal, output, parse)
 		output.Metrics <- metrics
 		output.MetricAmounts <- metrics
+		output.ReportClients([]out.ClientAmounts{client})
+	}
+}
+
+// read reads packets from one socket, in batches where supported
+func read(conn *net.UDPConn, prefix_internal string, output *out.Output, parse parseLineFunc) {
+	r, err := newPacketReader(conn)
+	if err != nil {
+		log.Fatalf("cannot read from %s - %s", conn.LocalAddr(), err)
+	}
+	clients := clientBatch{index: make(map[netip.Addr]int)}
+	for {
+		packets, sources, err := r.ReadBatch()
+		if err != nil {
+			if output.Stopped() {
+				return
+			}
+			log.Errorf("reading UDP packets on %s - %s", conn.LocalAddr(), err)
+			continue
+		}
+		for i, packet := range packets {
+			metrics := ParseClientMessage(packet, clients.get(sources[i]), prefix_internal, output, parse)
+			output.Metrics <- metrics
+			output.MetricAmounts <- metrics
+		}
+		output.ReportClients(clients.take())
+	}
+}
+
+// packetReader reads one or more packets at once from a socket
+type packetReader interface {
+	// ReadBatch blocks until at least one packet is available, and returns the packets and the ip
+	// addresses they came from. they are only valid until the next call.
+	ReadBatch() ([][]byte, []netip.Addr, error)
+}
+
+// dropMetric returns the internal metric for the amount of packets the kernel dropped for the socket
+func dropMetric(prefix_internal string, socket int, drops uint64) *common.Metric {
+	return &common.Metric{
+		Bucket:   fmt.Sprintf("%smtype_is_count.type_is_udp_drop.socket_is_%d.unit_is_Pckt", prefix_internal, socket),
+		Value:    float64(drops),
+		Modifier: "c",
+		Sampling: float32(1),
 	}
 }
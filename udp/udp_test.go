@@ -3,77 +3,214 @@ package udp
 import (
 	"errors"
 	"github.com/raintank/statsdaemon/common"
+	"github.com/raintank/statsdaemon/out"
 	"reflect"
 	"testing"
 )
 
-func runTest(t *testing.T, f func([]byte) (*common.Metric, error)) {
-	// input format: key:value|modifier[|@samplerate]
+func runTest(t *testing.T, f func([]byte) ([]*common.Metric, error)) {
+	// input format: key:value|modifier[|@samplerate][|#tag:value,...]
 	type Case struct {
-		Type      string
-		In        string
-		OutMetric *common.Metric
-		OutErr    []error // we allow more than one phrasing
+		Type       string
+		In         string
+		OutMetrics []*common.Metric
+		OutErr     []error // we allow more than one phrasing
 	}
 
 	tests := []Case{
 		Case{
 			"gauge-int-simple",
 			"search.solr.clips.results:78186|g",
-			&common.Metric{
+			[]*common.Metric{{
 				Bucket:   "search.solr.clips.results",
 				Value:    78186,
 				Modifier: "g",
 				Sampling: float32(1),
-			},
+			}},
 			nil,
 		},
 		/*
 			Case{
 				"counter-int-simple-trailing-white",
 				"cliapp1.queue.consumer.VideoFile_PruneSourceFilesV6.processing.10_90_128_162.removed:1|c  ",
-				&common.Metric{
+				[]*common.Metric{{
 					Bucket:   "cliapp1.queue.consumer.VideoFile_PruneSourceFilesV6.processing.10_90_128_162.removed",
 					Value:    1,
 					Modifier: "c",
 					Sampling: float32(1),
-				},
+				}},
 				nil,
 			},
 			Case{
 				"  timing-float-with-samplerate-prefix-whitespace",
 				"lvimdfs3.object-replicator.partition.update.timing:3.69596481323|ms|@0.05",
-				&common.Metric{
+				[]*common.Metric{{
 					Bucket:   "lvimdfs3.object-replicator.partition.update.timing",
 					Value:    3.69596481323,
 					Modifier: "ms",
 					Sampling: float32(0.05),
-				},
+				}},
 				nil,
 			},
 		*/
 		Case{
 			"funky-chars",
 			"foo%bar=yes:12|ms|@0.05",
-			&common.Metric{
+			[]*common.Metric{{
 				Bucket:   "foo%bar=yes",
 				Value:    12,
 				Modifier: "ms",
 				Sampling: float32(0.05),
-			},
+			}},
 			nil,
 		},
 		Case{
 			"middle-whitespace",
 			"foo bar:12|ms|@0.05",
-			&common.Metric{
+			[]*common.Metric{{
 				Bucket:   "foo bar",
 				Value:    12,
 				Modifier: "ms",
 				Sampling: float32(0.05),
+			}},
+			nil,
+		},
+		Case{
+			"gauge-delta",
+			"queue.size:-3|g",
+			[]*common.Metric{{
+				Bucket:   "queue.size",
+				Value:    -3,
+				Relative: true,
+				Modifier: "g",
+				Sampling: float32(1),
+			}},
+			nil,
+		},
+		Case{
+			"counter-sign",
+			"requests:+3|c",
+			[]*common.Metric{{
+				Bucket:   "requests",
+				Value:    3,
+				Modifier: "c",
+				Sampling: float32(1),
+			}},
+			nil,
+		},
+		Case{
+			"set",
+			"users.online:alice|s",
+			[]*common.Metric{{
+				Bucket:   "users.online",
+				SetValue: "alice",
+				Modifier: "s",
+				Sampling: float32(1),
+			}},
+			nil,
+		},
+		Case{
+			"histogram",
+			"api.latency:12.5|h|@0.5",
+			[]*common.Metric{{
+				Bucket:   "api.latency",
+				Value:    12.5,
+				Modifier: "h",
+				Sampling: float32(0.5),
+			}},
+			nil,
+		},
+		Case{
+			"empty-set-value",
+			"users.online:|s",
+			nil,
+			[]error{errors.New("set value zero len")},
+		},
+		Case{
+			"tags",
+			"api.requests:1|c|#region:eu,env:prod",
+			[]*common.Metric{{
+				Bucket:   "api.requests",
+				Value:    1,
+				Modifier: "c",
+				Sampling: float32(1),
+				Tags:     []string{"env=prod", "region=eu"},
+			}},
+			nil,
+		},
+		Case{
+			"samplerate-and-tags",
+			"api.latency:12|ms|@0.1|#env:prod,novalue",
+			[]*common.Metric{{
+				Bucket:   "api.latency",
+				Value:    12,
+				Modifier: "ms",
+				Sampling: float32(0.1),
+				Tags:     []string{"env=prod"},
+			}},
+			nil,
+		},
+		Case{
+			"invalid-extension",
+			"api.latency:12|ms|env",
+			nil,
+			[]error{errors.New("invalid sampling")},
+		},
+		Case{
+			"invalid-tags",
+			"api.latency:12|ms|@0.1|env",
+			nil,
+			[]error{errors.New("invalid tags"), errors.New("strconv.ParseFloat: parsing \"0.1|env\": invalid syntax")},
+		},
+		Case{
+			"packed-values",
+			"api.latency:12:15:9|ms|@0.5",
+			[]*common.Metric{
+				{Bucket: "api.latency", Value: 12, Modifier: "ms", Sampling: float32(0.5)},
+				{Bucket: "api.latency", Value: 15, Modifier: "ms", Sampling: float32(0.5)},
+				{Bucket: "api.latency", Value: 9, Modifier: "ms", Sampling: float32(0.5)},
+			},
+			nil,
+		},
+		Case{
+			"packed-segments",
+			"api.latency:12|ms|@0.1:15|ms:1:2|ms|@0.25",
+			[]*common.Metric{
+				{Bucket: "api.latency", Value: 12, Modifier: "ms", Sampling: float32(0.1)},
+				{Bucket: "api.latency", Value: 15, Modifier: "ms", Sampling: float32(1)},
+				{Bucket: "api.latency", Value: 1, Modifier: "ms", Sampling: float32(0.25)},
+				{Bucket: "api.latency", Value: 2, Modifier: "ms", Sampling: float32(0.25)},
 			},
 			nil,
 		},
+		Case{
+			"packed-mixed-types-with-tags",
+			"queue:+1|g:5:6|c|@0.5|#env:prod",
+			[]*common.Metric{
+				{Bucket: "queue", Value: 1, Relative: true, Modifier: "g", Sampling: float32(1), Tags: []string{"env=prod"}},
+				{Bucket: "queue", Value: 5, Modifier: "c", Sampling: float32(0.5), Tags: []string{"env=prod"}},
+				{Bucket: "queue", Value: 6, Modifier: "c", Sampling: float32(0.5), Tags: []string{"env=prod"}},
+			},
+			nil,
+		},
+		Case{
+			"packed-missing-modifier",
+			"api.latency:12:15",
+			nil,
+			[]error{errors.New("bad amount of pipes"), errors.New("missing value separator")},
+		},
+		Case{
+			"packed-trailing-colon",
+			"api.latency:12|ms:",
+			nil,
+			[]error{errors.New("bad amount of pipes"), errors.New("missing value separator")},
+		},
+		Case{
+			"packed-bad-value",
+			"api.latency:12:x|ms",
+			nil,
+			[]error{errors.New("strconv.ParseFloat: parsing \"x\": invalid syntax")},
+		},
 		Case{
 			"empty-key",
 			":12|ms|@0.05",
@@ -119,7 +256,7 @@ func runTest(t *testing.T, f func([]byte) (*common.Metric, error)) {
 	}
 
 	for _, c := range tests {
-		metric, err := f([]byte(c.In))
+		metrics, err := f([]byte(c.In))
 		if c.OutErr == nil {
 			if err != nil {
 				t.Errorf("case %s failed\nin: %s\nexpected err: %v\nreceived err: %v\n", c.Type, c.In, c.OutErr, err)
@@ -136,14 +273,74 @@ func runTest(t *testing.T, f func([]byte) (*common.Metric, error)) {
 				t.Errorf("case %s failed\nin: %s\nexpected one of err: %v\nreceived err:         %v\n", c.Type, c.In, c.OutErr, err)
 			}
 		}
-		metricEqual := reflect.DeepEqual(c.OutMetric, metric)
-		if !metricEqual {
-			t.Errorf("case %s failed\nin: %s\nexpected metric: %v\nreceived metric: %v\n", c.Type, c.In, c.OutMetric, metric)
+		metricsEqual := reflect.DeepEqual(c.OutMetrics, metrics)
+		if !metricsEqual {
+			t.Errorf("case %s failed\nin: %s\nexpected metrics: %v\nreceived metrics: %v\n", c.Type, c.In, c.OutMetrics, metrics)
+		}
+	}
+}
+
+func TestParseMessagePacked(t *testing.T) {
+	output := out.NullOutput()
+	metrics := ParseMessage([]byte("api.latency:12:15|ms|@0.1\nrequests:1|c\nbad:12:15"), "", output, ParseLine2)
+	if len(metrics) != 4 {
+		t.Fatalf("expected 4 metrics, got %d: %v", len(metrics), metrics)
+	}
+	for i, exp := range []float64{12, 15} {
+		if metrics[i].Value != exp || metrics[i].Sampling != float32(0.1) {
+			t.Errorf("metric %d: expected value %f with sampling 0.1, got %v", i, exp, metrics[i])
+		}
+	}
+	if metrics[3].Bucket != "mtype_is_count.type_is_invalid_line.reason_is_missing_value_sep.unit_is_Err" {
+		t.Errorf("expected invalid line metric, got %v", metrics[3])
+	}
+}
+
+func TestParseErrorReason(t *testing.T) {
+	cases := []struct {
+		in     string
+		reason string
+	}{
+		{"foo", ReasonMissingKeySep},
+		{":1|c", ReasonEmptyKey},
+		{"foo:1", ReasonMissingValueSep},
+		{"foo:|s", ReasonEmptySetValue},
+		{"foo:x|c", ReasonInvalidValue},
+		{"foo:1|x", ReasonInvalidModifier},
+		{"foo:1|c|x", ReasonInvalidSampling},
+		{"foo:1|c|@x", ReasonInvalidSampling},
+	}
+	for _, parse := range []parseLineFunc{ParseLine, ParseLine2} {
+		for _, c := range cases {
+			_, err := parse([]byte(c.in))
+			if reason := ParseErrorReason(err); reason != c.reason {
+				t.Errorf("%q: expected reason %s, got %s (%v)", c.in, c.reason, reason, err)
+			}
 		}
 	}
+	if reason := ParseErrorReason(errors.New("foo")); reason != ReasonUnknown {
+		t.Errorf("expected reason %s for other errors, got %s", ReasonUnknown, reason)
+	}
+}
+
+func TestParseClientMessage(t *testing.T) {
+	output := out.NullOutput()
+	consumer := make(chan interface{}, 10)
+	output.Invalid_lines.Register(consumer)
+	client := out.ClientAmounts{Source: "10.0.0.1"}
+	ParseClientMessage([]byte("a:1|c\nbad\n"), &client, "", output, ParseLine2)
+	ParseClientMessage([]byte("b:1|c"), &client, "", output, ParseLine2)
+	exp := out.ClientAmounts{Source: "10.0.0.1", Packets: 2, Lines: 3, Invalid: 1}
+	if client != exp {
+		t.Fatalf("expected %v, got %v", exp, client)
+	}
+	line := (<-consumer).(out.InvalidLine)
+	if line.Source != "10.0.0.1" || line.Reason != ReasonMissingKeySep || string(line.Line) != "bad" {
+		t.Fatalf("unexpected invalid line %v", line)
+	}
 }
 
-func runBench(b *testing.B, f func([]byte) (*common.Metric, error)) {
+func runBench(b *testing.B, f func([]byte) ([]*common.Metric, error)) {
 	var err error
 	line1 := []byte("cat:12.0231|ms")
 	line2 := []byte("meow:45.0231|g|@54.12")